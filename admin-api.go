@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Admin API for managing areas at runtime. All changes are made in the
+// work manager goroutine.
+//
+//  GET    <root_key>/areas       list areas
+//  POST   <root_key>/areas       create area, body is the area details
+//  PATCH  <root_key>/areas/<id>  edit area fields, e.g. {"enabled": true}
+//  DELETE <root_key>/areas/<id>  delete area (moved to the trash directory)
+
+func handleAreas(w http.ResponseWriter, r *http.Request) {
+	area_id := areaID(strings.TrimPrefix(r.URL.Path, root_key+"/areas"))
+	area_id = areaID(strings.TrimPrefix(string(area_id), "/"))
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(r.Body); err != nil {
+		return
+	}
+	var rsp interface{}
+	var err error
+	switch {
+	case area_id == "" && r.Method == http.MethodGet:
+		err = mgrCall(func() error {
+			rsp = mgrListAreas()
+			return nil
+		})
+	case area_id == "" && r.Method == http.MethodPost:
+		err = mgrCall(func() (err error) {
+			rsp, err = mgrCreateArea(buf.Bytes())
+			return err
+		})
+	case area_id != "" && r.Method == http.MethodPatch:
+		var fields map[string]json.RawMessage
+		if err = json.Unmarshal(buf.Bytes(), &fields); err != nil {
+			err = errBadRequest("decoding area fields failed: %v", err)
+			break
+		}
+		err = mgrCall(func() (err error) {
+			rsp, err = mgrEditArea(area_id, fields)
+			return err
+		})
+	case area_id != "" && r.Method == http.MethodDelete:
+		err = mgrCall(func() error {
+			rsp = true
+			return mgrDeleteArea(area_id)
+		})
+	default:
+		err = &reqError{http.StatusMethodNotAllowed, "method not allowed"}
+	}
+	if err != nil {
+		log.Printf("area request %v %v failed: %v\n", r.Method, r.URL.Path, err)
+		writeRspError(w, err)
+		return
+	}
+	writeRspJSON(w, rsp)
+}
+
+func writeRspJSON(w http.ResponseWriter, v interface{}) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		writeRspInternalError(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(raw)
+}
+
+func mgrListAreas() []areaInfo {
+	infos := []areaInfo{}
+	for _, area := range areas {
+		infos = append(infos, area.describe())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+func mgrCreateArea(raw []byte) (areaInfo, error) {
+	var head struct {
+		ID areaID
+	}
+	if err := json.Unmarshal(raw, &head); err != nil {
+		return areaInfo{}, errBadRequest("decoding area details failed: %v", err)
+	}
+	if strings.ContainsAny(string(head.ID), "/\\") {
+		return areaInfo{}, errBadRequest("invalid area id: %v", head.ID)
+	}
+	a, err := newArea(head.ID)
+	if err != nil {
+		return areaInfo{}, errBadRequest("%v", err)
+	}
+	if areas[head.ID] != nil {
+		return areaInfo{}, errConflict("area %v already exists", head.ID)
+	}
+	// Check that details decode into the area type before writing them.
+	if err := json.Unmarshal(raw, a); err != nil {
+		return areaInfo{}, errBadRequest("decoding area details failed: %v", err)
+	}
+	area_dir := path.Join(state_dir_path, string(head.ID))
+	if _, err := os.Stat(area_dir); err == nil {
+		return areaInfo{}, errConflict("area directory %v already exists", area_dir)
+	}
+	if err := os.Mkdir(area_dir, 0755); err != nil {
+		return areaInfo{}, err
+	}
+	err = writeFileAtomic(path.Join(area_dir, "details"), raw)
+	if err == nil {
+		err = snapshotStateDir(area_dir)
+	}
+	if err == nil {
+		if err = a.load(head.ID, area_dir); err != nil {
+			err = errBadRequest("%v", err)
+		}
+	}
+	if err == nil {
+		err = syncAreaDir(area_dir)
+	}
+	if err != nil {
+		// Do not leave a broken area that fails loading on next startup.
+		os.RemoveAll(area_dir)
+		return areaInfo{}, err
+	}
+	areas[head.ID] = a
+	log.Printf("created %v\n", head.ID)
+	return a.describe(), nil
+}
+
+func mgrEditArea(area_id areaID, fields map[string]json.RawMessage) (areaInfo, error) {
+	area := areas[area_id]
+	if area == nil {
+		return areaInfo{}, errNotFound("invalid area id: %v", area_id)
+	}
+	edited, err := area.edit(fields)
+	if err != nil {
+		return areaInfo{}, err
+	}
+	// The area is only replaced once the edit is stored.
+	if err := edited.store(); err != nil {
+		return areaInfo{}, err
+	}
+	areas[area_id] = edited
+	log.Printf("edited %v\n", area_id)
+	return edited.describe(), nil
+}
+
+func mgrDeleteArea(area_id areaID) error {
+	if areas[area_id] == nil {
+		return errNotFound("invalid area id: %v", area_id)
+	}
+	area_dir := path.Join(state_dir_path, string(area_id))
+	files, err := ioutil.ReadDir(area_dir)
+	if err != nil {
+		return err
+	}
+	trash_dir := path.Join(state_dir_path, trashDirName)
+	if err := os.MkdirAll(trash_dir, 0755); err != nil {
+		return err
+	}
+	trash_path := path.Join(trash_dir, fmt.Sprintf("%s.%d", area_id, time.Now().Unix()))
+	if err := os.Rename(area_dir, trash_path); err != nil {
+		return err
+	}
+	if err := syncDir(state_dir_path); err != nil {
+		return err
+	}
+	delete(areas, area_id)
+	// Remove area from web clients.
+	for _, file := range files {
+		syncNotify(pathSyncKey(path.Join(area_dir, file.Name())), "null")
+	}
+	log.Printf("deleted %v, moved to %v\n", area_id, trash_path)
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// Sends an admin API request and returns the response status and body.
+func adminRequest(method, url_path, body string) (int, string) {
+	r := httptest.NewRequest(method, root_key+url_path, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	handleAreas(w, r)
+	return w.Code, w.Body.String()
+}
+
+func TestAdminAreas(t *testing.T) {
+	state_dir := simStateDir(t, nil)
+	if err := simBootServer(state_dir); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{http.MethodPost, "/areas", `{"ID": "mine.0", "Pos": [0, 60, 0], "Depth": 4}`, http.StatusOK},
+		{http.MethodPost, "/areas", `{"ID": "mine.0", "Depth": 4}`, http.StatusConflict},
+		{http.MethodPost, "/areas", `{"ID": "quarry.0"}`, http.StatusBadRequest},
+		{http.MethodPatch, "/areas/mine.0", `{"enabled": true, "depth": 0}`, http.StatusBadRequest},
+		{http.MethodPatch, "/areas/mine.0", `{"Depth": 8}`, http.StatusBadRequest},
+		{http.MethodPatch, "/areas/mine.0", `{"enabled": true, "depth": 8}`, http.StatusOK},
+		{http.MethodPatch, "/areas/mine.1", `{"enabled": true}`, http.StatusNotFound},
+		{http.MethodPut, "/areas/mine.0", `{}`, http.StatusMethodNotAllowed},
+	}
+	for _, test := range tests {
+		if status, body := adminRequest(test.method, test.path, test.body); status != test.want {
+			t.Errorf("%v %v %v: got status %v (%v), want %v", test.method, test.path, test.body, status, body, test.want)
+		}
+	}
+	m := areas["mine.0"].(*mineArea)
+	if !m.Enabled || m.Depth != 8 {
+		t.Errorf("edited mine: enabled %v, depth %v, want true and 8", m.Enabled, m.Depth)
+	}
+	// The successful edit is stored.
+	if raw := readTestFile(t, path.Join(state_dir, "mine.0", "details")); !strings.Contains(raw, `"Depth": 8`) {
+		t.Errorf("stored details: %v", raw)
+	}
+	// An edit that cannot be stored leaves the area unchanged.
+	area_dir := path.Join(state_dir, "mine.0")
+	if err := os.Rename(area_dir, area_dir+".moved"); err != nil {
+		t.Fatal(err)
+	}
+	status, body := adminRequest(http.MethodPatch, "/areas/mine.0", `{"depth": 12}`)
+	if err := os.Rename(area_dir+".moved", area_dir); err != nil {
+		t.Fatal(err)
+	}
+	if status == http.StatusOK {
+		t.Errorf("edit without the area directory: got status %v (%v)", status, body)
+	}
+	if m := areas["mine.0"].(*mineArea); m.Depth != 8 {
+		t.Errorf("depth %v after failed edit, want 8", m.Depth)
+	}
+	if status, body := adminRequest(http.MethodDelete, "/areas/mine.0", ""); status != http.StatusOK {
+		t.Fatalf("delete: got status %v (%v)", status, body)
+	}
+	if _, err := os.Stat(path.Join(state_dir, "mine.0")); !os.IsNotExist(err) {
+		t.Errorf("area directory left after delete: %v", err)
+	}
+	if status, body := adminRequest(http.MethodGet, "/areas", ""); status != http.StatusOK || body != "[]" {
+		t.Errorf("list after delete: got status %v (%v), want empty list", status, body)
+	}
+}
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"time"
 )
 
+func init() {
+	registerAreaType("farm", func() area { return new(farmArea) })
+}
+
 type farmArea struct {
 	Enabled bool
 	Path    string `json:"-"`
@@ -15,10 +20,134 @@ type farmArea struct {
 	Pos       vec3
 	Seeds     []itemID
 	Plots     []*farmPlot
+	Fuel      fuelPolicy `json:"fuel"`
+	// estimated number of items in the fuel box
+	SupplyLevels map[string]int `json:"supply_levels"`
+}
+
+func (f farmArea) store() error {
+	return storeJSON(f.Path, f)
+}
+
+func (f farmArea) id() areaID {
+	return f.ID
+}
+
+func (f farmArea) getFuel() fuelPolicy {
+	return f.Fuel
+}
+
+func (f farmArea) describe() areaInfo {
+	n_assigned := 0
+	for _, plot := range f.Plots {
+		if plot.Assignee != "" {
+			n_assigned++
+		}
+	}
+	return areaInfo{
+		ID:      f.ID,
+		Type:    "farm",
+		Enabled: f.Enabled,
+		Pos:     f.Pos,
+		Details: map[string]interface{}{
+			"interval": f.Interval,
+			"plots":    len(f.Plots),
+			"assigned": n_assigned,
+		},
+	}
 }
 
-func (f farmArea) store() {
-	storeJSON(f.Path, f)
+func (f *farmArea) load(area_id areaID, area_dir string) error {
+	f.Path = fmt.Sprintf("%s/details", area_dir)
+	if err := readJSON(f.Path, f); err != nil {
+		return err
+	}
+	if f.ID != area_id {
+		return fmt.Errorf("invalid farm id: %v, expected: %v", f.ID, area_id)
+	}
+	for i, plot := range f.Plots {
+		plot.Level = i
+	}
+	if f.SupplyLevels == nil {
+		f.SupplyLevels = map[string]int{}
+	}
+	f.Fuel.init()
+	return nil
+}
+
+func (f *farmArea) keepAllocations(old area) {
+	old_f, ok := old.(*farmArea)
+	if !ok {
+		return
+	}
+	if old_f.WorkIDSeq > f.WorkIDSeq {
+		f.WorkIDSeq = old_f.WorkIDSeq
+	}
+	warnKeptField(f.ID, "SupplyLevels", old_f.SupplyLevels, f.SupplyLevels)
+	f.SupplyLevels = old_f.SupplyLevels
+	// Plots are identified by level.
+	for i, old_plot := range old_f.Plots {
+		if old_plot.Assignee != "" && i < len(f.Plots) {
+			warnKeptField(f.ID, fmt.Sprintf("assignee of plot %v", i), old_plot.Assignee, f.Plots[i].Assignee)
+			f.Plots[i].Assignee = old_plot.Assignee
+			f.Plots[i].WorkID = old_plot.WorkID
+		}
+	}
+}
+
+func (f *farmArea) decideWork(t turtle) (*job, error) {
+	return mgrDecideFarmWork(t, f)
+}
+
+func (f *farmArea) releaseTurtle(label turtleID) bool {
+	released := false
+	for _, plot := range f.Plots {
+		if plot.Assignee == label {
+			// Plant time is not updated so the plot is farmed again.
+			plot.Assignee = ""
+			plot.WorkID = workID(0)
+			released = true
+		}
+	}
+	return released
+}
+
+func (f *farmArea) edit(fields map[string]json.RawMessage) (area, error) {
+	edited := *f
+	// Decoded into a new slice, decoding into the current one would
+	// overwrite its items.
+	var seeds []itemID
+	var fuel_raw json.RawMessage
+	err := decodeAreaFields(fields, map[string]interface{}{
+		"enabled":  &edited.Enabled,
+		"interval": &edited.Interval,
+		"seeds":    &seeds,
+		"fuel":     &fuel_raw,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if seeds != nil {
+		edited.Seeds = seeds
+	}
+	if edited.Interval <= 0 {
+		return nil, errBadRequest("invalid farm interval: %v", edited.Interval)
+	}
+	for _, seed := range edited.Seeds {
+		if seed == "" {
+			return nil, errBadRequest("invalid empty farm seed")
+		}
+	}
+	if fuel_raw != nil {
+		if err := edited.Fuel.edit(fuel_raw); err != nil {
+			return nil, err
+		}
+	}
+	return &edited, nil
+}
+
+func (f *farmArea) handleExport(er exportRequest) (*exportOrder, error) {
+	return nil, errBadRequest("farm area %v does not export items", f.ID)
 }
 
 type farmPlot struct {
@@ -47,6 +176,18 @@ func (f farmArea) getBoxLoadCoord(box_id int) vec3 {
 	}
 }
 
+// Supply boxes: "fuel".
+func (f farmArea) supplyBox(box string) (vec3, vec3, bool) {
+	if box != "fuel" {
+		return vec3{}, vec3{}, false
+	}
+	return f.getBoxLoadCoord(1), f.getBoxLoadDir(1), true
+}
+
+func (f farmArea) supplyLevels() map[string]int {
+	return f.SupplyLevels
+}
+
 func (f farmArea) getDecendOrigin() vec3 {
 	return vec3Add(f.Pos, vec3{-4, 2, 6})
 }
@@ -65,7 +206,7 @@ func (f farmArea) getQ() qCoords {
 	}
 }
 
-func (f farmArea) getElevatorJob(t turtle, dst_level int) *string {
+func (f farmArea) getElevatorJob(t turtle, dst_level int) *job {
 	cur_level := -(t.CurPos[1] - f.Pos[1] - 2) / 3
 	fmt.Printf("cur level: %d, dst_level: %d\n", cur_level, dst_level)
 	if cur_level < 0 {
@@ -85,35 +226,30 @@ func (f farmArea) getElevatorJob(t turtle, dst_level int) *string {
 		vec3{elevator[0], elevator[1] - cur_level*3, elevator[2]},
 		vec3{elevator[0], elevator[1] - dst_level*3, elevator[2]},
 	}
-	job := makeJobGo(workIDTmp, waypoints)
-	return &job
+	return makeJobGo(workIDTmp, waypoints)
 }
 
-func (f farmArea) getWaitJob(t turtle) *string {
+func (f farmArea) getWaitJob(t turtle) *job {
 	queue := f.getQ()
 	if vec3Equal(t.CurPos, queue.origin) {
-		idle_job := makeJobIdle(workIDTmp, 10)
-		return &idle_job
+		return makeJobIdle(workIDTmp, 10)
 	}
 	elevator_job := f.getElevatorJob(t, 0)
 	if elevator_job != nil {
 		return elevator_job
 	}
-	queue_job := makeQueueOrderJob(workIDTmp, queue)
-	return &queue_job
+	return makeQueueOrderJob(workIDTmp, queue)
 }
 
-func mgrDecideFarmWork(t turtle, f *farmArea) (*string, error) {
+func mgrDecideFarmWork(t turtle, f *farmArea) (*job, error) {
 	// We do not assign work when an existing job is not completed.
 	if t.CurWork != nil && !t.CurWork.ID.isLowPriority() && !t.CurWork.Complete {
 		// Non interruptible work is not complete yet.
-		job := ""
-		return &job, nil
+		return nil, nil
 	}
 
 	if !f.Enabled {
-		job := f.getWaitJob(t)
-		return job, nil
+		return f.getWaitJob(t), nil
 	}
 	pending_area_changes := false
 
@@ -136,24 +272,10 @@ func mgrDecideFarmWork(t turtle, f *farmArea) (*string, error) {
 	}
 
 	// Handler for refueling.
-	tryRefuel := func() (*string, error) {
-		if t.FuelLvl > 500 {
-			return nil, nil
-		}
-		// When we have refuel item in inventory we use them.
-		item_id := itemID("minecraft:coal/0")
-		fuel_per_item := 80
-		fuel_to_lvl := 5000
-		n_has := t.InvCount.Grouped[item_id]
-		// Note: Assuming one stack of fuel.
-		if n_has == 0 && t.InvCount.FreeSlots == 0 {
-			return nil, nil
-		}
-		n_need := fuel_to_lvl / fuel_per_item
-		if n_has >= n_need {
-			// Refuel now.
-			job := makeJobRefuel(workIDTmp, item_id, n_need)
-			return &job, nil
+	tryRefuel := func() (*job, error) {
+		refuel_job, n_fetch := f.Fuel.decide(t, f.Fuel.BoxItem)
+		if n_fetch == 0 {
+			return refuel_job, nil
 		}
 		// Go to level 0 first.
 		elevator_job := f.getElevatorJob(t, 0)
@@ -164,19 +286,15 @@ func mgrDecideFarmWork(t turtle, f *farmArea) (*string, error) {
 		load_dir := f.getBoxLoadDir(1)
 		load_pos := f.getBoxLoadCoord(1)
 		if vec3Equal(t.CurPos, load_pos) {
-			// Create suck job.
-			amount := n_need - n_has
-			job := makeJobSuck(workIDTmp, &item_id, amount, load_dir)
-			return &job, nil
+			return supplyFetchJob(t, f, f.ID, "fuel", f.Fuel.BoxItem, n_fetch, load_dir, f.getWaitJob), nil
 		} else {
 			// Create go job.
-			job := makeJobGo(workIDTmp, []vec3{load_pos})
-			return &job, nil
+			return makeJobGo(workIDTmp, []vec3{load_pos}), nil
 		}
 	}
 
 	// Handler for loading and unloading.
-	tryReload := func() (*string, error) {
+	tryReload := func() (*job, error) {
 		// Calculate required seed amounts.
 		seed_req_amounts := map[itemID]int{}
 		plot_edge := 9
@@ -221,17 +339,14 @@ func mgrDecideFarmWork(t turtle, f *farmArea) (*string, error) {
 			if vec3Equal(t.CurPos, load_pos) {
 				if balance > 0 {
 					// Create drop job.
-					job := makeJobDrop(workIDTmp, map[itemID]int{item_id: balance}, load_dir)
-					return &job, nil
+					return makeJobDrop(workIDTmp, map[itemID]int{item_id: balance}, load_dir), nil
 				} else {
 					// Create suck job.
-					job := makeJobSuck(workIDTmp, &item_id, -balance, load_dir)
-					return &job, nil
+					return makeJobSuck(workIDTmp, &item_id, -balance, load_dir), nil
 				}
 			} else {
 				// Create go job.
-				job := makeJobGo(workIDTmp, []vec3{load_pos})
-				return &job, nil
+				return makeJobGo(workIDTmp, []vec3{load_pos}), nil
 			}
 		}
 		// Done if everything is balanced.
@@ -239,7 +354,7 @@ func mgrDecideFarmWork(t turtle, f *farmArea) (*string, error) {
 	}
 
 	// Handler for farming.
-	tryFarm := func() (*string, error) {
+	tryFarm := func() (*job, error) {
 		// Go through plots and find plot to farm.
 		replant_duration := time.Minute * time.Duration(f.Interval)
 		for _, plot := range f.Plots {
@@ -258,32 +373,34 @@ func mgrDecideFarmWork(t turtle, f *farmArea) (*string, error) {
 		return nil, nil
 	}
 
-	var job *string
-	for _, fn := range []func() (*string, error){tryRefuel, tryReload, tryFarm} {
+	var new_job *job
+	for _, fn := range []func() (*job, error){tryRefuel, tryReload, tryFarm} {
 		var err error
-		job, err = fn()
+		new_job, err = fn()
 		if err != nil {
 			return nil, err
 		}
-		if job != nil {
+		if new_job != nil {
 			break
 		}
 	}
-	if job == nil {
+	if new_job == nil {
 		// Nothing to do, go wait.
-		job = f.getWaitJob(t)
+		new_job = f.getWaitJob(t)
 	}
 
 	// Store pending area changes.
 	if pending_area_changes {
-		f.store()
+		if err := f.store(); err != nil {
+			return nil, err
+		}
 	}
 
 	// Return job.
-	return job, nil
+	return new_job, nil
 }
 
-func makeFarmOrderJob(t turtle, f farmArea, plot farmPlot) (*string, error) {
+func makeFarmOrderJob(t turtle, f farmArea, plot farmPlot) (*job, error) {
 	// Go to plot level.
 	elevator_job := f.getElevatorJob(t, plot.Level)
 	if elevator_job != nil {
@@ -293,8 +410,7 @@ func makeFarmOrderJob(t turtle, f farmArea, plot farmPlot) (*string, error) {
 	y_offset := 2 - (3 * plot.Level)
 	start_pos := vec3Add(f.Pos, vec3{-4, y_offset, 4})
 	if !vec3Equal(t.CurPos, start_pos) {
-		job := makeJobGo(workIDTmp, []vec3{start_pos})
-		return &job, nil
+		return makeJobGo(workIDTmp, []vec3{start_pos}), nil
 	}
 	// Define farming walk waypoints.
 	waypoints := []vec3{
@@ -329,6 +445,5 @@ func makeFarmOrderJob(t turtle, f farmArea, plot farmPlot) (*string, error) {
 		wp[1] = y_offset
 		waypoints[i] = vec3Add(f.Pos, wp)
 	}
-	job := makeJobFarm(plot.WorkID, waypoints, plot.Seeds, 1)
-	return &job, nil
+	return makeJobFarm(plot.WorkID, waypoints, plot.Seeds, 1), nil
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"math"
@@ -8,6 +9,10 @@ import (
 	"time"
 )
 
+func init() {
+	registerAreaType("mine", func() area { return new(mineArea) })
+}
+
 type boreholeState int
 
 const (
@@ -29,10 +34,133 @@ type mineArea struct {
 	// all mines in progress have the state of their 5 borehole jobs mapped here
 	MineProgress map[string][]boreholeState `json:"mine_progress"`
 	MineAllocs   map[turtleID]*mineOrder    `json:"mine_allocs"`
+	Fuel         fuelPolicy                 `json:"fuel"`
+	// estimated number of items in the fuel and torch boxes
+	SupplyLevels map[string]int `json:"supply_levels"`
+}
+
+func (m mineArea) store() error {
+	return storeJSON(m.Path, m)
+}
+
+func (m mineArea) id() areaID {
+	return m.ID
+}
+
+func (m mineArea) getFuel() fuelPolicy {
+	return m.Fuel
+}
+
+func (m mineArea) describe() areaInfo {
+	return areaInfo{
+		ID:      m.ID,
+		Type:    "mine",
+		Enabled: m.Enabled,
+		Pos:     m.Pos,
+		Details: map[string]interface{}{
+			"depth":       m.Depth,
+			"next_clear":  m.NextClear,
+			"next_mine":   m.NextMine,
+			"mine_allocs": len(m.MineAllocs),
+		},
+	}
+}
+
+func (m *mineArea) load(area_id areaID, area_dir string) error {
+	m.Path = fmt.Sprintf("%s/details", area_dir)
+	if err := readJSON(m.Path, m); err != nil {
+		return err
+	}
+	if m.ID != area_id {
+		return fmt.Errorf("invalid mine id: %v, expected: %v", m.ID, area_id)
+	}
+	if m.MineProgress == nil {
+		m.MineProgress = map[string][]boreholeState{}
+	}
+	if m.MineAllocs == nil {
+		m.MineAllocs = map[turtleID]*mineOrder{}
+	}
+	if m.SupplyLevels == nil {
+		m.SupplyLevels = map[string]int{}
+	}
+	m.Fuel.init()
+	return nil
 }
 
-func (m mineArea) store() {
-	storeJSON(m.Path, m)
+func (m *mineArea) keepAllocations(old area) {
+	old_m, ok := old.(*mineArea)
+	if !ok {
+		return
+	}
+	if old_m.WorkIDSeq > m.WorkIDSeq {
+		m.WorkIDSeq = old_m.WorkIDSeq
+	}
+	warnKeptField(m.ID, "MineAllocs", old_m.MineAllocs, m.MineAllocs)
+	warnKeptField(m.ID, "SupplyLevels", old_m.SupplyLevels, m.SupplyLevels)
+	m.MineAllocs = old_m.MineAllocs
+	m.SupplyLevels = old_m.SupplyLevels
+	// Boreholes being drilled stay in progress.
+	for _, order := range m.MineAllocs {
+		if order.Type != mineOrderDrill {
+			continue
+		}
+		mine_id_str := itoa(getBoreholeMineID(order.BoreholeID))
+		mine_progress := m.MineProgress[mine_id_str]
+		mine_borehole_offs := getBoreholeOffsInMine(order.BoreholeID)
+		if mine_borehole_offs >= len(mine_progress) {
+			m.MineProgress[mine_id_str] = old_m.MineProgress[mine_id_str]
+			continue
+		}
+		mine_progress[mine_borehole_offs] = boreholeInProgress
+	}
+}
+
+func (m *mineArea) decideWork(t turtle) (*job, error) {
+	return mgrDecideMineWork(t, m)
+}
+
+func (m *mineArea) edit(fields map[string]json.RawMessage) (area, error) {
+	edited := *m
+	var fuel_raw json.RawMessage
+	err := decodeAreaFields(fields, map[string]interface{}{
+		"enabled": &edited.Enabled,
+		"depth":   &edited.Depth,
+		"fuel":    &fuel_raw,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if edited.Depth <= 0 {
+		return nil, errBadRequest("invalid mine depth: %v", edited.Depth)
+	}
+	if fuel_raw != nil {
+		if err := edited.Fuel.edit(fuel_raw); err != nil {
+			return nil, err
+		}
+	}
+	return &edited, nil
+}
+
+func (m *mineArea) handleExport(er exportRequest) (*exportOrder, error) {
+	return nil, errBadRequest("mine area %v does not export items", m.ID)
+}
+
+func (m *mineArea) releaseTurtle(label turtleID) bool {
+	order := m.MineAllocs[label]
+	if order == nil {
+		return false
+	}
+	if order.Type == mineOrderDrill {
+		// Return borehole so it is drilled by another turtle.
+		mine_progress := m.MineProgress[itoa(getBoreholeMineID(order.BoreholeID))]
+		mine_borehole_offs := getBoreholeOffsInMine(order.BoreholeID)
+		if mine_borehole_offs < len(mine_progress) && mine_progress[mine_borehole_offs] == boreholeInProgress {
+			mine_progress[mine_borehole_offs] = boreholeUndrilled
+		}
+	}
+	// Clear orders are reassigned when no other turtle is clearing.
+	delete(m.MineAllocs, label)
+	return true
 }
 
 type mineOrderType string
@@ -65,6 +193,24 @@ func (m mineArea) getUnloadBoxCoord() vec3 {
 	return vec3Add(m.Pos, vec3{5, 1, -2})
 }
 
+// Supply boxes: "fuel" and "torch".
+func (m mineArea) supplyBox(box string) (vec3, vec3, bool) {
+	var orient boxLoadOrient
+	switch box {
+	case "fuel":
+		orient = getMineBoxLoadOrient(m.getFuelBoxCoord())
+	case "torch":
+		orient = getMineBoxLoadOrient(m.getTorchBoxCoord())
+	default:
+		return vec3{}, vec3{}, false
+	}
+	return orient.coord, orient.dir, true
+}
+
+func (m mineArea) supplyLevels() map[string]int {
+	return m.SupplyLevels
+}
+
 func (m mineArea) getTorchOffsets() []vec3 {
 	return []vec3{
 		vec3{2, 0, -2},
@@ -132,14 +278,12 @@ func (m mineArea) getQ() qCoords {
 	}
 }
 
-func (m mineArea) getWaitJob(t turtle) *string {
+func (m mineArea) getWaitJob(t turtle) *job {
 	queue := m.getQ()
 	if vec3Equal(t.CurPos, queue.origin) {
-		idle_job := makeJobIdle(workIDTmp, 20)
-		return &idle_job
+		return makeJobIdle(workIDTmp, 20)
 	}
-	queue_job := makeQueueOrderJob(workIDTmp, queue)
-	return &queue_job
+	return makeQueueOrderJob(workIDTmp, queue)
 }
 
 type boxLoadOrient struct {
@@ -196,12 +340,11 @@ func (m mineArea) getBoreholeWaypoints(borehole_id int) []vec3 {
 	}
 }
 
-func mgrDecideMineWork(t turtle, m *mineArea) *string {
+func mgrDecideMineWork(t turtle, m *mineArea) (*job, error) {
 	// We do not assign work when an existing job is not completed.
 	if t.CurWork != nil && !t.CurWork.ID.isLowPriority() && !t.CurWork.Complete {
 		// Non interruptible work is not complete yet.
-		job := ""
-		return &job
+		return nil, nil
 	}
 	pending_area_changes := false
 
@@ -210,8 +353,7 @@ func mgrDecideMineWork(t turtle, m *mineArea) *string {
 		if t.CurWork == nil || t.CurWork.ID != order.ID {
 			// Turtle completed intermediary step in mining operation
 			// or a race caused work to not be assigned (e.g. chunk unload).
-			job := makeMineOrderJob(t, *m, *order)
-			return &job
+			return makeMineOrderJob(t, *m, *order)
 		}
 		if order.State > 0 {
 			// Explicit intermediary step in mining operation completed.
@@ -219,9 +361,10 @@ func mgrDecideMineWork(t turtle, m *mineArea) *string {
 			m.WorkIDSeq++
 			order.ID = workID(m.WorkIDSeq)
 			order.State--
-			m.store()
-			job := makeMineOrderJob(t, *m, *order)
-			return &job
+			if err := m.store(); err != nil {
+				return nil, err
+			}
+			return makeMineOrderJob(t, *m, *order)
 		}
 		switch order.Type {
 		case mineOrderClear:
@@ -233,9 +376,8 @@ func mgrDecideMineWork(t turtle, m *mineArea) *string {
 			mine_id := getBoreholeMineID(order.BoreholeID)
 			mine_progress := m.MineProgress[itoa(mine_id)]
 			if mine_progress[mine_borehole_offs] != boreholeInProgress {
-				log.Printf("mine work error: turtle %v: current bore order: %#v,"+
+				return nil, errConflict("mine work error: turtle %v: current bore order: %#v,"+
 					" does not match mine progress: %#v", t.Label, order, m.MineProgress)
-				return nil
 			}
 			mine_progress[mine_borehole_offs] = boreholeComplete
 			mine_complete := true
@@ -258,7 +400,10 @@ func mgrDecideMineWork(t turtle, m *mineArea) *string {
 				"turtle":             t.Label,
 				"items":              t.InvCount.Grouped,
 			}
-			storeJSONSync(path.Dir(m.Path)+"/stats/"+itoa(order.BoreholeID), stats, false)
+			err := storeJSONSync(path.Dir(m.Path)+"/stats/"+itoa(order.BoreholeID), stats, false)
+			if err != nil {
+				return nil, err
+			}
 		}
 		// Mine allocation complete, remove it.
 		delete(m.MineAllocs, t.Label)
@@ -278,76 +423,56 @@ func mgrDecideMineWork(t turtle, m *mineArea) *string {
 	//    condition is common which is unlikely.)
 
 	// Handler for refueling.
-	tryRefuel := func() *string {
-		if t.FuelLvl > 500 {
-			return nil
-		}
-		// When we have refuel item in inventory we use them.
-		item_id := itemID("minecraft:coal/0")
-		fuel_per_item := 80
-		fuel_to_lvl := 5000
-		n_has := t.InvCount.Grouped[item_id]
-		// Note: Assuming one stack of fuel.
-		if n_has == 0 && t.InvCount.FreeSlots == 0 {
-			return nil
-		}
-		n_need := fuel_to_lvl / fuel_per_item
-		if n_has >= n_need {
-			// Refuel now.
-			job := makeJobRefuel(workIDTmp, item_id, n_need)
-			return &job
+	tryRefuel := func() (*job, error) {
+		refuel_job, n_fetch := m.Fuel.decide(t, m.Fuel.BoxItem)
+		if n_fetch == 0 {
+			return refuel_job, nil
 		}
 		// Go to fuel box.
 		box_orient := getMineBoxLoadOrient(m.getFuelBoxCoord())
 		if vec3Equal(t.CurPos, box_orient.coord) {
-			// Create suck job.
-			amount := n_need - n_has
-			job := makeJobSuck(workIDTmp, &item_id, amount, box_orient.dir)
-			return &job
+			return supplyFetchJob(t, m, m.ID, "fuel", m.Fuel.BoxItem, n_fetch, box_orient.dir, m.getWaitJob), nil
 		} else {
 			// Create go job.
-			job := makeJobGo(workIDTmp, []vec3{box_orient.coord})
-			return &job
+			return makeJobGo(workIDTmp, []vec3{box_orient.coord}), nil
 		}
 	}
 
 	// Handler for unloading.
-	tryUnload := func() *string {
+	tryUnload := func() (*job, error) {
 		if len(t.InvCount.Grouped) == 0 {
-			return nil
+			return nil, nil
 		}
 		// Go to unload box.
 		box_orient := getMineBoxLoadOrient(m.getUnloadBoxCoord())
 		if vec3Equal(t.CurPos, box_orient.coord) {
 			// Create drop job.
-			job := makeJobDrop(workIDTmp, t.InvCount.Grouped, box_orient.dir)
-			return &job
+			return makeJobDrop(workIDTmp, t.InvCount.Grouped, box_orient.dir), nil
 		} else {
 			// Create go job.
-			job := makeJobGo(workIDTmp, []vec3{box_orient.coord})
-			return &job
+			return makeJobGo(workIDTmp, []vec3{box_orient.coord}), nil
 		}
 	}
 
 	// Handler for idling.
-	tryIdle := func() *string {
+	tryIdle := func() (*job, error) {
 		if m.Enabled {
-			return nil
+			return nil, nil
 		}
-		return m.getWaitJob(t)
+		return m.getWaitJob(t), nil
 	}
 
 	// Handler for clearing.
-	tryClear := func() *string {
+	tryClear := func() (*job, error) {
 		ideal_clear_ahead := int(32) // How far NextClear should be kept from NextMine.
 		clear_ahead := m.NextClear - m.NextMine
 		if clear_ahead >= ideal_clear_ahead {
-			return nil
+			return nil, nil
 		}
 		// Only one turtle may clear at a time.
 		for _, order := range m.MineAllocs {
 			if order.Type == mineOrderClear {
-				return nil
+				return nil, nil
 			}
 		}
 		// Generate clear order.
@@ -358,13 +483,12 @@ func mgrDecideMineWork(t turtle, m *mineArea) *string {
 		order.Type = mineOrderClear
 		order.State = 2
 		m.MineAllocs[t.Label] = order
-		job := makeMineOrderJob(t, *m, *order)
-		return &job
+		return makeMineOrderJob(t, *m, *order)
 	}
 
 	// Handler for drilling.
-	tryDrill := func() *string {
-		create_drill_order := func(mine_id int, mine_borehole_offs int) *string {
+	tryDrill := func() (*job, error) {
+		create_drill_order := func(mine_id int, mine_borehole_offs int) (*job, error) {
 			pending_area_changes = true
 			m.WorkIDSeq++
 			order := new(mineOrder)
@@ -374,8 +498,7 @@ func mgrDecideMineWork(t turtle, m *mineArea) *string {
 			m.MineAllocs[t.Label] = order
 			mine_progress := m.MineProgress[itoa(mine_id)]
 			mine_progress[mine_borehole_offs] = boreholeInProgress
-			job := makeMineOrderJob(t, *m, *order)
-			return &job
+			return makeMineOrderJob(t, *m, *order)
 		}
 		// Find an undrilled borehole.
 		for mine_id_str, mine_progress := range m.MineProgress {
@@ -400,31 +523,36 @@ func mgrDecideMineWork(t turtle, m *mineArea) *string {
 			m.NextMine++
 			return create_drill_order(mine_id, mine_borehole_offs)
 		}
-		return nil
+		return nil, nil
 	}
 
-	var job *string
-	for _, fn := range []func() *string{tryRefuel, tryUnload, tryIdle, tryClear, tryDrill} {
-		job = fn()
-		if job != nil {
+	var new_job *job
+	for _, fn := range []func() (*job, error){tryRefuel, tryUnload, tryIdle, tryClear, tryDrill} {
+		var err error
+		new_job, err = fn()
+		if err != nil {
+			return nil, err
+		}
+		if new_job != nil {
 			break
 		}
 	}
-	if job == nil {
-		idle_job := makeJobIdle(workIDTmp, 10)
-		job = &idle_job
+	if new_job == nil {
+		new_job = makeJobIdle(workIDTmp, 10)
 	}
 
 	// Store pending area changes.
 	if pending_area_changes {
-		m.store()
+		if err := m.store(); err != nil {
+			return nil, err
+		}
 	}
 
 	// Return job.
-	return job
+	return new_job, nil
 }
 
-func makeMineOrderJob(t turtle, m mineArea, order mineOrder) string {
+func makeMineOrderJob(t turtle, m mineArea, order mineOrder) (*job, error) {
 	switch order.Type {
 	case mineOrderClear:
 		torch_item_id := itemID("Railcraft:lantern.stone/9")
@@ -438,14 +566,13 @@ func makeMineOrderJob(t turtle, m mineArea, order mineOrder) string {
 				// Go to fuel box.
 				box_orient := getMineBoxLoadOrient(m.getTorchBoxCoord())
 				if !vec3Equal(t.CurPos, box_orient.coord) {
-					return makeJobGo(workIDTmp, []vec3{box_orient.coord})
+					return makeJobGo(workIDTmp, []vec3{box_orient.coord}), nil
 				}
 				// Suck torches.
-				amount := n_need - n_has
-				return makeJobSuck(workIDTmp, &torch_item_id, amount, box_orient.dir)
+				return supplyFetchJob(t, m, m.ID, "torch", torch_item_id, n_need-n_has, box_orient.dir, m.getWaitJob), nil
 			}
 			// Clear mine segment.
-			return makeClearMineOrderJob(t, m, order, mine_coord)
+			return makeClearMineOrderJob(t, m, order, mine_coord), nil
 		case order.State < 2:
 			// Place torch.
 			coord := vec3Add(mine_coord, m.getTorchOffsets()[order.State])
@@ -453,30 +580,30 @@ func makeMineOrderJob(t turtle, m mineArea, order mineOrder) string {
 			place_dir := vec3{0, -1, 0}
 			// Go to construct position.
 			if !vec3Equal(t.CurPos, place_pos) {
-				return makeJobGo(workIDTmp, []vec3{place_pos})
+				return makeJobGo(workIDTmp, []vec3{place_pos}), nil
 			}
 			// Construct torch now.
-			return makeJobConstruct(order.ID, torch_item_id, []vec3{place_pos}, place_dir)
+			return makeJobConstruct(order.ID, torch_item_id, []vec3{place_pos}, place_dir), nil
 		default:
-			panic(fmt.Sprintf("invalid order state %v", order.State))
+			return nil, errConflict("invalid mine order state %v", order.State)
 		}
 	case mineOrderDrill:
 		// Go to drill position.
 		waypoints := m.getBoreholeWaypoints(order.BoreholeID)
 		start_pos := vec3Add(waypoints[0], vec3{0, 1, 0})
 		if !vec3Equal(t.CurPos, start_pos) {
-			return makeJobGo(workIDTmp, []vec3{start_pos})
+			return makeJobGo(workIDTmp, []vec3{start_pos}), nil
 		}
 		// Drill.
 		dynamic := true
 		clear := false
-		return makeJobMine(order.ID, waypoints, []vec3{}, dynamic, clear)
+		return makeJobMine(order.ID, waypoints, []vec3{}, dynamic, clear), nil
 	default:
-		panic(fmt.Sprintf("unknown order type %v", order.Type))
+		return nil, errConflict("unknown mine order type %v", order.Type)
 	}
 }
 
-func makeClearMineOrderJob(t turtle, m mineArea, order mineOrder, mine_coord vec3) string {
+func makeClearMineOrderJob(t turtle, m mineArea, order mineOrder, mine_coord vec3) *job {
 	// Determine attack direction.
 	var attack_dir vec3
 	x_pos := mine_coord[0] >= m.Pos[0]
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+// Writes area files to a new state directory. files maps a path in the
+// state directory to the file content.
+func simStateDir(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, raw := range files {
+		fs_path := path.Join(dir, name)
+		if err := os.MkdirAll(path.Dir(fs_path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fs_path, []byte(raw), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// Writes the details of areas to a new state directory and boots the
+// server with it.
+func simBootAreas(t *testing.T, details map[areaID]string) {
+	files := map[string]string{}
+	for area_id, raw := range details {
+		files[path.Join(string(area_id), "details")] = raw
+	}
+	if err := simBootServer(simStateDir(t, files)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Places a chest for every box of a storage area and the import and export
+// chests. Returns the import and export chests.
+func simStorageWorld(w *simWorld, s *storageArea) (simInv, simInv) {
+	for id := range s.Boxes {
+		if s.Boxes[id].Amount >= 0 {
+			w.addChest(s.getBoxOrient(id).boxPos, s.BoxSlots)
+		}
+	}
+	imp := w.addChest(vec3Add(s.getImportQ().origin, vec3{0, 1, 0}), 27)
+	exp := w.addChest(vec3Add(s.getExportQ().origin, vec3{0, 1, 0}), 27)
+	return imp, exp
+}
+
+// Returns the number of items of an item recorded in the boxes of a
+// storage area.
+func simStored(s *storageArea, item_id itemID) int {
+	n := 0
+	for _, box := range s.Boxes {
+		if box.Amount > 0 && box.Name == item_id {
+			n += box.Amount
+		}
+	}
+	return n
+}
+
+func TestSimStorageImportExport(t *testing.T) {
+	simBootAreas(t, map[areaID]string{
+		"storage.0": `{"ID": "storage.0", "Pos": [50, 121, 822], "XLen": 4, "ZLen": 4, "Rows": 2}`,
+	})
+	s := areas["storage.0"].(*storageArea)
+	w := newSimWorld()
+	imp, exp := simStorageWorld(w, s)
+	imp[0] = simStackOf("minecraft:cobblestone/0", 64)
+	imp[1] = simStackOf("minecraft:dirt/0", 40)
+	sm := newSim(w)
+	st := sm.addTurtle("storage.0.1", vec3{50, 119, 830}, vec3{1, 0, 0}, 1000)
+	err := sm.run(3000, func() bool {
+		return simStored(s, "minecraft:cobblestone/0") == 64 && simStored(s, "minecraft:dirt/0") == 40
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(st.inv.grouped()); n != 0 {
+		t.Errorf("turtle holds %v after import", st.inv.grouped())
+	}
+	if len(imp.grouped()) != 0 {
+		t.Errorf("import chest holds %v after import", imp.grouped())
+	}
+	// Recorded boxes match the chests.
+	for id, box := range s.Boxes {
+		if box.Amount <= 0 {
+			continue
+		}
+		if n := w.chests[s.getBoxOrient(id).boxPos].count(box.Name); n != box.Amount {
+			t.Errorf("box %v records %v %v, chest holds %v", id, box.Amount, box.Name, n)
+		}
+	}
+	order, err := exportItems(exportRequest{ItemID: "minecraft:cobblestone/0", Count: 10, AreaID: "storage.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sm.run(3000, func() bool {
+		o := s.getExportOrder(order.ID)
+		return o != nil && o.Status == exportStatusDelivered
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := exp.count("minecraft:cobblestone/0"); n != 10 {
+		t.Errorf("exported %v cobblestone, want 10", n)
+	}
+	if n := simStored(s, "minecraft:cobblestone/0"); n != 54 {
+		t.Errorf("stored %v cobblestone after export, want 54", n)
+	}
+	if len(s.ExportAllocs) != 0 || len(s.Exporting) != 0 {
+		t.Errorf("export allocations left: %v %v", s.ExportAllocs, s.Exporting)
+	}
+}
+
+func TestSimMineClear(t *testing.T) {
+	simBootAreas(t, map[areaID]string{
+		"mine.0": `{"ID": "mine.0", "Enabled": true, "Pos": [70, 100, 822], "Depth": 4}`,
+	})
+	m := areas["mine.0"].(*mineArea)
+	// Borehole statistics are written to the stats directory.
+	if err := os.Mkdir(path.Join(path.Dir(m.Path), "stats"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	w := newSimWorld()
+	torch_box := w.addChest(m.getTorchBoxCoord(), 27)
+	torch_box[0] = simStackOf("Railcraft:lantern.stone/9", 10)
+	w.addChest(m.getFuelBoxCoord(), 27)
+	w.addChest(m.getUnloadBoxCoord(), 27)
+	sm := newSim(w)
+	sm.verbose = os.Getenv("V") != ""
+	mt := sm.addTurtle("mine.0.1", m.getQ().origin, vec3{0, 0, 1}, 5000)
+	err := sm.run(20000, func() bool { return m.NextClear >= 1 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The turtle fetched two torches and placed them in the cleared mine.
+	if n := torch_box.count("Railcraft:lantern.stone/9"); n != 8 {
+		t.Errorf("torch box holds %v torches, want 8", n)
+	}
+	if n := mt.inv.count("Railcraft:lantern.stone/9"); n != 0 {
+		t.Errorf("turtle holds %v torches after clearing", n)
+	}
+	for _, offs := range m.getTorchOffsets() {
+		pos := vec3Add(m.getMineCoord(0), offs)
+		if block := w.blocks[pos]; block.Name != "Railcraft:lantern.stone" {
+			t.Errorf("no torch at %v: %+v", pos, block)
+		}
+	}
+	// A second turtle drills the boreholes of the cleared mine while the
+	// first one clears ahead.
+	sm.addTurtle("mine.0.2", m.getQ().origin, vec3{0, 0, 1}, 5000)
+	err = sm.run(20000, func() bool {
+		progress := m.MineProgress["0"]
+		return len(progress) > 0 && progress[0] == boreholeComplete
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.NextMine != 1 {
+		t.Errorf("next mine %v, want 1", m.NextMine)
+	}
+}
+
+func TestSimFarmPlot(t *testing.T) {
+	simBootAreas(t, map[areaID]string{
+		"farm.0": `{"ID": "farm.0", "Enabled": true, "Interval": 60, "Pos": [0, 100, 0],
+			"Seeds": ["minecraft:wheat_seeds/0", "minecraft:carrot/0"],
+			"Plots": [{"Seeds": ["minecraft:wheat_seeds/0", "minecraft:carrot/0"]}]}`,
+	})
+	f := areas["farm.0"].(*farmArea)
+	w := newSimWorld()
+	w.addChest(f.getBoxCoord(0), 27)
+	w.addChest(f.getBoxCoord(1), 27)
+	wheat_box := w.addChest(f.getBoxCoord(2), 27)
+	wheat_box[0] = simStackOf("minecraft:wheat_seeds/0", 64)
+	carrot_box := w.addChest(f.getBoxCoord(3), 27)
+	carrot_box[0] = simStackOf("minecraft:carrot/0", 64)
+	sm := newSim(w)
+	sm.verbose = os.Getenv("V") != ""
+	ft := sm.addTurtle("farm.0.1", f.getQ().origin, vec3{-1, 0, 0}, 5000)
+	err := sm.run(20000, func() bool { return f.Plots[0].PlantTime != "" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Plots[0].Assignee != "" {
+		t.Errorf("plot still assigned to %v", f.Plots[0].Assignee)
+	}
+	planted := map[itemID]int{}
+	for _, block := range w.blocks {
+		planted[simStackOf(itemID(block.Name+"/0"), 1).id()]++
+	}
+	// Every cell of the plot except the elevator shaft is planted with
+	// seeds fetched from the seed boxes.
+	if n := planted["minecraft:wheat_seeds/0"] + planted["minecraft:carrot/0"]; n != 80 {
+		t.Errorf("planted %v cells, want 80: %v", n, planted)
+	}
+	for item_id, box := range map[itemID]simInv{"minecraft:wheat_seeds/0": wheat_box, "minecraft:carrot/0": carrot_box} {
+		if n := box.count(item_id) + ft.inv.count(item_id) + planted[item_id]; n != 64 {
+			t.Errorf("%v: box, turtle and plot hold %v, want 64", item_id, n)
+		}
+	}
+}
@@ -1,20 +1,35 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"os"
 	"path"
+	"regexp"
+	"strconv"
+	"time"
 )
 
+func init() {
+	registerAreaType("storage", func() area { return new(storageArea) })
+}
+
 type storageArea struct {
 	Path string `json:"-"`
 	ID   areaID
 	// sequence counter for work ids
 	WorkIDSeq int `json:"work_id_seq"`
 	Pos       vec3
-	XLen      int
-	ZLen      int
-	Rows      int
+	// ring size of areas created before layouts existed
+	XLen int
+	ZLen int
+	Rows int
+	// positions of boxes, holes and queues
+	Layout storageLayout `json:"layout"`
+	// number of inventory slots of every box
+	BoxSlots int `json:"box_slots"`
 	// map from turtle labels to load orders that where assigned to them
 	LoadOrders map[turtleID]*loadOrder `json:"load_orders"`
 	Boxes      []storageBox            `json:"-"`
@@ -23,48 +38,550 @@ type storageArea struct {
 	// map from turtle ids to items and amount to export
 	// an alloc here subtracts the corresponding exporting value
 	ExportAllocs map[turtleID]map[itemID]int `json:"export_allocs"`
-	// turtle that is solely responsible for large exports (> 512).
-	LargeStackTurtle turtleID `json:"large_stack_turtle"`
+	// export orders, the queued items of all orders add up to Exporting
+	ExportOrders   []*exportOrder `json:"export_orders"`
+	ExportOrderSeq int            `json:"export_order_seq"`
+	// map from turtle ids to the export order they serve with each
+	// allocated item and default maximum number of turtles serving an order
+	ExportAllocOrders map[turtleID]map[itemID]int `json:"export_alloc_item_orders"`
+	ExportTurtles     int                         `json:"export_turtles"`
+	// single served export order of each turtle of old areas, moved to
+	// ExportAllocOrders on load
+	LegacyExportAllocOrders map[turtleID]int `json:"export_alloc_orders,omitempty"`
+	// map from turtle labels to boxes they are defragmenting
+	Defrags map[turtleID]*defragOrder `json:"defrags"`
+	// boxes queued for audit and map from turtle labels to boxes they audit
+	AuditQueue []int                    `json:"audit_queue"`
+	Audits     map[turtleID]*auditOrder `json:"audits"`
+	// map from lost turtle labels to the boxes of their released orders,
+	// audited when the turtle reports again
+	LostBoxes map[turtleID][]int `json:"lost_boxes"`
+	// minimum stock rules of supply boxes and pending deliveries
+	Stock       []stockRule `json:"stock"`
+	Deliveries  []*delivery `json:"deliveries"`
+	DeliverySeq int         `json:"delivery_seq"`
+	// access-frequency placement, export scores and map from turtle labels
+	// to boxes they move away from the export station
+	Placement    placementPolicy              `json:"placement"`
+	ExportScores map[itemID]*exportScore      `json:"export_scores"`
+	Rebalances   map[turtleID]*rebalanceOrder `json:"rebalances"`
+	// map from turtle labels to their pickup trips
+	Trips map[turtleID]*pickupTrip `json:"trips"`
+	// turtles that serve large exports
+	BulkExport bulkExportPolicy `json:"bulk_export"`
+	// single large export turtle of old areas, moved to the pool on load
+	LargeStackTurtle turtleID   `json:"large_stack_turtle,omitempty"`
+	Fuel             fuelPolicy `json:"fuel"`
+	// item routing rules, stored in their own file
+	Routing        []routingRule `json:"-"`
+	routingChanged bool
+	// planes with box updates that are not stored yet
+	dirtyPlanes map[int]bool
+	// map from turtle labels to boxes they are about to load
+	reservations map[turtleID]*boxReservation
+	// ledger entries that are not appended yet and the inventory and
+	// position of the last report of every turtle
+	pendingLedger []ledgerEntry
+	lastInv       map[turtleID]map[itemID]int
+	lastPos       map[turtleID]vec3
+}
+
+// Stores the area details together with all updated box planes in one
+// transaction.
+func (s *storageArea) store() error {
+	txn := newStateTxn(path.Dir(s.Path))
+	txn.storeJSON(s.Path, s)
+	if s.routingChanged {
+		txn.storeJSON(s.routingPath(), s.Routing)
+	}
+	n_pp := s.nBoxesPerPlane()
+	for plane_id := range s.dirtyPlanes {
+		box_plane := make([]storageBox, n_pp)
+		copy(box_plane, s.Boxes[n_pp*plane_id:])
+		txn.storeJSON(s.planePath(plane_id), box_plane)
+	}
+	if err := txn.commit(); err != nil {
+		return err
+	}
+	s.dirtyPlanes = map[int]bool{}
+	s.routingChanged = false
+	if err := s.flushLedger(); err != nil {
+		// The state is committed, the entries are appended with the next
+		// store.
+		log.Printf("storage ledger error: %v: %v", s.ID, err)
+	}
+	return nil
+}
+
+func (s storageArea) routingPath() string {
+	return path.Join(path.Dir(s.Path), "routing")
+}
+
+func (s storageArea) planePath(plane_id int) string {
+	return fmt.Sprintf("%s/plane.%d", path.Dir(s.Path), plane_id)
+}
+
+func (s storageArea) id() areaID {
+	return s.ID
+}
+
+func (s storageArea) getFuel() fuelPolicy {
+	return s.Fuel
+}
+
+func (s storageArea) describe() areaInfo {
+	n_used, n_free := 0, 0
+	for _, box := range s.Boxes {
+		if box.Amount > 0 {
+			n_used++
+		} else if box.Amount == 0 {
+			n_free++
+		}
+	}
+	return areaInfo{
+		ID:      s.ID,
+		Type:    "storage",
+		Enabled: true,
+		Pos:     s.Pos,
+		Details: map[string]interface{}{
+			"shape":       s.Layout.Shape,
+			"used_boxes":  n_used,
+			"free_boxes":  n_free,
+			"load_orders": len(s.LoadOrders),
+			"exporting":   len(s.Exporting),
+			"defrags":     len(s.Defrags),
+			"auditing":    len(s.AuditQueue) + len(s.Audits),
+			"routing":     len(s.Routing),
+			"stock":       len(s.Stock),
+			"deliveries":  len(s.Deliveries),
+			"rebalances":  len(s.Rebalances),
+			"trips":       len(s.Trips),
+			"bulk_pool":   s.BulkExport.Pool,
+		},
+	}
+}
+
+var rgx_row = regexp.MustCompile("^plane.([0-9]+)$")
+
+func (s *storageArea) load(area_id areaID, area_dir string) error {
+	s.Path = fmt.Sprintf("%s/details", area_dir)
+	if err := readJSON(s.Path, s); err != nil {
+		return err
+	}
+	if s.ID != area_id {
+		return fmt.Errorf("invalid storage id: %v, expected: %v", s.ID, area_id)
+	}
+	if s.LoadOrders == nil {
+		s.LoadOrders = map[turtleID]*loadOrder{}
+	}
+	if s.Exporting == nil {
+		s.Exporting = map[itemID]int{}
+	}
+	if s.ExportAllocs == nil {
+		s.ExportAllocs = map[turtleID]map[itemID]int{}
+	}
+	if s.ExportAllocOrders == nil {
+		s.ExportAllocOrders = map[turtleID]map[itemID]int{}
+	}
+	// Turtles of old areas served one order. Stored with the next update.
+	for label, order_id := range s.LegacyExportAllocOrders {
+		order := s.getExportOrder(order_id)
+		if order == nil || s.ExportAllocs[label][order.ItemID] <= 0 {
+			continue
+		}
+		if s.ExportAllocOrders[label] == nil {
+			s.ExportAllocOrders[label] = map[itemID]int{}
+		}
+		s.ExportAllocOrders[label][order.ItemID] = order_id
+	}
+	s.LegacyExportAllocOrders = nil
+	if s.ExportTurtles == 0 {
+		s.ExportTurtles = 2
+	}
+	if s.Defrags == nil {
+		s.Defrags = map[turtleID]*defragOrder{}
+	}
+	if s.Audits == nil {
+		s.Audits = map[turtleID]*auditOrder{}
+	}
+	if s.LostBoxes == nil {
+		s.LostBoxes = map[turtleID][]int{}
+	}
+	if s.ExportScores == nil {
+		s.ExportScores = map[itemID]*exportScore{}
+	}
+	if s.Rebalances == nil {
+		s.Rebalances = map[turtleID]*rebalanceOrder{}
+	}
+	if s.Trips == nil {
+		s.Trips = map[turtleID]*pickupTrip{}
+	}
+	// Items exported before export orders existed get a legacy order.
+	for item_id, n_exporting := range s.Exporting {
+		n_queued := 0
+		for _, order := range s.itemExportOrders(item_id) {
+			n_queued += order.Queued
+		}
+		if n_queued < n_exporting {
+			s.ExportOrderSeq++
+			order := &exportOrder{
+				ID:        s.ExportOrderSeq,
+				Requester: "legacy",
+				ItemID:    item_id,
+				Count:     n_exporting - n_queued,
+				Created:   time.Now().UTC().Format(time.RFC3339),
+				Queued:    n_exporting - n_queued,
+			}
+			order.updateStatus()
+			s.ExportOrders = append(s.ExportOrders, order)
+		}
+	}
+	if s.BoxSlots == 0 {
+		s.BoxSlots = 32
+	}
+	if s.Layout.Shape == "" {
+		// Stored with the next update.
+		s.Layout = ringLayout(s.XLen, s.ZLen, s.Rows)
+	}
+	if err := s.Layout.validate(); err != nil {
+		return fmt.Errorf("invalid layout of %v: %v", s.ID, err)
+	}
+	if _, err := os.Stat(s.routingPath()); err == nil {
+		if err := readJSON(s.routingPath(), &s.Routing); err != nil {
+			return err
+		}
+	} else {
+		s.Routing = append([]routingRule{}, defaultRoutingRules...)
+	}
+	if err := initRoutingRules(s.Routing, s.nBoxes()); err != nil {
+		return fmt.Errorf("invalid routing of %v: %v", s.ID, err)
+	}
+	s.Fuel.init()
+	s.Placement.init()
+	if s.LargeStackTurtle != "" {
+		// Stored with the next update.
+		if !s.BulkExport.inPool(s.LargeStackTurtle) {
+			s.BulkExport.Pool = append(s.BulkExport.Pool, s.LargeStackTurtle)
+		}
+		s.LargeStackTurtle = ""
+	}
+	s.BulkExport.init()
+	if len(s.BulkExport.Pool) > s.BulkExport.Turtles {
+		s.BulkExport.Turtles = len(s.BulkExport.Pool)
+	}
+	if err := s.BulkExport.validate(); err != nil {
+		return fmt.Errorf("invalid bulk_export of %v: %v", s.ID, err)
+	}
+	s.dirtyPlanes = map[int]bool{}
+	s.reservations = map[turtleID]*boxReservation{}
+	s.lastInv = map[turtleID]map[itemID]int{}
+	s.lastPos = map[turtleID]vec3{}
+	s.Boxes = make([]storageBox, s.nBoxes())
+	files, err := ioutil.ReadDir(area_dir)
+	if err != nil {
+		return err
+	}
+	// Read boxes.
+	for _, file := range files {
+		m := rgx_row.FindStringSubmatch(file.Name())
+		if m == nil {
+			continue
+		}
+		plane_id, err := strconv.Atoi(m[1])
+		if err != nil {
+			return err
+		}
+		var row_boxes []storageBox
+		if err := readJSON(fmt.Sprintf("%s/%s", area_dir, file.Name()), &row_boxes); err != nil {
+			return err
+		}
+		if plane_id >= s.Layout.Rows || len(row_boxes) > s.nBoxesPerPlane() {
+			return fmt.Errorf("%v: %v does not fit the layout", s.ID, file.Name())
+		}
+		for i, box := range row_boxes {
+			s.Boxes[s.nBoxesPerPlane()*plane_id+i] = box
+		}
+	}
+	// Initialize holes.
+	for _, box_id := range s.Layout.Holes {
+		if box := s.Boxes[box_id]; box.Amount > 0 {
+			log.Printf("storage warning: %v: hole %v holds %v %v, ignoring them", s.ID, box_id, box.Amount, box.Name)
+		}
+		s.Boxes[box_id] = storageBox{Amount: -1}
+	}
+	return nil
 }
 
-func (s storageArea) store() {
-	storeJSON(s.Path, s)
+func (s *storageArea) keepAllocations(old area) {
+	old_s, ok := old.(*storageArea)
+	if !ok {
+		return
+	}
+	if old_s.WorkIDSeq > s.WorkIDSeq {
+		s.WorkIDSeq = old_s.WorkIDSeq
+	}
+	s.LoadOrders = map[turtleID]*loadOrder{}
+	for label, lo := range old_s.LoadOrders {
+		if lo.BoxID >= s.nBoxes() || (lo.BoxID >= 0 && s.Boxes[lo.BoxID].Amount < 0) {
+			log.Printf("state reload: %v: dropping load order of %v for removed box %v", s.ID, label, lo.BoxID)
+			continue
+		}
+		s.LoadOrders[label] = lo
+	}
+	warnKeptField(s.ID, "ExportAllocs", old_s.ExportAllocs, s.ExportAllocs)
+	warnKeptField(s.ID, "ExportAllocOrders", old_s.ExportAllocOrders, s.ExportAllocOrders)
+	warnKeptField(s.ID, "Exporting", old_s.Exporting, s.Exporting)
+	warnKeptField(s.ID, "ExportOrders", old_s.ExportOrders, s.ExportOrders)
+	warnKeptField(s.ID, "Deliveries", old_s.Deliveries, s.Deliveries)
+	s.ExportAllocs = old_s.ExportAllocs
+	s.ExportAllocOrders = old_s.ExportAllocOrders
+	s.Exporting = old_s.Exporting
+	s.ExportOrders = old_s.ExportOrders
+	s.ExportOrderSeq = old_s.ExportOrderSeq
+	s.Deliveries = old_s.Deliveries
+	s.DeliverySeq = old_s.DeliverySeq
+	s.ExportScores = old_s.ExportScores
+	s.pendingLedger = old_s.pendingLedger
+	s.lastInv = old_s.lastInv
+	s.lastPos = old_s.lastPos
+	s.Rebalances = map[turtleID]*rebalanceOrder{}
+	for label, r := range old_s.Rebalances {
+		if r.BoxID >= s.nBoxes() || r.TargetID >= s.nBoxes() || s.Boxes[r.BoxID].Amount < 0 || s.Boxes[r.TargetID].Amount < 0 {
+			log.Printf("state reload: %v: dropping rebalance of %v for removed box %v", s.ID, label, r.BoxID)
+			continue
+		}
+		s.Rebalances[label] = r
+	}
+	s.Trips = map[turtleID]*pickupTrip{}
+	for label, trip := range old_s.Trips {
+		var stops []pickupStop
+		for _, stop := range trip.Stops {
+			if stop.BoxID < s.nBoxes() && s.Boxes[stop.BoxID].Amount >= 0 {
+				stops = append(stops, stop)
+			}
+		}
+		if len(stops) > 0 {
+			s.Trips[label] = &pickupTrip{Stops: stops}
+		}
+	}
+	s.Defrags = map[turtleID]*defragOrder{}
+	for label, d := range old_s.Defrags {
+		if d.BoxID >= s.nBoxes() || s.Boxes[d.BoxID].Amount < 0 {
+			log.Printf("state reload: %v: dropping defrag of %v for removed box %v", s.ID, label, d.BoxID)
+			continue
+		}
+		s.Defrags[label] = d
+	}
+	s.Audits = map[turtleID]*auditOrder{}
+	for label, a := range old_s.Audits {
+		if a.BoxID >= s.nBoxes() || s.Boxes[a.BoxID].Amount < 0 {
+			log.Printf("state reload: %v: dropping audit of %v for removed box %v", s.ID, label, a.BoxID)
+			continue
+		}
+		s.Audits[label] = a
+	}
+	s.LostBoxes = old_s.LostBoxes
+	for label, res := range old_s.reservations {
+		if res.boxID < s.nBoxes() && s.Boxes[res.boxID].Amount >= 0 {
+			s.reservations[label] = res
+		}
+	}
+}
+
+func (s *storageArea) decideWork(t turtle) (*job, error) {
+	return mgrDecideStorageWork(t, s)
+}
+
+func (s *storageArea) edit(fields map[string]json.RawMessage) (area, error) {
+	// Storage areas are always enabled.
+	edited := *s
+	// Lists are decoded into new slices, decoding into the current ones
+	// would overwrite their items.
+	var fuel_raw, placement_raw, bulk_export_raw json.RawMessage
+	var audit *bool
+	var routing []routingRule
+	var stock []stockRule
+	err := decodeAreaFields(fields, map[string]interface{}{
+		"box_slots":      &edited.BoxSlots,
+		"export_turtles": &edited.ExportTurtles,
+		"fuel":           &fuel_raw,
+		// bulk export pool, e.g. {"turtles": 2}
+		"bulk_export": &bulk_export_raw,
+		// true queues all boxes for audit, false clears the queue
+		"audit":   &audit,
+		"routing": &routing,
+		"stock":   &stock,
+		// placement policy, e.g. {"hot": 5}
+		"placement": &placement_raw,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if edited.BoxSlots <= 0 {
+		return nil, errBadRequest("invalid box_slots: %v", edited.BoxSlots)
+	}
+	if edited.ExportTurtles <= 0 {
+		return nil, errBadRequest("invalid export_turtles: %v", edited.ExportTurtles)
+	}
+	if routing != nil {
+		if err := initRoutingRules(routing, s.nBoxes()); err != nil {
+			return nil, errBadRequest("invalid routing: %v", err)
+		}
+		edited.Routing, edited.routingChanged = routing, true
+	}
+	if stock != nil {
+		for _, rule := range stock {
+			if err := rule.validate(); err != nil {
+				return nil, errBadRequest("invalid stock: %v", err)
+			}
+		}
+		edited.Stock = stock
+	}
+	if fuel_raw != nil {
+		if err := edited.Fuel.edit(fuel_raw); err != nil {
+			return nil, err
+		}
+	}
+	if placement_raw != nil {
+		if err := edited.Placement.edit(placement_raw); err != nil {
+			return nil, err
+		}
+	}
+	if bulk_export_raw != nil {
+		if err := edited.BulkExport.edit(bulk_export_raw); err != nil {
+			return nil, err
+		}
+	}
+	if audit != nil {
+		if *audit {
+			edited.AuditQueue = append([]int{}, s.AuditQueue...)
+			edited.startAudit()
+		} else {
+			edited.AuditQueue = nil
+		}
+	}
+	return &edited, nil
+}
+
+func (s *storageArea) handleExport(er exportRequest) (*exportOrder, error) {
+	if er.Count < 0 {
+		// Negative counts cancel queued exports of the item.
+		s.cancelItemExports(er.ItemID, -er.Count)
+		return nil, s.store()
+	}
+	order, err := s.addExportOrder(er)
+	if err != nil {
+		return nil, err
+	}
+	order_copy := *order
+	return &order_copy, s.store()
+}
+
+func (s *storageArea) releaseTurtle(label turtleID) bool {
+	released := false
+	// A slow turtle may still load the boxes of its orders, they are
+	// audited when it reports again.
+	var touched []int
+	if lo := s.LoadOrders[label]; lo != nil && lo.BoxID >= 0 {
+		touched = append(touched, lo.BoxID)
+	}
+	if d := s.Defrags[label]; d != nil {
+		touched = append(touched, d.BoxID)
+	}
+	if r := s.Rebalances[label]; r != nil {
+		touched = append(touched, r.BoxID, r.TargetID)
+	}
+	if len(touched) > 0 {
+		s.LostBoxes[label] = append(s.LostBoxes[label], touched...)
+	}
+	if s.LoadOrders[label] != nil {
+		// Items in the turtle are lost. A partially completed box load
+		// cannot be accounted for since the box delta is unknown.
+		delete(s.LoadOrders, label)
+		released = true
+	}
+	if item_map := s.ExportAllocs[label]; item_map != nil {
+		for item_id, amount := range item_map {
+			if amount <= 0 {
+				continue
+			}
+			// Items the turtle carried are lost with it.
+			n_carried := s.exportCarried(label, item_id, amount)
+			s.moveTurtleExportItems(label, item_id, n_carried, []exportStage{exportInTransit, exportAllocated}, exportMissing)
+			// Return items still in storage to the global export counter.
+			if n_stored := amount - n_carried; n_stored > 0 {
+				s.Exporting[item_id] += n_stored
+				s.moveTurtleExportItems(label, item_id, n_stored, []exportStage{exportAllocated, exportInTransit}, exportQueued)
+			}
+		}
+		delete(s.ExportAllocs, label)
+		delete(s.ExportAllocOrders, label)
+		released = true
+	}
+	if s.Defrags[label] != nil {
+		delete(s.Defrags, label)
+		released = true
+	}
+	if s.Rebalances[label] != nil {
+		delete(s.Rebalances, label)
+		released = true
+	}
+	if s.Trips[label] != nil {
+		delete(s.Trips, label)
+		released = true
+	}
+	if a := s.Audits[label]; a != nil {
+		// The box is audited by another turtle.
+		s.AuditQueue = append(s.AuditQueue, a.BoxID)
+		delete(s.Audits, label)
+		released = true
+	}
+	if d := s.turtleDelivery(label); d != nil {
+		// The delivered items are lost, another turtle fetches them again.
+		d.Turtle, d.Fetched, d.WorkID = "", false, 0
+		released = true
+	}
+	s.releaseReservation(label)
+	delete(s.lastPos, label)
+	if s.BulkExport.leave(label) {
+		// The next bulk export picks a replacement.
+		log.Printf("storage work warning: bulk export turtle %v is lost, leaving the pool", label)
+		released = true
+	}
+	return released
+}
+
+// Returns how many of the n_alloc items of an item allocated to a turtle
+// for export the turtle carries, from its last report. Without a report
+// since the server started the items in transit of the order it serves
+// are assumed to be carried.
+func (s storageArea) exportCarried(label turtleID, item_id itemID, n_alloc int) int {
+	n := 0
+	if inv, ok := s.lastInv[label]; ok {
+		n = inv[item_id]
+	} else if order := s.getExportOrder(s.ExportAllocOrders[label][item_id]); order != nil && order.ItemID == item_id {
+		n = order.InTransit
+	}
+	if n > n_alloc {
+		n = n_alloc
+	}
+	return n
 }
 
 func (s storageArea) nBoxesPerPlane() int {
-	return (s.XLen*2 + s.ZLen*2)
+	return s.Layout.nBoxesPerPlane()
 }
 
 func (s storageArea) nBoxes() int {
-	return s.nBoxesPerPlane() * s.Rows
+	return s.Layout.nBoxes()
 }
 
 func (s storageArea) getExportQ() qCoords {
-	return qCoords{
-		face_dir: vec3{0, 1, 0},
-		origin: vec3{
-			s.Pos[0] - 2,
-			s.Pos[1] - 1,
-			s.Pos[2] + 1,
-		},
-		q_dir:     vec3{0, 0, -1},
-		o_q0_dir:  vec3{0, -1, 0},
-		q0_t0_dir: vec3{-1, 0, 0},
-	}
+	return s.Layout.Export.coords(s.Pos)
 }
 
 func (s storageArea) getImportQ() qCoords {
-	return qCoords{
-		face_dir: vec3{0, 1, 0},
-		origin: vec3{
-			s.Pos[0] - 4,
-			s.Pos[1] - 1,
-			s.Pos[2] + 1,
-		},
-		q_dir:     vec3{0, 0, -1},
-		o_q0_dir:  vec3{0, -1, 0},
-		q0_t0_dir: vec3{1, 0, 0},
-	}
+	return s.Layout.Import.coords(s.Pos)
 }
 
 type boxOrient struct {
@@ -77,33 +594,9 @@ func (bo boxOrient) loadPos() vec3 {
 }
 
 func (s storageArea) getBoxOrient(id int) boxOrient {
-	out := boxOrient{}
-	pp := s.nBoxesPerPlane()
-	out.boxPos[1] = -id/pp - 2
-	plane_id := id % pp
-	if plane_id < s.XLen*2 {
-		out.boxPos[0] = -s.XLen + (plane_id % s.XLen)
-		if plane_id < s.XLen {
-			out.boxPos[2] = -s.ZLen - 1
-			out.loadDir = vec3{0, 0, -1}
-		} else {
-			out.boxPos[2] = 0
-			out.loadDir = vec3{0, 0, 1}
-		}
-	} else {
-		z_id := (plane_id - s.XLen*2)
-		out.boxPos[2] = -s.ZLen + (z_id % s.ZLen)
-		if z_id < s.ZLen {
-			out.boxPos[0] = -s.XLen - 1
-			out.loadDir = vec3{-1, 0, 0}
-		} else {
-			out.boxPos[0] = 0
-			out.loadDir = vec3{1, 0, 0}
-		}
-	}
+	out := s.Layout.boxOrient(id)
 	// Convert relative position of box in inventory to world coordinate.
 	out.boxPos = vec3Add(s.Pos, out.boxPos)
-	// fmt.Printf("box orient %d %#v\n", id, out)
 	return out
 }
 
@@ -113,12 +606,26 @@ type boxCandidate struct {
 	item_id itemID
 }
 
-func (s storageArea) closestBox(pos vec3, item_id itemID, drop bool) *boxCandidate {
+// Returns the closest box to load an item for a turtle. Boxes reserved by
+// other turtles are considered as they will be after their loads.
+func (s storageArea) closestBox(label turtleID, pos vec3, item_id itemID, drop bool) *boxCandidate {
 	var new, used *boxCandidate
+	new_rank := 0
+	defrag_sources := s.defragSources()
+	rebalance_boxes := s.rebalanceBoxes()
+	audit_boxes := s.auditBoxes()
+	reserved := s.reservedLoads(label)
+	hot := drop && s.isHot(item_id)
 	for id, box := range s.Boxes {
-		if box.Amount < 0 {
+		if box.Amount < 0 || (drop && (defrag_sources[id] || rebalance_boxes[id] || !s.routeAllows(item_id, id))) || audit_boxes[id] {
 			continue
 		}
+		if load := reserved[id]; load != nil {
+			if box.Name == "" {
+				box.Name = load.itemID
+			}
+			box.Amount += load.nDrop - load.nSuck
+		}
 		getCand := func() *boxCandidate {
 			return &boxCandidate{
 				dist:    vec3L1Dist(pos, s.getBoxOrient(id).loadPos()),
@@ -126,16 +633,18 @@ func (s storageArea) closestBox(pos vec3, item_id itemID, drop bool) *boxCandida
 				item_id: item_id,
 			}
 		}
-		if (drop && box.Amount == 0) || (!drop && box.Amount >= box.Capacity() && box.Name == item_id) {
-			// New box candidate.
-			// TODO: For drop we likely want to record a soft/temporary virtual
-			// selection to avoid contention when dropping multiple resources
-			// into new boxes by multiple turtles.
+		if (drop && box.Amount == 0 && box.Name == "") || (!drop && box.Amount >= s.boxCapacity(box.Name) && box.Name == item_id) {
+			// New box candidate. Hot items get the new box closest to
+			// the export station.
 			cand := getCand()
-			if new == nil || cand.dist < new.dist {
-				new = cand
+			rank := cand.dist
+			if hot {
+				rank = s.exportDist(id)
 			}
-		} else if box.Amount > 0 && box.Amount < box.Capacity() && box.Name == item_id {
+			if new == nil || rank < new_rank {
+				new, new_rank = cand, rank
+			}
+		} else if box.Amount > 0 && box.Amount < s.boxCapacity(box.Name) && box.Name == item_id {
 			// Used box candidate.
 			cand := getCand()
 			if used == nil || cand.dist < used.dist {
@@ -150,10 +659,10 @@ func (s storageArea) closestBox(pos vec3, item_id itemID, drop bool) *boxCandida
 	return new
 }
 
-func (s *storageArea) updateBox(box_id int, item_id itemID, delta int) {
+func (s *storageArea) updateBox(box_id int, item_id itemID, delta int) error {
 	box := &s.Boxes[box_id]
 	if box.Amount < 0 {
-		panic("attempting to update hole box")
+		return errConflict("attempting to update hole box %v", box_id)
 	}
 	box.Amount += delta
 	if box.Amount <= 0 {
@@ -163,18 +672,15 @@ func (s *storageArea) updateBox(box_id int, item_id itemID, delta int) {
 		if box.Name == "" {
 			box.Name = item_id
 		} else if box.Name != item_id {
-			panic(fmt.Sprintf("attempting to load %v in %v box", item_id, box.Name))
+			return errConflict("attempting to load %v in %v box", item_id, box.Name)
+		}
+		if box.Amount > s.boxCapacity(item_id) {
+			log.Printf("storage work warning: box %v holds %v %v, more than its capacity", box_id, box.Amount, item_id)
 		}
 	}
-	// Write update plane to json.
-	n_pp := s.nBoxesPerPlane()
-	plane_id := box_id / n_pp
-	box_plane := make([]storageBox, n_pp)
-	for i := 0; i < n_pp; i++ {
-		box_plane[i] = s.Boxes[n_pp*plane_id+i]
-	}
-	path := fmt.Sprintf("%s/plane.%d", path.Dir(s.Path), plane_id)
-	storeJSON(path, box_plane)
+	// Updated plane is written by the next store.
+	s.dirtyPlanes[box_id/s.nBoxesPerPlane()] = true
+	return nil
 }
 
 const ExportVBoxID = -1
@@ -200,21 +706,31 @@ type storageBox struct {
 	Name   itemID
 }
 
-func (s *storageBox) Capacity() int {
-	return 2048
+// Returns the number of items of an item that fit in a box.
+func (s storageArea) boxCapacity(item_id itemID) int {
+	return s.BoxSlots * itemMaxStack(item_id)
 }
 
-func mgrDecideStorageWork(t turtle, s *storageArea) *string {
+func mgrDecideStorageWork(t turtle, s *storageArea) (*job, error) {
+	s.recordImports(t)
+	s.lastPos[t.Label] = t.CurPos
 	// We generally do not assign work when an existing job is not completed,
 	// except for low priority interruptible jobs that should always be
 	// re-evaluated when reported in case another more important job is available.
 	if t.CurWork != nil && !t.CurWork.ID.isLowPriority() && !t.CurWork.Complete {
 		// Non interruptible work is not complete yet.
-		job := ""
-		return &job
+		return nil, nil
 	}
 	pending_area_changes := false
 
+	// Did a lost turtle report again?
+	if box_ids := s.LostBoxes[t.Label]; box_ids != nil {
+		log.Printf("storage work warning: lost turtle %v reported again, auditing boxes %v", t.Label, box_ids)
+		s.queueAudit(box_ids)
+		delete(s.LostBoxes, t.Label)
+		pending_area_changes = true
+	}
+
 	// Have we completed a box load that we should account for?
 	if lo_ptr := s.LoadOrders[t.Label]; lo_ptr != nil {
 		lo := *lo_ptr
@@ -222,23 +738,20 @@ func mgrDecideStorageWork(t turtle, s *storageArea) *string {
 			// Turtle did not get assigned work? Reassign load order.
 			log.Printf("storage work warning: turtle %v: current load order work: %#v,"+
 				" was unexpectedly not assigned", t.Label, lo)
-			job := makeLoadOrderJob(*s, lo)
-			return &job
+			return makeLoadOrderJob(*s, lo)
 		}
 		if t.CurWork.ID != lo.ID ||
 			(lo.Drop && t.CurWork.Type != "drop") ||
 			(!lo.Drop && t.CurWork.Type != "suck") {
-			log.Printf("storage work error: turtle %v: current work: %#v,"+
+			return nil, errConflict("storage work error: turtle %v: current work: %#v,"+
 				" does not match current load order: %#v", t.Label, t.CurWork, lo)
-			return nil
 		}
 		for item_id, lo_count := range lo.Items {
 			// Calculate turtle inventory amount delta.
 			cur_count := t.InvCount.Grouped[item_id]
 			n_delta := cur_count - lo_count.PreCount
 			if (n_delta < 0 && !lo.Drop) || (n_delta > 0 && lo.Drop) {
-				log.Printf("storage work error: turtle %v: negative load (%v) %#v", t.Label, n_delta, lo)
-				return nil
+				return nil, errConflict("storage work error: turtle %v: negative load (%v) %#v", t.Label, n_delta, lo)
 			}
 			if lo.BoxID == ExportVBoxID {
 				// Update export allocation.
@@ -248,22 +761,42 @@ func mgrDecideStorageWork(t turtle, s *storageArea) *string {
 						return -n_delta
 					}
 					item_amount := item_map[item_id]
+					n_accounted := -n_delta
+					if n_accounted > item_amount {
+						n_accounted = item_amount
+					}
+					s.moveTurtleExportItems(t.Label, item_id, n_accounted, []exportStage{exportInTransit, exportAllocated}, exportDelivered)
 					// Update remaining amount.
 					remaining := item_amount + n_delta
 					if remaining > 0 {
 						item_map[item_id] = remaining
 					} else {
-						delete(item_map, item_id)
-						if len(item_map) == 0 {
-							delete(s.ExportAllocs, t.Label)
-						}
+						s.clearExportAlloc(t.Label, item_id)
 					}
 					return -remaining
 				})()
+				// Items that were neither allocated nor queued for export
+				// were exported by a routing rule.
+				n_routed := n_unaccounted - s.Exporting[item_id]
+				if n_routed < 0 {
+					n_routed = 0
+				}
+				if rule := s.itemRule(item_id); n_routed > 0 && rule != nil && rule.Action == routeActionReject {
+					log.Printf("storage work warning: turtle %v: rejected %v %v, dropped in the export chest", t.Label, n_routed, item_id)
+					s.record(ledgerReject, t.Label, lo.ID, item_id, n_routed, ExportVBoxID)
+					s.record(ledgerExport, t.Label, lo.ID, item_id, -n_delta-n_routed, ExportVBoxID)
+				} else {
+					s.record(ledgerExport, t.Label, lo.ID, item_id, -n_delta, ExportVBoxID)
+				}
 				// Unaccounted exported items subtract the global export counter directly.
 				// This happens when items to export are import loaded and therefore not allocated.
 				if n_unaccounted > 0 {
-					if _, ok := s.Exporting[item_id]; ok {
+					if n_exporting, ok := s.Exporting[item_id]; ok {
+						if n_unaccounted > n_exporting {
+							s.moveExportItems(item_id, n_exporting, exportQueued, exportDelivered)
+						} else {
+							s.moveExportItems(item_id, n_unaccounted, exportQueued, exportDelivered)
+						}
 						s.Exporting[item_id] -= n_unaccounted
 						if s.Exporting[item_id] <= 0 {
 							delete(s.Exporting, item_id)
@@ -274,30 +807,101 @@ func mgrDecideStorageWork(t turtle, s *storageArea) *string {
 				// Normal box load.
 				box := s.Boxes[lo.BoxID]
 				if box.Amount < n_delta || (box.Name != "" && box.Name != item_id) {
-					log.Printf("storage work error: turtle %v: completed load is incompatible"+
+					return nil, errConflict("storage work error: turtle %v: completed load is incompatible"+
 						" with box: (%v), box: %#v, load order: %#v", t.Label, n_delta, box, lo)
-					return nil
 				}
 				// Box delta is negative turtle delta.
 				box_n_delta := -n_delta
 				// Adjust box content.
-				s.updateBox(lo.BoxID, item_id, box_n_delta)
+				if err := s.updateBox(lo.BoxID, item_id, box_n_delta); err != nil {
+					return nil, err
+				}
+				s.record(ledgerLoad, t.Label, lo.ID, item_id, box_n_delta, lo.BoxID)
+				// Sucked items allocated for export are in transit now.
+				if n_alloc := s.ExportAllocs[t.Label][item_id]; !lo.Drop && n_alloc > 0 {
+					n_picked := n_delta
+					if n_picked > n_alloc {
+						n_picked = n_alloc
+					}
+					s.moveTurtleExportItems(t.Label, item_id, n_picked, []exportStage{exportAllocated}, exportInTransit)
+				}
+				// Sucked items of a delivery are no longer in storage.
+				if d := s.turtleDelivery(t.Label); d != nil && !lo.Drop && !d.Fetched && d.ItemID == item_id {
+					d.Picked += n_delta
+				}
+				// Sucked items of a defragmented box are dropped next.
+				if d := s.Defrags[t.Label]; d != nil && !lo.Drop && d.BoxID == lo.BoxID {
+					d.Fetched = true
+				}
+				s.completeStop(t.Label, lo)
+				// Rebalanced items are dropped in the target box next.
+				if r := s.Rebalances[t.Label]; r != nil && !lo.Drop && r.BoxID == lo.BoxID {
+					r.Fetched = true
+				} else if r != nil && lo.Drop && r.Fetched && r.TargetID == lo.BoxID {
+					log.Printf("storage rebalance: %v: moved %v %v from box %v to %v", s.ID, box_n_delta, item_id, r.BoxID, r.TargetID)
+					delete(s.Rebalances, t.Label)
+				}
 			}
 		}
 		// Load order complete, remove it.
 		delete(s.LoadOrders, t.Label)
+		s.releaseReservation(t.Label)
 		// Storing changes is pending.
 		pending_area_changes = true
 	}
 
-	// Find new job.
+	// Have we completed an audit that we should account for?
+	if a := s.Audits[t.Label]; a != nil && a.ID != 0 {
+		if t.CurWork == nil || t.CurWork.ID != a.ID {
+			// Turtle did not get assigned work? Reassign audit.
+			log.Printf("storage work warning: turtle %v: current audit: %#v,"+
+				" was unexpectedly not assigned", t.Label, *a)
+			return makeJobAudit(a.ID, s.getBoxOrient(a.BoxID).loadDir), nil
+		}
+		if t.CurWork.Type != "audit" || t.CurWork.Audit == nil {
+			return nil, errConflict("storage work error: turtle %v: current work: %#v,"+
+				" does not match current audit: %#v", t.Label, t.CurWork, *a)
+		}
+		s.reconcileAudit(t.Label, *a, *t.CurWork.Audit)
+		delete(s.Audits, t.Label)
+		pending_area_changes = true
+	}
+
+	// Is defragmentation complete?
+	if d := s.Defrags[t.Label]; d != nil && d.Fetched && s.LoadOrders[t.Label] == nil && t.InvCount.Grouped[d.ItemID] == 0 {
+		delete(s.Defrags, t.Label)
+		pending_area_changes = true
+	}
+
+	// Is the delivery complete?
+	if d := s.turtleDelivery(t.Label); d != nil && d.WorkID != 0 && t.CurWork != nil && t.CurWork.ID == d.WorkID {
+		n_dropped := d.PreCount - t.InvCount.Grouped[d.ItemID]
+		log.Printf("supply: %v/%v: %v delivered %v %v", d.AreaID, d.Box, t.Label, n_dropped, d.ItemID)
+		s.record(ledgerDelivery, t.Label, d.WorkID, d.ItemID, n_dropped, -1)
+		if a, ok := areas[d.AreaID].(supplyArea); ok && n_dropped > 0 {
+			a.supplyLevels()[d.Box] += n_dropped
+			if err := areas[d.AreaID].store(); err != nil {
+				log.Printf("supply: error: %v: %v", d.AreaID, err)
+			}
+		}
+		s.removeDelivery(d)
+		pending_area_changes = true
+	}
+
+	// Find new job. The reservation of the previous job is renewed if the
+	// turtle is sent to the same box again.
+	s.pruneReservations()
+	s.pruneExportScores()
+	if s.LoadOrders[t.Label] == nil {
+		s.releaseReservation(t.Label)
+	}
 	// The highest priority is always to refuel when out of fuel.
 	// First we need to divide our theoretical inventory into the subsets:
 	// A = {inventory we have and don't want to export}
 	// B = {inventory we have and want to export}
 	// C = {inventory we don't have and want to export}
 	// When we have free slots:
-	//  - 1. When C has more than one item: suck them (select closest box).
+	//  - 1. When C has more than one item: suck them on a pickup trip.
 	//  - 2. When B has more than one item: drop them (export all).
 	//  - 3. When A has more than one item: drop it (select closest box).
 	//  - 4. Queue for import.
@@ -315,11 +919,22 @@ func mgrDecideStorageWork(t turtle, s *storageArea) *string {
 	export_q := s.getExportQ()
 
 	// Create a box load job.
-	boxLoadJob := func(cand *boxCandidate, drop bool, abs_delta int) *string {
+	boxLoadJob := func(cand *boxCandidate, drop bool, abs_delta int) (*job, error) {
 		// Are we at the box load position?
 		box_orient := s.getBoxOrient(cand.id)
 		box_load_pos := box_orient.loadPos()
 		// fmt.Printf("box %#v %#v %v %v\n", cand, box_orient, box_load_pos, drop)
+		box_amount := s.Boxes[cand.id].Amount
+		if !drop && abs_delta > box_amount {
+			// Cannot suck more than what's in the box.
+			abs_delta = box_amount
+		}
+		if n_room := s.boxCapacity(cand.item_id) - box_amount; drop && abs_delta > n_room {
+			// Cannot drop more than what fits in the box. The rest
+			// is dropped in another box.
+			abs_delta = n_room
+		}
+		s.reserveBox(t.Label, cand, drop, abs_delta)
 		if vec3Equal(t.CurPos, box_load_pos) {
 			// Create load order job.
 			pending_area_changes = true
@@ -327,11 +942,6 @@ func mgrDecideStorageWork(t turtle, s *storageArea) *string {
 			lo := new(loadOrder)
 			lo.ID = workID(s.WorkIDSeq)
 			lo.BoxID = cand.id
-			box_amount := s.Boxes[cand.id].Amount
-			if !drop && abs_delta > box_amount {
-				// Cannot suck more than what's in the box.
-				abs_delta = box_amount
-			}
 			lo.Items = map[itemID]itemLoadCount{
 				cand.item_id: itemLoadCount{
 					PreCount: t.InvCount.Grouped[cand.item_id],
@@ -340,77 +950,53 @@ func mgrDecideStorageWork(t turtle, s *storageArea) *string {
 			}
 			lo.Drop = drop
 			s.LoadOrders[t.Label] = lo
-			job := makeLoadOrderJob(*s, *lo)
-			return &job
+			return makeLoadOrderJob(*s, *lo)
 		} else {
 			// Create go job.
-			job := makeJobGo(workIDTmp, []vec3{box_load_pos})
-			return &job
+			return makeJobGo(workIDTmp, []vec3{box_load_pos}), nil
 		}
 	}
 
 	// Handler for refueling.
-	tryRefuel := func() *string {
-		if t.FuelLvl > 500 {
-			return nil
-		}
-		// When we have refuel item in inventory we use them.
-		item_id := itemID("minecraft:coal/0")
-		fuel_per_item := 80
-		fuel_to_lvl := 5000
-		n_has := t.InvCount.Grouped[item_id]
-		// Note: Assuming one stack of fuel.
-		if n_has == 0 && t.InvCount.FreeSlots == 0 {
-			return nil
-		}
-		n_need := fuel_to_lvl / fuel_per_item
-		if n_has < n_need {
-			// Find closest box to pick up fuel.
-			cand := s.closestBox(t.CurPos, item_id, false)
-			if cand != nil {
-				return boxLoadJob(cand, false, n_need-n_has)
-			}
-			log.Printf("storage work warning: turtle %v: no available fuel in inventory", t.Label)
-			if n_has == 0 {
-				return nil
+	tryRefuel := func() (*job, error) {
+		if !s.Fuel.needsRefuel(t) {
+			return nil, nil
+		}
+		// Find closest box with the best fuel available.
+		var cand *boxCandidate
+		for _, item_id := range s.Fuel.bestItems() {
+			if cand = s.closestBox(t.Label, t.CurPos, item_id, false); cand != nil {
+				break
 			}
-			n_need = n_has
 		}
-		job := makeJobRefuel(workIDTmp, item_id, n_need)
-		return &job
+		box_item := itemID("")
+		if cand != nil {
+			box_item = cand.item_id
+		} else {
+			log.Printf("storage work warning: turtle %v: no available fuel in storage", t.Label)
+		}
+		refuel_job, n_fetch := s.Fuel.decide(t, box_item)
+		if n_fetch == 0 {
+			return refuel_job, nil
+		}
+		return boxLoadJob(cand, false, n_fetch)
 	}
 
-	// General handler for A/C cases.
-	tryHandleAC := func(inv_x map[itemID]int, drop bool) *string {
-		if len(inv_x) == 0 {
-			return nil
+	// Handler for A. Items we hold and don't export are dropped in the
+	// closest box.
+	tryHandleA := func() (*job, error) {
+		if len(inv_a) == 0 {
+			return nil, nil
 		}
 		// Find closest free box to drop for any item we want to drop.
 		var cand *boxCandidate
-		for item_id, amount := range inv_x {
-			if !drop && amount >= 512 && s.LargeStackTurtle != "" {
-				if t.Label != s.LargeStackTurtle {
-					// We have a dedicated for export of large stacks, and it's not us.
-					continue
-				}
-			}
-			used := s.closestBox(t.CurPos, item_id, drop)
+		for item_id := range inv_a {
+			used := s.closestBox(t.Label, t.CurPos, item_id, true)
 			if used == nil {
-				if drop {
-					log.Printf("storage work warning: turtle %v: no free box to load junk %v", t.Label, item_id)
+				if target := mgrFederatedImportTarget(item_id, s.ID); target != nil {
+					log.Printf("storage work warning: turtle %v: no free box to load junk %v, %v has room for %v", t.Label, item_id, target.AreaID, target.FreeCapacity)
 				} else {
-					log.Printf("storage work warning: turtle %v: out of item %v, nothing to export", t.Label, item_id)
-					// Automatically delete any export allocation of this item.
-					item_map := s.ExportAllocs[t.Label]
-					if item_map != nil {
-						if _, ok := item_map[item_id]; ok {
-							delete(item_map, item_id)
-							if len(item_map) == 0 {
-								delete(s.ExportAllocs, t.Label)
-							}
-							pending_area_changes = true
-						}
-					}
+					log.Printf("storage work warning: turtle %v: no free box to load junk %v", t.Label, item_id)
 				}
 				continue
 			}
@@ -419,45 +1005,177 @@ func mgrDecideStorageWork(t turtle, s *storageArea) *string {
 			}
 		}
 		if cand == nil {
-			return nil
+			return nil, nil
 		}
-		// fmt.Printf("load candidate: %#v\n", cand)
-		// Has a load candidate now.
-		box_amount := s.Boxes[cand.id].Amount
-		if !drop {
-			// Allocate export of this item to this turtle if have not already.
-			if s.ExportAllocs[t.Label][cand.item_id] == 0 {
-				pending_area_changes = true
-				n_export_me := inv_x[cand.item_id]
-				if n_export_me > box_amount {
-					// We do not export allocate more than what's in the target candidate box.
-					// This allows parallel export of large quantities.
-					n_export_me = box_amount
-				}
-				n_export_tot := s.Exporting[cand.item_id]
-				// assert(n_export_tot <= n_export_me) - inv_c cannot be defined with larger value
-				s.Exporting[cand.item_id] = n_export_tot - n_export_me
-				if s.Exporting[cand.item_id] <= 0 {
-					delete(s.Exporting, cand.item_id)
-				}
-				eallocs := s.ExportAllocs[t.Label]
-				if eallocs == nil {
-					eallocs = map[itemID]int{}
-					s.ExportAllocs[t.Label] = eallocs
+		return boxLoadJob(cand, true, inv_a[cand.item_id])
+	}
+
+	// Handler for audits. Turtles with nothing better to do audit queued
+	// boxes.
+	tryAudit := func() (*job, error) {
+		a := s.Audits[t.Label]
+		if a == nil {
+			if a = s.takeAuditBox(t); a == nil {
+				return nil, nil
+			}
+			s.Audits[t.Label] = a
+			pending_area_changes = true
+		}
+		box_orient := s.getBoxOrient(a.BoxID)
+		if !vec3Equal(t.CurPos, box_orient.loadPos()) {
+			return makeJobGo(workIDTmp, []vec3{box_orient.loadPos()}), nil
+		}
+		// Create audit job.
+		pending_area_changes = true
+		s.WorkIDSeq++
+		a.ID = workID(s.WorkIDSeq)
+		return makeJobAudit(a.ID, box_orient.loadDir), nil
+	}
+
+	// Handler for defragmentation. Turtles waiting for imports without
+	// anything to import select a box to defragment.
+	tryDefrag := func() (*job, error) {
+		d := s.Defrags[t.Label]
+		if d == nil {
+			idle := t.CurWork != nil && t.CurWork.ID == workIDInvImpSuck && !t.CurWork.Complete &&
+				vec3Equal(t.CurPos, import_q.origin)
+			if !idle {
+				return nil, nil
+			}
+			cand, n_suck := s.defragCandidate(t)
+			if cand == nil {
+				return nil, nil
+			}
+			d = &defragOrder{BoxID: cand.id, ItemID: cand.item_id, Count: n_suck}
+			s.Defrags[t.Label] = d
+			pending_area_changes = true
+		} else if d.Fetched {
+			// Fetched items are dropped as A.
+			return nil, nil
+		}
+		if !s.isPartialBox(d.BoxID, d.ItemID) {
+			// Box was emptied or filled in the meantime.
+			delete(s.Defrags, t.Label)
+			pending_area_changes = true
+			return nil, nil
+		}
+		cand := &boxCandidate{
+			dist:    vec3L1Dist(t.CurPos, s.getBoxOrient(d.BoxID).loadPos()),
+			id:      d.BoxID,
+			item_id: d.ItemID,
+		}
+		return boxLoadJob(cand, false, d.Count)
+	}
+
+	// Handler for deliveries to supply boxes. The items are fetched and
+	// then dropped in the supply box. Deliveries are created for supply
+	// boxes below their minimum and are served before exports.
+	tryDeliver := func() (*job, error) {
+		d := s.turtleDelivery(t.Label)
+		if d == nil {
+			if t.InvCount.FreeSlots == 0 {
+				return nil, nil
+			}
+			if d = s.takeDelivery(t.Label); d == nil {
+				return nil, nil
+			}
+			pending_area_changes = true
+		}
+		n_has := t.InvCount.Grouped[d.ItemID]
+		if !d.Fetched {
+			if n_has < d.Count && t.InvCount.FreeSlots > 0 {
+				if cand := s.closestBox(t.Label, t.CurPos, d.ItemID, false); cand != nil {
+					return boxLoadJob(cand, false, d.Count-n_has)
 				}
-				eallocs[cand.item_id] = n_export_me
 			}
+			if n_has == 0 {
+				log.Printf("storage work warning: turtle %v: no %v to deliver to %v/%v", t.Label, d.ItemID, d.AreaID, d.Box)
+				s.removeDelivery(d)
+				pending_area_changes = true
+				return nil, nil
+			}
+			// Deliver what we have.
+			if n_has < d.Count {
+				d.Count = n_has
+			}
+			d.Fetched = true
+			pending_area_changes = true
+		}
+		load_pos, load_dir, err := deliveryTarget(*d)
+		if err != nil {
+			log.Printf("storage work warning: turtle %v: cannot deliver: %v", t.Label, err)
+			s.removeDelivery(d)
+			pending_area_changes = true
+			return nil, nil
+		}
+		if !vec3Equal(t.CurPos, load_pos) {
+			return makeJobGo(workIDTmp, []vec3{load_pos}), nil
 		}
-		return boxLoadJob(cand, drop, inv_x[cand.item_id])
+		// Create drop job.
+		pending_area_changes = true
+		s.WorkIDSeq++
+		d.WorkID = workID(s.WorkIDSeq)
+		d.PreCount = n_has
+		n_drop := d.Count
+		if n_drop > n_has {
+			n_drop = n_has
+		}
+		return makeJobDrop(d.WorkID, map[itemID]int{d.ItemID: n_drop}, load_dir), nil
 	}
 
-	// Handlers for all cases.
-	tryHandleA := func() *string {
-		return tryHandleAC(inv_a, true)
+	// Handler for rebalancing. Turtles waiting for imports without anything
+	// to import move cold items away from the export station.
+	tryRebalance := func() (*job, error) {
+		r := s.Rebalances[t.Label]
+		if r == nil {
+			idle := t.CurWork != nil && t.CurWork.ID == workIDInvImpSuck && !t.CurWork.Complete &&
+				vec3Equal(t.CurPos, import_q.origin)
+			if !idle || len(s.AuditQueue) > 0 {
+				return nil, nil
+			}
+			if r = s.rebalanceCandidate(t); r == nil {
+				return nil, nil
+			}
+			s.Rebalances[t.Label] = r
+			pending_area_changes = true
+		}
+		if !r.Fetched {
+			if box := s.Boxes[r.BoxID]; box.Amount <= 0 || box.Name != r.ItemID {
+				// Box was emptied in the meantime.
+				delete(s.Rebalances, t.Label)
+				pending_area_changes = true
+				return nil, nil
+			}
+			cand := &boxCandidate{
+				dist:    vec3L1Dist(t.CurPos, s.getBoxOrient(r.BoxID).loadPos()),
+				id:      r.BoxID,
+				item_id: r.ItemID,
+			}
+			return boxLoadJob(cand, false, r.Count)
+		}
+		n_has := t.InvCount.Grouped[r.ItemID]
+		if n_has > r.Count {
+			n_has = r.Count
+		}
+		if target := s.Boxes[r.TargetID]; n_has == 0 || (target.Amount != 0 && target.Name != r.ItemID) {
+			// Nothing was fetched or the target was taken. Held items are
+			// dropped as A.
+			delete(s.Rebalances, t.Label)
+			pending_area_changes = true
+			return nil, nil
+		}
+		cand := &boxCandidate{
+			dist:    vec3L1Dist(t.CurPos, s.getBoxOrient(r.TargetID).loadPos()),
+			id:      r.TargetID,
+			item_id: r.ItemID,
+		}
+		return boxLoadJob(cand, true, n_has)
 	}
-	tryHandleB := func() *string {
+
+	// Handlers for B and C.
+	tryHandleB := func() (*job, error) {
 		if len(inv_b) == 0 {
-			return nil
+			return nil, nil
 		}
 		// Are we at the export position?
 		if vec3Equal(t.CurPos, export_q.origin) {
@@ -476,19 +1194,53 @@ func mgrDecideStorageWork(t turtle, s *storageArea) *string {
 			}
 			drop_lo.Drop = true
 			s.LoadOrders[t.Label] = drop_lo
-			job := makeLoadOrderJob(*s, *drop_lo)
-			return &job
+			return makeLoadOrderJob(*s, *drop_lo)
 		} else {
 			// Create queue job. This is a temporary important job and
 			// does not need to be interruptible.
-			job := makeQueueOrderJob(workIDTmp, export_q)
-			return &job
+			return makeQueueOrderJob(workIDTmp, export_q), nil
 		}
 	}
-	tryHandleC := func() *string {
-		return tryHandleAC(inv_c, false)
+	tryHandleC := func() (*job, error) {
+		trip := s.Trips[t.Label]
+		if trip == nil {
+			if len(inv_b) > 0 && len(s.ExportAllocs[t.Label]) > 0 {
+				// Fetched items are exported before the next trip.
+				return nil, nil
+			}
+			var changed bool
+			trip, changed = s.planTrip(t, inv_c)
+			if changed {
+				pending_area_changes = true
+			}
+			if trip == nil {
+				return nil, nil
+			}
+			s.Trips[t.Label] = trip
+		}
+		for len(trip.Stops) > 0 {
+			stop := trip.Stops[0]
+			// Only allocated items that we don't hold yet are sucked.
+			n_load := stop.Count
+			if n_want := inv_c[stop.ItemID]; n_load > n_want {
+				n_load = n_want
+			}
+			if box := s.Boxes[stop.BoxID]; n_load > 0 && box.Amount > 0 && box.Name == stop.ItemID {
+				cand := &boxCandidate{
+					dist:    vec3L1Dist(t.CurPos, s.getBoxOrient(stop.BoxID).loadPos()),
+					id:      stop.BoxID,
+					item_id: stop.ItemID,
+				}
+				return boxLoadJob(cand, false, n_load)
+			}
+			// Nothing left to fetch or the box changed in the meantime.
+			trip.Stops = trip.Stops[1:]
+			pending_area_changes = true
+		}
+		delete(s.Trips, t.Label)
+		return nil, nil
 	}
-	importQueue := func() string {
+	importQueue := func() *job {
 		// Are we at the import position?
 		// Both of these jobs are temporary and unimportant. They should be
 		// cancelled if required (e.g. if export is suddenly required).
@@ -498,26 +1250,18 @@ func mgrDecideStorageWork(t turtle, s *storageArea) *string {
 		if vec3Equal(t.CurPos, import_q.origin) {
 			// Create generic suck order.
 			if t.CurWork != nil && t.CurWork.ID == workIDInvImpSuck {
-				return ""
+				return nil
 			}
 			return makeJobSuck(workIDInvImpSuck, nil, 0, import_q.face_dir)
 		} else {
 			// Create queue order.
 			if t.CurWork != nil && t.CurWork.ID == workIDInvImpQueue {
-				return ""
+				return nil
 			}
 			return makeQueueOrderJob(workIDInvImpQueue, import_q)
 		}
 	}
 
-	// Some items are blacklisted and should be immediately exported
-	// because we can distinguish different items that can't be stacked.
-	// This is caused by mods not using damage/metadata properly.
-	item_blacklist := map[itemID]bool{
-		itemID("Thaumcraft:ItemWispEssence/0"): true,
-		itemID("Thaumcraft:ItemManaBean/0"):    true,
-	}
-
 	// Generate A, B and C.
 	for item_id, want_count := range s.ExportAllocs[t.Label] {
 		if want_count > 0 {
@@ -530,10 +1274,23 @@ func mgrDecideStorageWork(t turtle, s *storageArea) *string {
 		}
 	}
 	for item_id, has_count := range t.InvCount.Grouped {
+		if d := s.turtleDelivery(t.Label); d != nil && d.ItemID == item_id {
+			// Items held for a delivery are not stored.
+			if has_count -= d.Count; has_count <= 0 {
+				continue
+			}
+		}
+		if r := s.Rebalances[t.Label]; r != nil && r.Fetched && r.ItemID == item_id {
+			// Rebalanced items are dropped in their target box.
+			if has_count -= r.Count; has_count <= 0 {
+				continue
+			}
+		}
 		inv_a[item_id] = has_count
 		exp_count := inv_c[item_id]
-		if item_blacklist[item_id] && exp_count < has_count {
-			exp_count = has_count
+		// Routing rules may export items that are not requested.
+		if n_routed := s.nRoutedExport(item_id, has_count); exp_count < n_routed {
+			exp_count = n_routed
 		}
 		if exp_count > 0 {
 			if exp_count > has_count {
@@ -553,41 +1310,50 @@ func mgrDecideStorageWork(t turtle, s *storageArea) *string {
 	}
 
 	// Work priority is based on free slots.
-	var job *string
+	var new_job *job
+	var err error
 	if t.InvCount.FreeSlots > 0 {
-		for _, fn := range []func() *string{tryRefuel, tryHandleC, tryHandleB, tryHandleA} {
-			job = fn()
-			if job != nil {
+		for _, fn := range []func() (*job, error){tryRefuel, tryDeliver, tryHandleC, tryHandleB, tryHandleA, tryRebalance, tryAudit, tryDefrag} {
+			new_job, err = fn()
+			if err != nil {
+				return nil, err
+			}
+			if new_job != nil {
 				break
 			}
 		}
-		if job == nil {
-			import_job := importQueue()
-			job = &import_job
+		if new_job == nil {
+			new_job = importQueue()
 		}
 	} else {
-		for _, fn := range []func() *string{tryRefuel, tryHandleA, tryHandleB} {
-			job = fn()
-			if job != nil {
+		for _, fn := range []func() (*job, error){tryRefuel, tryDeliver, tryHandleA, tryHandleB, tryRebalance} {
+			new_job, err = fn()
+			if err != nil {
+				return nil, err
+			}
+			if new_job != nil {
 				break
 			}
 		}
-		if job == nil {
+		if new_job == nil {
 			// No free slots and nothing to drop? Expected if entire inventory is full.
 			log.Printf("storage work error: turtle %v: no free slots and nothing to drop", t.Label)
+			new_job = makeJobIdle(workIDTmp, 10)
 		}
 	}
 
 	// Store pending area changes.
 	if pending_area_changes {
-		s.store()
+		if store_err := s.store(); store_err != nil {
+			return nil, store_err
+		}
 	}
 
 	// Return job.
-	return job
+	return new_job, err
 }
 
-func makeLoadOrderJob(s storageArea, lo loadOrder) string {
+func makeLoadOrderJob(s storageArea, lo loadOrder) (*job, error) {
 	if lo.Drop {
 		var load_dir vec3
 		if lo.BoxID == ExportVBoxID {
@@ -601,12 +1367,12 @@ func makeLoadOrderJob(s storageArea, lo loadOrder) string {
 		for item_id, lo_count := range lo.Items {
 			items[item_id] = lo_count.AbsDelta
 		}
-		return makeJobDrop(lo.ID, items, load_dir)
+		return makeJobDrop(lo.ID, items, load_dir), nil
 	} else {
 		box_orient := s.getBoxOrient(lo.BoxID)
 		for item_id, lo_count := range lo.Items {
-			return makeJobSuck(lo.ID, &item_id, lo_count.AbsDelta, box_orient.loadDir)
+			return makeJobSuck(lo.ID, &item_id, lo_count.AbsDelta, box_orient.loadDir), nil
 		}
-		panic("expected exactly one item in load order to suck, got zero")
+		return nil, errConflict("expected exactly one item in load order to suck, got zero")
 	}
 }
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"path"
+	"reflect"
+	"testing"
+)
+
+// Boots a storage area whose first box holds 64 cobblestone.
+func bootCobbleStorage(t *testing.T) *storageArea {
+	err := simBootServer(simStateDir(t, map[string]string{
+		"storage.0/details": `{"ID": "storage.0", "Pos": [50, 121, 822], "XLen": 4, "ZLen": 4, "Rows": 2}`,
+		"storage.0/plane.0": `[{"Amount": 64, "Name": "minecraft:cobblestone/0"}]`,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return areas["storage.0"].(*storageArea)
+}
+
+func TestReleaseTurtleExports(t *testing.T) {
+	const item_id = itemID("minecraft:cobblestone/0")
+	tests := []struct {
+		name string
+		// inventory of the last report, nil if the turtle did not report
+		inv          map[itemID]int
+		n_picked     int
+		want_queued  int
+		want_missing int
+	}{
+		{"allocated", map[itemID]int{}, 0, 20, 0},
+		{"carried", map[itemID]int{item_id: 8}, 8, 12, 8},
+		{"not reported", nil, 8, 12, 8},
+	}
+	for _, test := range tests {
+		s := bootCobbleStorage(t)
+		created, err := exportItems(exportRequest{ItemID: item_id, Count: 20, AreaID: "storage.0"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		order := s.getExportOrder(created.ID)
+		err = mgrCall(func() error {
+			const label = turtleID("storage.0.1")
+			if n := s.allocateExport(label, item_id, 20); n != 20 {
+				t.Fatalf("%v: allocated %v, want 20", test.name, n)
+			}
+			s.moveTurtleExportItems(label, item_id, test.n_picked, []exportStage{exportAllocated}, exportInTransit)
+			if test.inv != nil {
+				s.lastInv[label] = test.inv
+			}
+			if !s.releaseTurtle(label) {
+				t.Errorf("%v: nothing released", test.name)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if order.Queued != test.want_queued || order.Missing != test.want_missing || order.Allocated != 0 || order.InTransit != 0 {
+			t.Errorf("%v: order %+v, want %v queued and %v missing", test.name, *order, test.want_queued, test.want_missing)
+		}
+		if n := s.Exporting[item_id]; n != test.want_queued {
+			t.Errorf("%v: exporting %v, want %v", test.name, n, test.want_queued)
+		}
+	}
+}
+
+func TestLoadLegacyExportAllocOrders(t *testing.T) {
+	const item_id = itemID("minecraft:cobblestone/0")
+	dir := simStateDir(t, map[string]string{
+		"storage.0/details": `{"ID": "storage.0", "Pos": [50, 121, 822], "XLen": 4, "ZLen": 4, "Rows": 2,
+			"Exporting": {"minecraft:cobblestone/0": 10},
+			"export_allocs": {"storage.0.1": {"minecraft:cobblestone/0": 20}},
+			"export_orders": [{"ID": 3, "item_id": "minecraft:cobblestone/0", "Count": 30, "Queued": 10, "Allocated": 20}],
+			"export_order_seq": 3,
+			"export_alloc_orders": {"storage.0.1": 3, "storage.0.2": 7}}`,
+	})
+	// Loaded without booting since lost turtles are released on boot.
+	s := new(storageArea)
+	if err := s.load("storage.0", path.Join(dir, "storage.0")); err != nil {
+		t.Fatal(err)
+	}
+	want := map[turtleID]map[itemID]int{"storage.0.1": {item_id: 3}}
+	if !reflect.DeepEqual(s.ExportAllocOrders, want) {
+		t.Errorf("got export alloc orders %v, want %v", s.ExportAllocOrders, want)
+	}
+	if s.LegacyExportAllocOrders != nil {
+		t.Errorf("legacy export alloc orders kept: %v", s.LegacyExportAllocOrders)
+	}
+}
+
+func TestFullTurtleIdles(t *testing.T) {
+	s := bootCobbleStorage(t)
+	var got *job
+	err := mgrCall(func() error {
+		// The turtle has no free slots and nothing the storage takes.
+		var err error
+		got, err = mgrDecideStorageWork(turtle{
+			Label:    "storage.0.1",
+			CurPos:   s.Pos,
+			InvCount: icount{FreeSlots: 0, Grouped: map[itemID]int{}},
+		}, s)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.Instr.jobType() != "idle" {
+		t.Errorf("got job %+v, want idle", got)
+	}
+}
+
+func TestLostTurtleAudit(t *testing.T) {
+	const label = turtleID("storage.0.1")
+	s := bootCobbleStorage(t)
+	err := mgrCall(func() error {
+		s.LoadOrders[label] = &loadOrder{
+			ID:    1,
+			BoxID: 0,
+			Items: map[itemID]itemLoadCount{"minecraft:cobblestone/0": {PreCount: 0, AbsDelta: 64}},
+		}
+		if !s.releaseTurtle(label) {
+			t.Errorf("nothing released")
+		}
+		if got := s.LostBoxes[label]; len(got) != 1 || got[0] != 0 {
+			t.Errorf("lost boxes %v, want [0]", got)
+		}
+		// The turtle sucked the box after it was released.
+		_, err := mgrDecideStorageWork(turtle{
+			Label:    label,
+			CurPos:   s.Pos,
+			CurWork:  &work{ID: 1, Type: "suck", Complete: true},
+			InvCount: icount{FreeSlots: 15, Grouped: map[itemID]int{"minecraft:cobblestone/0": 64}},
+		}, s)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	audited := s.auditBoxes()
+	for _, box_id := range s.AuditQueue {
+		audited[box_id] = true
+	}
+	if !audited[0] || len(s.LostBoxes) != 0 {
+		t.Errorf("box 0 not audited after the lost turtle reported: queue %v, audits %v, lost boxes %v", s.AuditQueue, s.Audits, s.LostBoxes)
+	}
+}
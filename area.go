@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// An area is a part of the world that turtles are assigned to by label,
+// e.g. turtle "storage.0.3" works in area "storage.0". Each area kind
+// implements its own work decisions and persistence.
+type area interface {
+	// Returns the id of the area.
+	id() areaID
+	// Returns the fuel policy of the turtles of the area.
+	getFuel() fuelPolicy
+	// Decides new work for a turtle that reported in the area.
+	// A nil job means that the turtle should keep its current job.
+	decideWork(t turtle) (*job, error)
+	// Handles a request to export items from the area. Returns the new
+	// export order, nil if the request did not create one.
+	handleExport(er exportRequest) (*exportOrder, error)
+	// Releases all work and items allocated to a turtle that is lost so
+	// they can be assigned to other turtles. Returns true if anything was
+	// released. Changes are stored by the caller.
+	releaseTurtle(label turtleID) bool
+	// Returns a copy of the area with edited settings, e.g.
+	// {"enabled": false}. The area itself is not changed. The copy is
+	// stored by the caller.
+	edit(fields map[string]json.RawMessage) (area, error)
+	// Loads area state from the area directory.
+	load(area_id areaID, area_dir string) error
+	// Takes over in-flight allocations from the previously loaded instance
+	// of the area when the area is reloaded.
+	keepAllocations(old area)
+	// Stores area state.
+	store() error
+	// Returns a generic description of the area.
+	describe() areaInfo
+}
+
+// Generic area description that can be inspected without knowing the
+// concrete area type.
+type areaInfo struct {
+	ID      areaID `json:"id"`
+	Type    string `json:"type"`
+	Enabled bool   `json:"enabled"`
+	Pos     vec3   `json:"pos"`
+	// area type specific summary
+	Details map[string]interface{} `json:"details"`
+}
+
+// Map from area id prefix (area type) to area constructor.
+var areaTypes = map[string]func() area{}
+
+// Registers a new area type. Turtles and area directories with an id
+// starting with "<prefix>." are handled by areas created by new_fn.
+func registerAreaType(prefix string, new_fn func() area) {
+	if _, ok := areaTypes[prefix]; ok {
+		panic(fmt.Sprintf("area type registered twice: %v", prefix))
+	}
+	areaTypes[prefix] = new_fn
+}
+
+// Returns the area type of an area id.
+func areaTypeOf(area_id areaID) (string, error) {
+	area_parts := strings.Split(string(area_id), ".")
+	if len(area_parts) != 2 {
+		return "", fmt.Errorf("invalid area id: %v", area_id)
+	}
+	return area_parts[0], nil
+}
+
+// Creates a new unloaded area for an area id.
+func newArea(area_id areaID) (area, error) {
+	area_type, err := areaTypeOf(area_id)
+	if err != nil {
+		return nil, err
+	}
+	new_fn := areaTypes[area_type]
+	if new_fn == nil {
+		return nil, fmt.Errorf("unknown area type: %v", area_type)
+	}
+	return new_fn(), nil
+}
+
+// Decodes edited area fields into the matching destinations in dst.
+// Fields without a destination cannot be edited.
+func decodeAreaFields(fields map[string]json.RawMessage, dst map[string]interface{}) error {
+	for name, raw := range fields {
+		ptr := dst[name]
+		if ptr == nil {
+			return errBadRequest("field %v cannot be edited", name)
+		}
+		if err := json.Unmarshal(raw, ptr); err != nil {
+			return errBadRequest("invalid %v: %v", name, err)
+		}
+	}
+	return nil
+}
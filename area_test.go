@@ -0,0 +1,31 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNewArea(t *testing.T) {
+	tests := []struct {
+		area_id  areaID
+		want     area
+		want_err bool
+	}{
+		{"storage.0", new(storageArea), false},
+		{"mine.1", new(mineArea), false},
+		{"farm.2", new(farmArea), false},
+		{"quarry.0", nil, true},
+		{"storage", nil, true},
+		{"storage.0.1", nil, true},
+	}
+	for _, test := range tests {
+		a, err := newArea(test.area_id)
+		if (err != nil) != test.want_err {
+			t.Errorf("%v: got error %v, want error %v", test.area_id, err, test.want_err)
+			continue
+		}
+		if reflect.TypeOf(a) != reflect.TypeOf(test.want) {
+			t.Errorf("%v: got area %T, want %T", test.area_id, a, test.want)
+		}
+	}
+}
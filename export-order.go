@@ -0,0 +1,482 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Export orders track requests to export items from a storage area.
+// Every item of an order is in exactly one stage. Queued items are counted
+// in storageArea.Exporting, allocated items in storageArea.ExportAllocs
+// until a turtle picks them up, and in transit items until the turtle drops
+// them in the export queue. Items move between stages for all orders of an
+// item in order priority, items allocated to a turtle first for the order
+// the turtle serves.
+//
+// Orders are served as a queue: by priority, then first in first out. A
+// turtle is allocated items of the first orders it may serve, one order per
+// item, and every order occupies at most max_turtles turtles at a time, so
+// a large order does not starve the orders behind it.
+
+type exportStage int
+
+const (
+	exportQueued = exportStage(iota)
+	exportAllocated
+	exportInTransit
+	exportDelivered
+	// items that were not in storage when an allocated turtle got to them,
+	// or were lost with the turtle carrying them
+	exportMissing
+	exportCancelled
+)
+
+// Order status, derived from the stages of its items.
+const (
+	exportStatusQueued    = "queued"
+	exportStatusAllocated = "allocated"
+	exportStatusInTransit = "in transit"
+	exportStatusDelivered = "delivered"
+	exportStatusCancelled = "cancelled"
+)
+
+// Export priority, higher priorities are served first. Requests may give
+// the priority as a number or as "urgent", "normal" or "bulk".
+type exportPriority int
+
+const (
+	exportPriorityBulk   = exportPriority(-1)
+	exportPriorityNormal = exportPriority(0)
+	exportPriorityUrgent = exportPriority(1)
+)
+
+func (p *exportPriority) UnmarshalJSON(raw []byte) error {
+	var name string
+	if err := json.Unmarshal(raw, &name); err != nil {
+		var n int
+		if err := json.Unmarshal(raw, &n); err != nil {
+			return fmt.Errorf("invalid export priority: %s", raw)
+		}
+		*p = exportPriority(n)
+		return nil
+	}
+	switch name {
+	case "urgent":
+		*p = exportPriorityUrgent
+	case "normal":
+		*p = exportPriorityNormal
+	case "bulk":
+		*p = exportPriorityBulk
+	default:
+		return fmt.Errorf("invalid export priority: %q", name)
+	}
+	return nil
+}
+
+// Finished orders are kept this long before they are removed.
+const exportOrderRetention = 24 * time.Hour
+
+type exportOrder struct {
+	ID        int
+	Requester string
+	ItemID    itemID `json:"item_id"`
+	Count     int
+	// orders with higher priority are served first
+	Priority exportPriority
+	// maximum number of turtles serving the order at a time, zero for the
+	// area default
+	MaxTurtles int `json:"max_turtles"`
+	Created    string
+	Finished   string
+	Status     string
+	// number of items in each stage
+	Queued    int
+	Allocated int
+	InTransit int `json:"in_transit"`
+	Delivered int
+	Missing   int
+	Cancelled int
+}
+
+func (o *exportOrder) stage(st exportStage) *int {
+	switch st {
+	case exportQueued:
+		return &o.Queued
+	case exportAllocated:
+		return &o.Allocated
+	case exportInTransit:
+		return &o.InTransit
+	case exportDelivered:
+		return &o.Delivered
+	case exportMissing:
+		return &o.Missing
+	default:
+		return &o.Cancelled
+	}
+}
+
+// Updates the status from the stages of the items.
+func (o *exportOrder) updateStatus() {
+	switch {
+	case o.InTransit > 0:
+		o.Status = exportStatusInTransit
+	case o.Allocated > 0:
+		o.Status = exportStatusAllocated
+	case o.Queued > 0:
+		o.Status = exportStatusQueued
+	case o.Delivered > 0:
+		o.Status = exportStatusDelivered
+	default:
+		o.Status = exportStatusCancelled
+	}
+	if o.Queued+o.Allocated+o.InTransit == 0 {
+		if o.Finished == "" {
+			o.Finished = time.Now().UTC().Format(time.RFC3339)
+		}
+	} else {
+		o.Finished = ""
+	}
+}
+
+// Returns the orders of an item in the order they are served.
+func (s storageArea) itemExportOrders(item_id itemID) []*exportOrder {
+	var orders []*exportOrder
+	for _, order := range s.ExportOrders {
+		if order.ItemID == item_id {
+			orders = append(orders, order)
+		}
+	}
+	sort.SliceStable(orders, func(i, j int) bool {
+		if orders[i].Priority != orders[j].Priority {
+			return orders[i].Priority > orders[j].Priority
+		}
+		return orders[i].ID < orders[j].ID
+	})
+	return orders
+}
+
+// Moves up to n items of an item from one stage to another in serving
+// order. Returns the number of items moved.
+func (s *storageArea) moveExportItems(item_id itemID, n int, from exportStage, to exportStage) int {
+	n_moved := 0
+	for _, order := range s.itemExportOrders(item_id) {
+		if n_moved >= n {
+			break
+		}
+		n_from := order.stage(from)
+		n_move := n - n_moved
+		if n_move > *n_from {
+			n_move = *n_from
+		}
+		if n_move <= 0 {
+			continue
+		}
+		*n_from -= n_move
+		*order.stage(to) += n_move
+		order.updateStatus()
+		n_moved += n_move
+	}
+	return n_moved
+}
+
+// Moves up to n items to a stage, taking them from the first of the given
+// stages that has items.
+func (s *storageArea) moveExportItemsFrom(item_id itemID, n int, from []exportStage, to exportStage) {
+	for _, st := range from {
+		n -= s.moveExportItems(item_id, n, st, to)
+	}
+}
+
+// Moves up to n items of an order from one stage to another. Returns the
+// number of items moved.
+func (o *exportOrder) move(n int, from exportStage, to exportStage) int {
+	n_from := o.stage(from)
+	if n > *n_from {
+		n = *n_from
+	}
+	if n <= 0 {
+		return 0
+	}
+	*n_from -= n
+	*o.stage(to) += n
+	o.updateStatus()
+	return n
+}
+
+// Moves up to n items of an item allocated to a turtle to a stage, like
+// moveExportItemsFrom. Items of the order the turtle serves with the item
+// are moved first.
+func (s *storageArea) moveTurtleExportItems(label turtleID, item_id itemID, n int, from []exportStage, to exportStage) {
+	if order := s.getExportOrder(s.ExportAllocOrders[label][item_id]); order != nil && order.ItemID == item_id {
+		for _, st := range from {
+			n -= order.move(n, st, to)
+		}
+	}
+	s.moveExportItemsFrom(item_id, n, from, to)
+}
+
+// Removes the export allocation of an item from a turtle.
+func (s *storageArea) clearExportAlloc(label turtleID, item_id itemID) {
+	delete(s.ExportAllocs[label], item_id)
+	delete(s.ExportAllocOrders[label], item_id)
+	if len(s.ExportAllocs[label]) == 0 {
+		delete(s.ExportAllocs, label)
+		delete(s.ExportAllocOrders, label)
+	}
+}
+
+// Returns true if a turtle has items of an order allocated.
+func (s storageArea) servesOrder(label turtleID, order_id int) bool {
+	for item_id, alloc_id := range s.ExportAllocOrders[label] {
+		if alloc_id == order_id && s.ExportAllocs[label][item_id] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the orders with queued items in the order they are served.
+func (s storageArea) exportQueue() []*exportOrder {
+	var queue []*exportOrder
+	for _, order := range s.ExportOrders {
+		if order.Queued > 0 {
+			queue = append(queue, order)
+		}
+	}
+	sort.SliceStable(queue, func(i, j int) bool {
+		if queue[i].Priority != queue[j].Priority {
+			return queue[i].Priority > queue[j].Priority
+		}
+		return queue[i].ID < queue[j].ID
+	})
+	return queue
+}
+
+// Returns true if a turtle may be allocated queued items of an order.
+func (s storageArea) canServeOrder(order *exportOrder, label turtleID) bool {
+	if order.Queued <= 0 {
+		return false
+	}
+	limit := order.MaxTurtles
+	if limit <= 0 {
+		limit = s.ExportTurtles
+	}
+	n_turtles := 0
+	for alloc_label := range s.ExportAllocOrders {
+		if alloc_label != label && s.servesOrder(alloc_label, order.ID) {
+			n_turtles++
+		}
+	}
+	return n_turtles < limit
+}
+
+// Allocates up to n queued items of an item to a turtle from the first
+// order of the item the turtle may serve. A turtle serves one order per
+// item, more items are allocated from the order it serves already. Returns
+// the number of allocated items.
+func (s *storageArea) allocateExport(label turtleID, item_id itemID, n int) int {
+	served_id := s.ExportAllocOrders[label][item_id]
+	for _, order := range s.itemExportOrders(item_id) {
+		if (served_id != 0 && order.ID != served_id) || !s.canServeOrder(order, label) {
+			continue
+		}
+		if n > s.Exporting[item_id] {
+			n = s.Exporting[item_id]
+		}
+		n = order.move(n, exportQueued, exportAllocated)
+		if n <= 0 {
+			return 0
+		}
+		s.Exporting[item_id] -= n
+		if s.Exporting[item_id] <= 0 {
+			delete(s.Exporting, item_id)
+		}
+		allocs := s.ExportAllocs[label]
+		if allocs == nil {
+			allocs = map[itemID]int{}
+			s.ExportAllocs[label] = allocs
+		}
+		allocs[item_id] += n
+		if s.ExportAllocOrders[label] == nil {
+			s.ExportAllocOrders[label] = map[itemID]int{}
+		}
+		s.ExportAllocOrders[label][item_id] = order.ID
+		return n
+	}
+	return 0
+}
+
+// Creates a new export order of count items. The count is limited to what
+// is in storage and not exported already.
+func (s *storageArea) addExportOrder(er exportRequest) (*exportOrder, error) {
+	if er.MaxTurtles < 0 {
+		return nil, errBadRequest("invalid max_turtles: %v", er.MaxTurtles)
+	}
+	count := er.Count
+	if n_available := s.nAvailable(er.ItemID); count > n_available {
+		count = n_available
+	}
+	if count <= 0 {
+		return nil, errConflict("no %v available to export in %v", er.ItemID, s.ID)
+	}
+	s.pruneExportOrders()
+	s.ExportOrderSeq++
+	order := &exportOrder{
+		ID:         s.ExportOrderSeq,
+		Requester:  er.Requester,
+		ItemID:     er.ItemID,
+		Count:      count,
+		Priority:   er.Priority,
+		MaxTurtles: er.MaxTurtles,
+		Created:    time.Now().UTC().Format(time.RFC3339),
+		Queued:     count,
+	}
+	order.updateStatus()
+	s.ExportOrders = append(s.ExportOrders, order)
+	s.Exporting[er.ItemID] += count
+	s.recordExport(er.ItemID)
+	return order, nil
+}
+
+// Cancels up to count queued items of an order. Items that are already
+// allocated to turtles are exported anyway. Returns the number of
+// cancelled items.
+func (s *storageArea) cancelExportOrder(order *exportOrder, count int) int {
+	if count > order.Queued {
+		count = order.Queued
+	}
+	if count > s.Exporting[order.ItemID] {
+		count = s.Exporting[order.ItemID]
+	}
+	if count <= 0 {
+		return 0
+	}
+	order.Queued -= count
+	order.Cancelled += count
+	order.updateStatus()
+	s.Exporting[order.ItemID] -= count
+	if s.Exporting[order.ItemID] <= 0 {
+		delete(s.Exporting, order.ItemID)
+	}
+	return count
+}
+
+// Cancels up to count queued items of an item in reverse serving order:
+// lowest priority first, then newest first.
+func (s *storageArea) cancelItemExports(item_id itemID, count int) int {
+	orders := s.itemExportOrders(item_id)
+	n_cancelled := 0
+	for i := len(orders) - 1; i >= 0 && n_cancelled < count; i-- {
+		n_cancelled += s.cancelExportOrder(orders[i], count-n_cancelled)
+	}
+	return n_cancelled
+}
+
+func (s storageArea) getExportOrder(id int) *exportOrder {
+	for _, order := range s.ExportOrders {
+		if order.ID == id {
+			return order
+		}
+	}
+	return nil
+}
+
+// Removes finished orders after the retention time.
+func (s *storageArea) pruneExportOrders() {
+	orders := s.ExportOrders[:0]
+	for _, order := range s.ExportOrders {
+		finished, err := time.Parse(time.RFC3339, order.Finished)
+		if err == nil && time.Since(finished) > exportOrderRetention {
+			continue
+		}
+		orders = append(orders, order)
+	}
+	s.ExportOrders = orders
+}
+
+// Export order API.
+//
+//	GET    <root_key>/exports/<area_id>       list orders, optionally filtered
+//	                                          by "status" and "item"
+//	GET    <root_key>/exports/<area_id>/<id>  get order
+//	DELETE <root_key>/exports/<area_id>/<id>  cancel all or "count" queued
+//	                                          items of order
+func handleExportOrders(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, root_key+"/exports/"), "/")
+	if len(parts) > 2 {
+		writeRspNotFound(w)
+		return
+	}
+	area_id := areaID(parts[0])
+	order_id := -1
+	if len(parts) == 2 {
+		id, err := strconv.Atoi(parts[1])
+		if err != nil {
+			writeRspError(w, errBadRequest("invalid export order id: %v", parts[1]))
+			return
+		}
+		order_id = id
+	}
+	q := r.URL.Query()
+	var rsp interface{}
+	err := mgrCall(func() error {
+		s, ok := areas[area_id].(*storageArea)
+		if !ok {
+			return errNotFound("invalid storage area id: %v", area_id)
+		}
+		if order_id < 0 {
+			if r.Method != http.MethodGet {
+				return &reqError{http.StatusMethodNotAllowed, "method not allowed"}
+			}
+			orders := []exportOrder{}
+			for _, order := range s.ExportOrders {
+				if status := q.Get("status"); status != "" && order.Status != status {
+					continue
+				}
+				if item_id := q.Get("item"); item_id != "" && order.ItemID != itemID(item_id) {
+					continue
+				}
+				orders = append(orders, *order)
+			}
+			rsp = orders
+			return nil
+		}
+		order := s.getExportOrder(order_id)
+		if order == nil {
+			return errNotFound("invalid export order id: %v", order_id)
+		}
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodDelete:
+			count := order.Queued
+			if q.Get("count") != "" {
+				n, err := strconv.Atoi(q.Get("count"))
+				if err != nil || n < 0 {
+					return errBadRequest("invalid count: %v", q.Get("count"))
+				}
+				count = n
+			}
+			n_cancelled := s.cancelExportOrder(order, count)
+			log.Printf("export order %v/%v: cancelled %v items\n", area_id, order_id, n_cancelled)
+			if err := s.store(); err != nil {
+				return err
+			}
+		default:
+			return &reqError{http.StatusMethodNotAllowed, "method not allowed"}
+		}
+		rsp = *order
+		return nil
+	})
+	if err != nil {
+		log.Printf("export order request %v %v failed: %v\n", r.Method, r.URL.Path, err)
+		writeRspError(w, err)
+		return
+	}
+	writeRspJSON(w, rsp)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCancelItemExports(t *testing.T) {
+	const item_id = itemID("minecraft:cobblestone/0")
+	s := bootCobbleStorage(t)
+	// Orders in creation order and the number of items cancelled from them
+	// when 25 items are cancelled.
+	tests := []struct {
+		priority       exportPriority
+		want_cancelled int
+	}{
+		{exportPriorityNormal, 5},
+		{exportPriorityUrgent, 0},
+		{exportPriorityNormal, 10},
+		{exportPriorityBulk, 10},
+	}
+	var ids []int
+	for _, test := range tests {
+		order, err := exportItems(exportRequest{ItemID: item_id, Count: 10, AreaID: "storage.0", Priority: test.priority})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, order.ID)
+	}
+	var n_cancelled int
+	err := mgrCall(func() error {
+		n_cancelled = s.cancelItemExports(item_id, 25)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n_cancelled != 25 {
+		t.Errorf("cancelled %v, want 25", n_cancelled)
+	}
+	for i, test := range tests {
+		order := s.getExportOrder(ids[i])
+		if order.Cancelled != test.want_cancelled || order.Queued != 10-test.want_cancelled {
+			t.Errorf("order %v with priority %v: %+v, want %v cancelled", order.ID, test.priority, *order, test.want_cancelled)
+		}
+	}
+	if n := s.Exporting[item_id]; n != 15 {
+		t.Errorf("exporting %v, want 15", n)
+	}
+}
+
+func TestExportPriority(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want exportPriority
+		ok   bool
+	}{
+		{`"urgent"`, exportPriorityUrgent, true},
+		{`"normal"`, exportPriorityNormal, true},
+		{`"bulk"`, exportPriorityBulk, true},
+		{`5`, 5, true},
+		{`"soon"`, 0, false},
+		{`1.5`, 0, false},
+	}
+	for _, test := range tests {
+		var p exportPriority
+		err := json.Unmarshal([]byte(test.raw), &p)
+		if (err == nil) != test.ok || (test.ok && p != test.want) {
+			t.Errorf("priority %v: got %v and error %v, want %v", test.raw, p, err, test.want)
+		}
+	}
+}
+
+func TestExportQueue(t *testing.T) {
+	const item_id = itemID("minecraft:cobblestone/0")
+	s := bootCobbleStorage(t)
+	requests := []exportRequest{
+		{ItemID: item_id, Count: 10, AreaID: "storage.0", Priority: exportPriorityBulk},
+		{ItemID: item_id, Count: 10, AreaID: "storage.0", MaxTurtles: 1},
+		{ItemID: item_id, Count: 10, AreaID: "storage.0", Priority: exportPriorityUrgent},
+		{ItemID: item_id, Count: 10, AreaID: "storage.0"},
+	}
+	var ids []int
+	for _, er := range requests {
+		order, err := exportItems(er)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, order.ID)
+	}
+	if _, err := exportItems(exportRequest{ItemID: item_id, Count: 10, AreaID: "storage.0", MaxTurtles: -1}); err == nil {
+		t.Errorf("export with negative max_turtles succeeded")
+	}
+	err := mgrCall(func() error {
+		var got []int
+		for _, order := range s.exportQueue() {
+			got = append(got, order.ID)
+		}
+		want := []int{ids[2], ids[1], ids[3], ids[0]}
+		if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] || got[3] != want[3] {
+			t.Errorf("queue %v, want %v", got, want)
+		}
+		// The urgent order takes the area default of two turtles, the
+		// next order only one.
+		allocs := []struct {
+			label turtleID
+			want  int
+		}{
+			{"storage.0.1", ids[2]},
+			{"storage.0.2", ids[2]},
+			{"storage.0.3", ids[1]},
+			{"storage.0.4", ids[3]},
+		}
+		for _, a := range allocs {
+			if n := s.allocateExport(a.label, item_id, 5); n != 5 {
+				t.Errorf("%v: allocated %v, want 5", a.label, n)
+			}
+			if id := s.ExportAllocOrders[a.label][item_id]; id != a.want {
+				t.Errorf("%v: serves order %v, want %v", a.label, id, a.want)
+			}
+		}
+		// A turtle serving an order may be allocated more of it.
+		if s.allocateExport("storage.0.3", item_id, 5); s.ExportAllocOrders["storage.0.3"][item_id] != ids[1] {
+			t.Errorf("storage.0.3 serves order %v, want %v", s.ExportAllocOrders["storage.0.3"][item_id], ids[1])
+		}
+		if order := s.getExportOrder(ids[1]); order.Allocated != 10 || order.Queued != 0 {
+			t.Errorf("order %+v, want 10 allocated", *order)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
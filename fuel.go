@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// Default fuel value of items that turtles can refuel with.
+var defaultFuelValues = map[itemID]int{
+	"minecraft:coal/0":        80,   // coal
+	"minecraft:coal/1":        80,   // charcoal
+	"minecraft:coal_block/0":  800,  // block of coal
+	"minecraft:lava_bucket/0": 1000, // lava bucket, leaves an empty bucket
+}
+
+// Fuel policy of an area. Zero values are replaced by defaults on load.
+type fuelPolicy struct {
+	// turtles refuel when their fuel level is at or below threshold
+	Threshold int `json:"threshold"`
+	// fuel level turtles refuel to
+	Target int `json:"target"`
+	// fuel value of items, defaults to the default fuel values
+	Values map[itemID]int `json:"values"`
+	// fuel items turtles may use, defaults to all items with a value
+	Items []itemID `json:"items"`
+	// fuel item stocked in the area fuel box, one of the items
+	BoxItem itemID `json:"box_item"`
+}
+
+func (p *fuelPolicy) init() {
+	if p.Threshold == 0 {
+		p.Threshold = 500
+	}
+	if p.Target == 0 {
+		p.Target = 5000
+	}
+	if len(p.Values) == 0 {
+		p.Values = map[itemID]int{}
+		for item_id, value := range defaultFuelValues {
+			p.Values[item_id] = value
+		}
+	}
+	if len(p.Items) == 0 {
+		for item_id := range p.Values {
+			p.Items = append(p.Items, item_id)
+		}
+		sort.Slice(p.Items, func(i, j int) bool {
+			return p.Items[i] < p.Items[j]
+		})
+	}
+	if p.BoxItem == "" {
+		p.BoxItem = "minecraft:coal/0"
+		if !p.allows(p.BoxItem) && len(p.Items) > 0 {
+			p.BoxItem = p.bestItems()[0]
+		}
+	}
+}
+
+func (p fuelPolicy) validate() error {
+	if p.Threshold < 0 || p.Target <= p.Threshold {
+		return errBadRequest("invalid fuel threshold %v and target %v", p.Threshold, p.Target)
+	}
+	for item_id, value := range p.Values {
+		if value <= 0 {
+			return errBadRequest("invalid fuel value %v of %v", value, item_id)
+		}
+	}
+	for _, item_id := range p.Items {
+		if p.Values[item_id] == 0 {
+			return errBadRequest("unknown fuel item: %v", item_id)
+		}
+	}
+	if !p.allows(p.BoxItem) {
+		return errBadRequest("fuel box item %v is not one of the fuel items %v", p.BoxItem, p.Items)
+	}
+	return nil
+}
+
+// Decodes an edited fuel policy, e.g. {"target": 10000}. Fields that are
+// not given keep their current value.
+func (p *fuelPolicy) edit(raw json.RawMessage) error {
+	edited := *p
+	edited.Items = append([]itemID{}, p.Items...)
+	edited.Values = map[itemID]int{}
+	for item_id, value := range p.Values {
+		edited.Values[item_id] = value
+	}
+	if err := json.Unmarshal(raw, &edited); err != nil {
+		return errBadRequest("invalid fuel: %v", err)
+	}
+	edited.init()
+	if err := edited.validate(); err != nil {
+		return err
+	}
+	*p = edited
+	return nil
+}
+
+// Returns true if turtles may refuel with an item.
+func (p fuelPolicy) allows(item_id itemID) bool {
+	for _, allowed := range p.Items {
+		if allowed == item_id {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the fuel value of the allowed items. Turtles receive it with
+// every report response and only refuel with these items.
+func (p fuelPolicy) itemValues() map[itemID]int {
+	values := map[itemID]int{}
+	for _, item_id := range p.Items {
+		values[item_id] = p.Values[item_id]
+	}
+	return values
+}
+
+// Returns true if the turtle should refuel.
+func (p fuelPolicy) needsRefuel(t turtle) bool {
+	return t.FuelLvl <= p.Threshold
+}
+
+// Returns the allowed fuel items ordered from best to worst.
+func (p fuelPolicy) bestItems() []itemID {
+	items := append([]itemID{}, p.Items...)
+	sort.SliceStable(items, func(i, j int) bool {
+		return p.Values[items[i]] > p.Values[items[j]]
+	})
+	return items
+}
+
+// Returns the number of items needed to refuel from the current fuel
+// level to the target.
+func (p fuelPolicy) nItemsNeeded(item_id itemID, fuel_needed int) int {
+	fuel_per_item := p.Values[item_id]
+	if fuel_per_item <= 0 || fuel_needed <= 0 {
+		return 0
+	}
+	return (fuel_needed + fuel_per_item - 1) / fuel_per_item
+}
+
+// Decision on how a turtle should refuel.
+type fuelPlan struct {
+	// fuel item to burn from the inventory and the amount, zero if none
+	burnItem itemID
+	nBurn    int
+	// fuel missing in the inventory to reach the target
+	fuelMissing int
+}
+
+// Plans refueling with the fuel in the turtle inventory. The best fuel is
+// burnt first. When the inventory does not hold enough fuel to reach the
+// target, the missing fuel should be fetched first.
+func (p fuelPolicy) plan(t turtle) fuelPlan {
+	fuel_needed := p.Target - t.FuelLvl
+	var plan fuelPlan
+	fuel_has := 0
+	for _, item_id := range p.bestItems() {
+		n_has := t.InvCount.Grouped[item_id]
+		if n_has <= 0 {
+			continue
+		}
+		fuel_has += n_has * p.Values[item_id]
+		if plan.nBurn == 0 {
+			plan.burnItem = item_id
+			plan.nBurn = p.nItemsNeeded(item_id, fuel_needed)
+			if plan.nBurn > n_has {
+				plan.nBurn = n_has
+			}
+		}
+	}
+	if fuel_has < fuel_needed {
+		plan.fuelMissing = fuel_needed - fuel_has
+	}
+	return plan
+}
+
+// Decides refueling for a turtle. The box item is the fuel available in the
+// area fuel box, empty if none is available. Returns a refuel job when the
+// inventory fuel should be burnt, or the amount of the box item to fetch
+// when fuel should be fetched first. Returns a nil job and zero amount
+// when the turtle does not refuel.
+func (p fuelPolicy) decide(t turtle, box_item itemID) (*job, int) {
+	if !p.needsRefuel(t) {
+		return nil, 0
+	}
+	plan := p.plan(t)
+	if plan.fuelMissing > 0 && box_item != "" && t.InvCount.FreeSlots > 0 {
+		// Fetch missing fuel before burning.
+		return nil, p.nItemsNeeded(box_item, plan.fuelMissing)
+	}
+	if plan.nBurn > 0 {
+		return makeJobRefuel(workIDTmp, plan.burnItem, plan.nBurn), 0
+	}
+	// Out of fuel and nothing to fetch.
+	return nil, 0
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/yuin/gopher-lua"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFuelPolicyEdit(t *testing.T) {
+	tests := []struct {
+		edit        string
+		want_err    string
+		want_box    itemID
+		want_values map[itemID]int
+	}{
+		{`{}`, "", "minecraft:coal/0", defaultFuelValues},
+		{`{"items": ["minecraft:coal/1"], "box_item": ""}`, "", "minecraft:coal/1", map[itemID]int{"minecraft:coal/1": 80}},
+		{`{"items": ["minecraft:coal/1"]}`, "not one of the fuel items", "", nil},
+		{`{"items": ["minecraft:stick/0"]}`, "unknown fuel item", "", nil},
+		{`{"values": {"minecraft:stick/0": -1}}`, "invalid fuel value", "", nil},
+		{`{"values": {"Forestry:peat/0": 2000}, "items": ["Forestry:peat/0", "minecraft:coal/0"]}`, "", "minecraft:coal/0",
+			map[itemID]int{"Forestry:peat/0": 2000, "minecraft:coal/0": 80}},
+		{`{"target": 100, "threshold": 200}`, "invalid fuel threshold", "", nil},
+	}
+	for _, test := range tests {
+		var p fuelPolicy
+		p.init()
+		err := p.edit(json.RawMessage(test.edit))
+		if test.want_err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.want_err) {
+				t.Errorf("%v: got error %v, want %q", test.edit, err, test.want_err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", test.edit, err)
+			continue
+		}
+		if p.BoxItem != test.want_box {
+			t.Errorf("%v: box item %v, want %v", test.edit, p.BoxItem, test.want_box)
+		}
+		if values := p.itemValues(); !reflect.DeepEqual(values, test.want_values) {
+			t.Errorf("%v: fuel items %v, want %v", test.edit, values, test.want_values)
+		}
+	}
+}
+
+func TestFuelDecide(t *testing.T) {
+	p := fuelPolicy{Items: []itemID{"minecraft:coal/0", "minecraft:coal_block/0"}}
+	p.init()
+	tests := []struct {
+		name      string
+		fuel      int
+		inv       map[itemID]int
+		box_item  itemID
+		want_burn map[itemID]int
+		want_n    int
+	}{
+		{"full", 600, map[itemID]int{}, "minecraft:coal/0", nil, 0},
+		{"fetch", 100, map[itemID]int{}, "minecraft:coal/0", nil, 62},
+		{"burn best", 100, map[itemID]int{"minecraft:coal/0": 64, "minecraft:coal_block/0": 10}, "minecraft:coal/0",
+			map[itemID]int{"minecraft:coal_block/0": 7}, 0},
+		// Fuel that is not allowed in the area is not burnt.
+		{"not allowed", 100, map[itemID]int{"minecraft:lava_bucket/0": 5}, "", nil, 0},
+		{"fetch missing", 400, map[itemID]int{"minecraft:coal/0": 5}, "minecraft:coal/0", nil, 53},
+	}
+	for _, test := range tests {
+		tt := turtle{FuelLvl: test.fuel, InvCount: icount{FreeSlots: 10, Grouped: test.inv}}
+		j, n := p.decide(tt, test.box_item)
+		var burn map[itemID]int
+		if j != nil {
+			refuel := j.Instr.(*jobRefuel)
+			burn = map[itemID]int{refuel.Item: refuel.Count}
+		}
+		if !reflect.DeepEqual(burn, test.want_burn) || n != test.want_n {
+			t.Errorf("%v: burn %v fetch %v, want burn %v fetch %v", test.name, burn, n, test.want_burn, test.want_n)
+		}
+	}
+}
+
+func TestReportFuelItems(t *testing.T) {
+	simBootAreas(t, map[areaID]string{
+		"mine.0": `{"ID": "mine.0", "Pos": [70, 100, 822], "Depth": 4, "fuel": {"items": ["minecraft:coal/1"]}}`,
+	})
+	rsp, err := processReport([]byte(`{"Label": "mine.0.1", "cur_pos": [70, 100, 822], "cur_rot": [0, 0, 1],
+		"fuel_lvl": 5000, "inv_count": {"free_slots": 16, "Grouped": {}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Turtles receive the fuel items of their area.
+	if !strings.Contains(rsp, `fuel_items = {["minecraft:coal/1"] = 80,}`) {
+		t.Errorf("response without area fuel items: %v", rsp)
+	}
+}
+
+func TestKernelFuelItemsEqual(t *testing.T) {
+	kern := lua.NewState()
+	defer kern.Close()
+	for _, src := range []string{"is_server = true", lua_src_json} {
+		if err := kern.DoString(src); err != nil {
+			t.Fatal(err)
+		}
+	}
+	kern.SetGlobal("JSON", kern.Get(-1))
+	if err := kern.DoString(lua_src_kernel); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		// The order of the items does not matter.
+		{`{["minecraft:coal/0"] = 80, ["minecraft:coal/1"] = 80}`, `{["minecraft:coal/1"] = 80, ["minecraft:coal/0"] = 80}`, true},
+		{`{["minecraft:coal/0"] = 80}`, `{["minecraft:coal/0"] = 80, ["minecraft:coal/1"] = 80}`, false},
+		{`{["minecraft:coal/0"] = 80, ["minecraft:coal/1"] = 80}`, `{["minecraft:coal/0"] = 80}`, false},
+		{`{["minecraft:coal/0"] = 80}`, `{["minecraft:coal/0"] = 1600}`, false},
+		{`{}`, `{}`, true},
+	}
+	for _, test := range tests {
+		if err := kern.DoString("result = map_equal(" + test.a + ", " + test.b + ")"); err != nil {
+			t.Fatal(err)
+		}
+		if got := lua.LVAsBool(kern.GetGlobal("result")); got != test.want {
+			t.Errorf("map_equal(%v, %v): got %v, want %v", test.a, test.b, got, test.want)
+		}
+	}
+}
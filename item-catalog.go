@@ -0,0 +1,70 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path"
+)
+
+// Catalog of item properties, stored in "items.catalog" in the state
+// directory. Turtles report the max stack size of the items in their
+// inventory, so the catalog learns every item that passes through a turtle.
+// Entries can also be added by hand while the server is stopped.
+
+type itemCatalogEntry struct {
+	// maximum number of items in one inventory slot
+	MaxStack int `json:"max_stack"`
+}
+
+// Max stack size of items that are not in the catalog.
+const defaultMaxStack = 64
+
+// Only accessed by the work manager after the catalog has been loaded.
+var item_catalog = map[itemID]*itemCatalogEntry{}
+
+var item_catalog_path string
+
+func loadItemCatalog(state_dir string) error {
+	item_catalog_path = path.Join(state_dir, "items.catalog")
+	if _, err := os.Stat(item_catalog_path); err == nil {
+		if err := loadJSON(item_catalog_path, &item_catalog); err != nil {
+			return err
+		}
+	}
+	for item_id, entry := range item_catalog {
+		if entry == nil || entry.MaxStack <= 0 {
+			log.Printf("item catalog: ignoring invalid entry for %v", item_id)
+			delete(item_catalog, item_id)
+		}
+	}
+	log.Printf("loaded %v items from catalog\n", len(item_catalog))
+	return nil
+}
+
+// Returns the max stack size of an item.
+func itemMaxStack(item_id itemID) int {
+	if entry := item_catalog[item_id]; entry != nil {
+		return entry.MaxStack
+	}
+	return defaultMaxStack
+}
+
+// Records the max stack sizes reported by a turtle and stores the catalog
+// if it changed.
+func mgrLearnItemStacks(t turtle) error {
+	changed := false
+	for item_id, max_stack := range t.InvCount.MaxStack {
+		if max_stack <= 0 {
+			continue
+		}
+		if entry := item_catalog[item_id]; entry == nil || entry.MaxStack != max_stack {
+			log.Printf("item catalog: %v stacks to %v", item_id, max_stack)
+			item_catalog[item_id] = &itemCatalogEntry{MaxStack: max_stack}
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return storeJSON(item_catalog_path, item_catalog)
+}
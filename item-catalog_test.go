@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestItemCatalog(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(path.Join(dir, "items.catalog"), []byte(`{
+		"minecraft:ender_pearl/0": {"max_stack": 16},
+		"minecraft:stick/0": {"max_stack": 0}
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { item_catalog = map[itemID]*itemCatalogEntry{} }()
+	item_catalog = map[itemID]*itemCatalogEntry{}
+	if err := loadItemCatalog(dir); err != nil {
+		t.Fatal(err)
+	}
+	tur := turtle{Label: "storage.0.1", InvCount: icount{MaxStack: map[itemID]int{"minecraft:bucket/0": 1}}}
+	if err := mgrLearnItemStacks(tur); err != nil {
+		t.Fatal(err)
+	}
+	// The learned entry is stored.
+	item_catalog = map[itemID]*itemCatalogEntry{}
+	if err := loadItemCatalog(dir); err != nil {
+		t.Fatal(err)
+	}
+	s := storageArea{BoxSlots: 27}
+	want := map[itemID]int{
+		"minecraft:ender_pearl/0": 27 * 16,
+		"minecraft:bucket/0":      27,
+		// invalid entries are ignored
+		"minecraft:stick/0": 27 * defaultMaxStack,
+		"minecraft:dirt/0":  27 * defaultMaxStack,
+	}
+	for item_id, n := range want {
+		if got := s.boxCapacity(item_id); got != n {
+			t.Errorf("capacity of a box of %v: got %v, want %v", item_id, got, n)
+		}
+	}
+}
@@ -1,141 +1,254 @@
 package main
 
-import(
-    "fmt"
-    "strings"
-    "strconv"
+import (
+	"context"
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"sort"
+	"strings"
+	"time"
 )
 
-func luaSerialVec3(v vec3) string {
-    return fmt.Sprintf("{%d, %d, %d}", v[0], v[1], v[2])
+// A job is a unit of work assigned to a turtle. Jobs are built as data by
+// the areas and serialized to lua table literals that the kernel
+// unserializes, see job.luaSrc().
+type job struct {
+	ID    workID
+	Instr jobInstr
 }
 
-func luaSerialVec3Arr(vecs []vec3, invert bool) string {
-    parts := make([]string, len(vecs))
-    for i, vec := range(vecs) {
-        dst := i
-        if invert {
-            dst = len(vecs) - i - 1
-        }
-        parts[dst] = luaSerialVec3(vec) + ","
-    }
-    return strings.Join(parts, "")
-}
-
-var tplJobIdle = `new_job = {
-    id = %d,
-    type = "idle",
-    instructions = {
-        time = %d,
-    },
-},
-`
-
-func makeJobIdle(id workID, seconds int) string {
-    return fmt.Sprintf(tplJobIdle, id, seconds)
-}
-
-var tplJobGo = `new_job = {
-    id = %d,
-    type = "go",
-    instructions = {
-        waypoint_stack = {%s},
-    },
-},
-`
-
-func makeJobGo(id workID, waypoints []vec3) string {
-    wp_srl := luaSerialVec3Arr(waypoints, true)
-    return fmt.Sprintf(tplJobGo, id, wp_srl)
-}
-
-var tplJobSuck = `new_job = {
-    id = %d,
-    type = "suck",
-    instructions = {
-        item_id = %s,
-        amount = %d,
-        dir = %s,
-    },
-},
-`
-
-func makeJobSuck(id workID, item_id *itemID, amount int, dir vec3) string {
-    item_srl := "nil"
-    if item_id != nil {
-        item_srl = strconv.Quote(string(*item_id))
-    }
-    dir_srl := luaSerialVec3(dir)
-    return fmt.Sprintf(tplJobSuck, id, item_srl, amount, dir_srl)
-}
-
-var tplJobDrop = `new_job = {
-    id = %d,
-    type = "drop",
-    instructions = {
-        items = {%s},
-        dir = %s,
-    },
-},
-`
-
-func makeJobDrop(id workID, items map[itemID]int, dir vec3) string {
-    items_parts := make([]string, len(items))
-    i := 0
-    for item_id, count := range(items) {
-        items_parts[i] = fmt.Sprintf("[%s] = %d,", strconv.Quote(string(item_id)), count)
-        i++
-    }
-    items_srl := strings.Join(items_parts, "")
-    dir_srl := luaSerialVec3(dir)
-    return fmt.Sprintf(tplJobDrop, id, items_srl, dir_srl)
-}
-
-var tplJobRefuel = `new_job = {
-    id = %d,
-    type = "refuel",
-    instructions = {
-        item = %s,
-        count = %d
-    },
-},`
-
-func makeJobRefuel(id workID, item_id itemID, count int) string {
-    item_srl := strconv.Quote(string(item_id))
-    return fmt.Sprintf(tplJobRefuel, id, item_srl, count)
-}
-
-var tplJobQueue = `new_job = {
-    id = %d,
-    type = "queue",
-    instructions = {
-        origin = %s,
-        q_dir = %s,
-        o_q0_dir = %s,
-        q0_t0_dir = %s,
-    },
-},
-`
-
-func makeJobQueue(id workID, origin, q_dir, o_q0_dir, q0_t0_dir vec3) string {
-    return fmt.Sprintf(tplJobQueue, id,
-        luaSerialVec3(origin),
-        luaSerialVec3(q_dir),
-        luaSerialVec3(o_q0_dir),
-        luaSerialVec3(q0_t0_dir),
-    )
-}
-
-var tplJobMine = `new_job = {
-    id = %d,
-    type = "mine",
-    instructions = {
-        waypoint_stack = {%s},
-        extra_dirs = {%s},
-        dynamic = %t,
-        clear = %t,
-    },
-},`
+// Job type specific instructions.
+type jobInstr interface {
+	// Returns the job type as understood by the kernel.
+	jobType() string
+	// Returns the instruction fields in serialization order. The field
+	// values are pointers into the instructions so the same description can
+	// be used for both serializing and parsing.
+	luaFields() []luaField
+	// Returns an error if the instructions would be rejected or misbehave
+	// in the kernel.
+	validate() error
+}
+
+type luaField struct {
+	key   string
+	value interface{}
+}
+
+// Map from job type to instruction constructor, used when parsing jobs.
+var jobTypes = map[string]func() jobInstr{
+	"idle":      func() jobInstr { return new(jobIdle) },
+	"go":        func() jobInstr { return new(jobGo) },
+	"suck":      func() jobInstr { return new(jobSuck) },
+	"drop":      func() jobInstr { return new(jobDrop) },
+	"refuel":    func() jobInstr { return new(jobRefuel) },
+	"queue":     func() jobInstr { return new(jobQueue) },
+	"mine":      func() jobInstr { return new(jobMine) },
+	"construct": func() jobInstr { return new(jobConstruct) },
+	"farm":      func() jobInstr { return new(jobFarm) },
+	"audit":     func() jobInstr { return new(jobAudit) },
+}
+
+// Waypoints in travel order. They are serialized in reverse order since the
+// kernel pops the next waypoint from the end of the stack.
+type waypointStack []vec3
+
+type jobIdle struct {
+	Time int
+}
+
+func (_ *jobIdle) jobType() string {
+	return "idle"
+}
+
+func (j *jobIdle) luaFields() []luaField {
+	return []luaField{{"time", &j.Time}}
+}
+
+func (j *jobIdle) validate() error {
+	if j.Time < 0 {
+		return fmt.Errorf("negative idle time %v", j.Time)
+	}
+	return nil
+}
+
+func makeJobIdle(id workID, seconds int) *job {
+	return &job{id, &jobIdle{Time: seconds}}
+}
+
+type jobGo struct {
+	Waypoints waypointStack
+}
+
+func (_ *jobGo) jobType() string {
+	return "go"
+}
+
+func (j *jobGo) luaFields() []luaField {
+	return []luaField{{"waypoint_stack", &j.Waypoints}}
+}
+
+func (j *jobGo) validate() error {
+	return nil
+}
+
+func makeJobGo(id workID, waypoints []vec3) *job {
+	return &job{id, &jobGo{Waypoints: waypoints}}
+}
+
+type jobSuck struct {
+	// nil = suck any item
+	ItemID *itemID
+	// ignored when sucking any item
+	Amount int
+	Dir    vec3
+}
+
+func (_ *jobSuck) jobType() string {
+	return "suck"
+}
+
+func (j *jobSuck) luaFields() []luaField {
+	return []luaField{
+		{"item_id", &j.ItemID},
+		{"amount", &j.Amount},
+		{"dir", &j.Dir},
+	}
+}
+
+func (j *jobSuck) validate() error {
+	if j.Amount < 0 {
+		return fmt.Errorf("negative suck amount %v", j.Amount)
+	}
+	return validateDir(j.Dir)
+}
+
+func makeJobSuck(id workID, item_id *itemID, amount int, dir vec3) *job {
+	return &job{id, &jobSuck{ItemID: item_id, Amount: amount, Dir: dir}}
+}
+
+type jobDrop struct {
+	Items map[itemID]int
+	Dir   vec3
+}
+
+func (_ *jobDrop) jobType() string {
+	return "drop"
+}
+
+func (j *jobDrop) luaFields() []luaField {
+	return []luaField{
+		{"items", &j.Items},
+		{"dir", &j.Dir},
+	}
+}
+
+func (j *jobDrop) validate() error {
+	for item_id, count := range j.Items {
+		if count < 0 {
+			return fmt.Errorf("negative drop count %v of %v", count, item_id)
+		}
+	}
+	return validateDir(j.Dir)
+}
+
+func makeJobDrop(id workID, items map[itemID]int, dir vec3) *job {
+	return &job{id, &jobDrop{Items: items, Dir: dir}}
+}
+
+type jobRefuel struct {
+	Item  itemID
+	Count int
+}
+
+func (_ *jobRefuel) jobType() string {
+	return "refuel"
+}
+
+func (j *jobRefuel) luaFields() []luaField {
+	return []luaField{
+		{"item", &j.Item},
+		{"count", &j.Count},
+	}
+}
+
+func (j *jobRefuel) validate() error {
+	if j.Count < 0 {
+		return fmt.Errorf("negative refuel count %v", j.Count)
+	}
+	return nil
+}
+
+func makeJobRefuel(id workID, item_id itemID, count int) *job {
+	return &job{id, &jobRefuel{Item: item_id, Count: count}}
+}
+
+type jobQueue struct {
+	Origin  vec3
+	QDir    vec3
+	OQ0Dir  vec3
+	Q0T0Dir vec3
+}
+
+func (_ *jobQueue) jobType() string {
+	return "queue"
+}
+
+func (j *jobQueue) luaFields() []luaField {
+	return []luaField{
+		{"origin", &j.Origin},
+		{"q_dir", &j.QDir},
+		{"o_q0_dir", &j.OQ0Dir},
+		{"q0_t0_dir", &j.Q0T0Dir},
+	}
+}
+
+func (j *jobQueue) validate() error {
+	for _, dir := range []vec3{j.QDir, j.OQ0Dir, j.Q0T0Dir} {
+		if err := validateDir(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func makeJobQueue(id workID, origin, q_dir, o_q0_dir, q0_t0_dir vec3) *job {
+	return &job{id, &jobQueue{
+		Origin:  origin,
+		QDir:    q_dir,
+		OQ0Dir:  o_q0_dir,
+		Q0T0Dir: q0_t0_dir,
+	}}
+}
+
+type jobMine struct {
+	Waypoints waypointStack
+	ExtraDirs []vec3
+	Dynamic   bool
+	Clear     bool
+}
+
+func (_ *jobMine) jobType() string {
+	return "mine"
+}
+
+func (j *jobMine) luaFields() []luaField {
+	return []luaField{
+		{"waypoint_stack", &j.Waypoints},
+		{"extra_dirs", &j.ExtraDirs},
+		{"dynamic", &j.Dynamic},
+		{"clear", &j.Clear},
+	}
+}
+
+func (j *jobMine) validate() error {
+	for _, dir := range j.ExtraDirs {
+		if err := validateDir(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
 // Creates a mine job.
 // A static mine job means just drill forward to the next waypoint.
@@ -143,55 +256,429 @@ var tplJobMine = `new_job = {
 // after each step taken.
 // A dynamic mine job means to also look around for intresting blocks that will
 // be selectively mined.
-func makeJobMine(id workID, waypoints []vec3, extra_dirs []vec3, dynamic bool, clear bool) string {
-    wp_srl := luaSerialVec3Arr(waypoints, true)
-    extra_dirs_srl := luaSerialVec3Arr(extra_dirs, false)
-    return fmt.Sprintf(tplJobMine, id, wp_srl, extra_dirs_srl, dynamic, clear)
-}
-
-var tplJobConstruct = `new_job = {
-    id = %d,
-    type = "construct",
-    instructions = {
-        item = %s,
-        waypoint_stack = {%s},
-        dir = %s,
-    },
-},`
+func makeJobMine(id workID, waypoints []vec3, extra_dirs []vec3, dynamic bool, clear bool) *job {
+	return &job{id, &jobMine{
+		Waypoints: waypoints,
+		ExtraDirs: extra_dirs,
+		Dynamic:   dynamic,
+		Clear:     clear,
+	}}
+}
+
+type jobConstruct struct {
+	Item      itemID
+	Waypoints waypointStack
+	Dir       vec3
+}
+
+func (_ *jobConstruct) jobType() string {
+	return "construct"
+}
+
+func (j *jobConstruct) luaFields() []luaField {
+	return []luaField{
+		{"item", &j.Item},
+		{"waypoint_stack", &j.Waypoints},
+		{"dir", &j.Dir},
+	}
+}
+
+func (j *jobConstruct) validate() error {
+	return validateDir(j.Dir)
+}
 
 // Creates a construct job.
 // Before starting and after each step taken the specified item will be placed
 // in the specified direction while walking towards dir.
-func makeJobConstruct(id workID, item_id itemID, waypoints []vec3, dir vec3) string {
-    item_srl := strconv.Quote(string(item_id))
-    wp_srl := luaSerialVec3Arr(waypoints, true)
-    dir_srl := luaSerialVec3(dir)
-    return fmt.Sprintf(tplJobConstruct, id, item_srl, wp_srl, dir_srl)
-}
-
-var tplJobFarm = `new_job = {
-    id = %d,
-    type = "farm",
-    instructions = {
-        waypoint_stack = {%s},
-        items = {%s},
-        mod_dim = %d,
-    },
-},`
+func makeJobConstruct(id workID, item_id itemID, waypoints []vec3, dir vec3) *job {
+	return &job{id, &jobConstruct{Item: item_id, Waypoints: waypoints, Dir: dir}}
+}
+
+type jobFarm struct {
+	Waypoints waypointStack
+	Items     []itemID
+	ModDim    int
+}
+
+func (_ *jobFarm) jobType() string {
+	return "farm"
+}
+
+func (j *jobFarm) luaFields() []luaField {
+	return []luaField{
+		{"waypoint_stack", &j.Waypoints},
+		{"items", &j.Items},
+		{"mod_dim", &j.ModDim},
+	}
+}
+
+func (j *jobFarm) validate() error {
+	if len(j.Items) == 0 {
+		return fmt.Errorf("farm job without items")
+	}
+	if j.ModDim < 1 || j.ModDim > 3 {
+		return fmt.Errorf("invalid farm mod dim %v", j.ModDim)
+	}
+	return nil
+}
 
 // Creates a farm job.
 // Before starting and after each step taken the block below the turtle will
 // be harvested (if required) and one of the specified crop seeds will be
 // planeted. The crop seed is determined by the modulus position of the turtle
 // in the specified dimension (1 = x, 2 = y, 3 = z).
-func makeJobFarm(id workID, waypoints []vec3, items []itemID, mod_dim int) string {
-    wp_srl := luaSerialVec3Arr(waypoints, true)
-    items_parts := make([]string, len(items))
-    i := 0
-    for _, item_id := range(items) {
-        items_parts[i] = fmt.Sprintf("%s,", strconv.Quote(string(item_id)))
-        i++
-    }
-    items_srl := strings.Join(items_parts, "")
-    return fmt.Sprintf(tplJobFarm, id, wp_srl, items_srl, mod_dim)
+func makeJobFarm(id workID, waypoints []vec3, items []itemID, mod_dim int) *job {
+	return &job{id, &jobFarm{Waypoints: waypoints, Items: items, ModDim: mod_dim}}
+}
+
+type jobAudit struct {
+	Dir vec3
+}
+
+func (_ *jobAudit) jobType() string {
+	return "audit"
+}
+
+func (j *jobAudit) luaFields() []luaField {
+	return []luaField{{"dir", &j.Dir}}
+}
+
+func (j *jobAudit) validate() error {
+	return validateDir(j.Dir)
+}
+
+// Creates an audit job. The turtle lists the items in the container in the
+// direction and reports them in the audit result of the completed work.
+func makeJobAudit(id workID, dir vec3) *job {
+	return &job{id, &jobAudit{Dir: dir}}
+}
+
+// Returns an error if dir is not an orthogonal unit vector.
+func validateDir(dir vec3) error {
+	if vec3L1Dist(dir, vec3{}) != 1 {
+		return fmt.Errorf("direction %v is not an orthogonal unit vector", dir)
+	}
+	return nil
+}
+
+func (j job) validate() error {
+	if j.Instr == nil {
+		return fmt.Errorf("job %v has no instructions", j.ID)
+	}
+	if err := j.Instr.validate(); err != nil {
+		return fmt.Errorf("invalid %v job %v: %v", j.Instr.jobType(), j.ID, err)
+	}
+	return nil
+}
+
+// Serializes the job to a lua table literal.
+func (j job) luaTable() (string, error) {
+	fields := []luaField{
+		{"id", &j.ID},
+		{"type", j.Instr.jobType()},
+		{"instructions", j.Instr.luaFields()},
+	}
+	return luaSerial(fields, "")
+}
+
+// Serializes the job to a new job assignment in a report response table.
+func (j job) luaSrc() (string, error) {
+	tbl, err := j.luaTable()
+	if err != nil {
+		return "", err
+	}
+	return "new_job = " + tbl + ",\n", nil
+}
+
+// Quotes a string as a lua string literal. Unlike strconv.Quote it only
+// uses escapes that lua 5.1 understands.
+func luaQuote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&b, "\\%03d", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func luaSerialVec3(v vec3) string {
+	return fmt.Sprintf("{%d, %d, %d}", v[0], v[1], v[2])
+}
+
+func luaSerialVec3Arr(vecs []vec3, invert bool) string {
+	parts := make([]string, len(vecs))
+	for i, vec := range vecs {
+		dst := i
+		if invert {
+			dst = len(vecs) - i - 1
+		}
+		parts[dst] = luaSerialVec3(vec) + ","
+	}
+	return "{" + strings.Join(parts, "") + "}"
+}
+
+// Serializes a value to a lua literal. Nested field lists are serialized
+// as tables with one field per line. Returns an error if the value has a
+// type that cannot be serialized.
+func luaSerial(v interface{}, indent string) (string, error) {
+	switch v := v.(type) {
+	case []luaField:
+		var b strings.Builder
+		b.WriteString("{\n")
+		for _, field := range v {
+			value, err := luaSerial(field.value, indent+"    ")
+			if err != nil {
+				return "", fmt.Errorf("%v: %v", field.key, err)
+			}
+			b.WriteString(indent + "    " + field.key + " = ")
+			b.WriteString(value)
+			b.WriteString(",\n")
+		}
+		b.WriteString(indent + "}")
+		return b.String(), nil
+	case string:
+		return luaQuote(v), nil
+	case *int:
+		return itoa(*v), nil
+	case *workID:
+		return itoa(int(*v)), nil
+	case *bool:
+		return fmt.Sprintf("%t", *v), nil
+	case *itemID:
+		return luaQuote(string(*v)), nil
+	case **itemID:
+		if *v == nil {
+			return "nil", nil
+		}
+		return luaQuote(string(**v)), nil
+	case *vec3:
+		return luaSerialVec3(*v), nil
+	case *[]vec3:
+		return luaSerialVec3Arr(*v, false), nil
+	case *waypointStack:
+		return luaSerialVec3Arr(*v, true), nil
+	case *[]itemID:
+		parts := make([]string, len(*v))
+		for i, item_id := range *v {
+			parts[i] = luaQuote(string(item_id)) + ","
+		}
+		return "{" + strings.Join(parts, "") + "}", nil
+	case *map[itemID]int:
+		// Sort items to make serialization deterministic.
+		item_ids := make([]string, 0, len(*v))
+		for item_id := range *v {
+			item_ids = append(item_ids, string(item_id))
+		}
+		sort.Strings(item_ids)
+		parts := make([]string, len(item_ids))
+		for i, item_id := range item_ids {
+			parts[i] = fmt.Sprintf("[%s] = %d,", luaQuote(item_id), (*v)[itemID(item_id)])
+		}
+		return "{" + strings.Join(parts, "") + "}", nil
+	default:
+		return "", fmt.Errorf("cannot serialize %T to lua", v)
+	}
+}
+
+// Parses a job from a lua table literal, e.g. a job serialized by
+// job.luaTable() or the cur_work state stored by the kernel.
+func parseJob(src string) (*job, error) {
+	return parseJobExpr(src, "")
+}
+
+// Parses the new job of a report response table.
+func parseJobResponse(rsp string) (*job, error) {
+	return parseJobExpr(rsp, "new_job")
+}
+
+// Evaluates src as a lua expression without any libraries and parses the
+// job in field key of the result, or the result itself if key is empty.
+func parseJobExpr(src string, key string) (*job, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	defer L.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	L.SetContext(ctx)
+	err := L.DoString("return " + src)
+	if err != nil {
+		return nil, fmt.Errorf("evaluating job failed: %v", err)
+	}
+	tbl, ok := L.Get(-1).(*lua.LTable)
+	if !ok {
+		return nil, fmt.Errorf("job is not a table")
+	}
+	if key != "" {
+		tbl, ok = tbl.RawGetString(key).(*lua.LTable)
+		if !ok {
+			return nil, fmt.Errorf("%v is not a table", key)
+		}
+	}
+	return decodeJob(tbl)
+}
+
+func decodeJob(tbl *lua.LTable) (*job, error) {
+	j := new(job)
+	if err := luaDecode(tbl.RawGetString("id"), &j.ID); err != nil {
+		return nil, fmt.Errorf("id: %v", err)
+	}
+	job_type, ok := tbl.RawGetString("type").(lua.LString)
+	if !ok {
+		return nil, fmt.Errorf("type is not a string")
+	}
+	new_fn := jobTypes[string(job_type)]
+	if new_fn == nil {
+		return nil, fmt.Errorf("unknown job type: %v", job_type)
+	}
+	j.Instr = new_fn()
+	instr, ok := tbl.RawGetString("instructions").(*lua.LTable)
+	if !ok {
+		return nil, fmt.Errorf("instructions is not a table")
+	}
+	for _, field := range j.Instr.luaFields() {
+		if err := luaDecode(instr.RawGetString(field.key), field.value); err != nil {
+			return nil, fmt.Errorf("%v: %v", field.key, err)
+		}
+	}
+	if err := j.validate(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func luaDecodeInt(lv lua.LValue) (int, error) {
+	n, ok := lv.(lua.LNumber)
+	if !ok || float64(n) != float64(int(n)) {
+		return 0, fmt.Errorf("expected integer, got %v", lv)
+	}
+	return int(n), nil
+}
+
+func luaDecodeVec3(lv lua.LValue) (vec3, error) {
+	var v vec3
+	tbl, ok := lv.(*lua.LTable)
+	if !ok || tbl.Len() != len(v) {
+		return v, fmt.Errorf("expected vector, got %v", lv)
+	}
+	for i := range v {
+		n, err := luaDecodeInt(tbl.RawGetInt(i + 1))
+		if err != nil {
+			return v, err
+		}
+		v[i] = n
+	}
+	return v, nil
+}
+
+func luaDecodeVec3Arr(lv lua.LValue) ([]vec3, error) {
+	tbl, ok := lv.(*lua.LTable)
+	if !ok {
+		return nil, fmt.Errorf("expected vector array, got %v", lv)
+	}
+	vecs := make([]vec3, tbl.Len())
+	for i := range vecs {
+		v, err := luaDecodeVec3(tbl.RawGetInt(i + 1))
+		if err != nil {
+			return nil, err
+		}
+		vecs[i] = v
+	}
+	return vecs, nil
+}
+
+// Decodes a lua value into a field value pointer, see luaSerial().
+func luaDecode(lv lua.LValue, dst interface{}) error {
+	switch dst := dst.(type) {
+	case *int:
+		n, err := luaDecodeInt(lv)
+		*dst = n
+		return err
+	case *workID:
+		n, err := luaDecodeInt(lv)
+		*dst = workID(n)
+		return err
+	case *bool:
+		b, ok := lv.(lua.LBool)
+		if !ok {
+			return fmt.Errorf("expected boolean, got %v", lv)
+		}
+		*dst = bool(b)
+	case *itemID:
+		s, ok := lv.(lua.LString)
+		if !ok {
+			return fmt.Errorf("expected string, got %v", lv)
+		}
+		*dst = itemID(s)
+	case **itemID:
+		if lv == lua.LNil {
+			*dst = nil
+			return nil
+		}
+		s, ok := lv.(lua.LString)
+		if !ok {
+			return fmt.Errorf("expected string or nil, got %v", lv)
+		}
+		item_id := itemID(s)
+		*dst = &item_id
+	case *vec3:
+		v, err := luaDecodeVec3(lv)
+		*dst = v
+		return err
+	case *[]vec3:
+		vecs, err := luaDecodeVec3Arr(lv)
+		*dst = vecs
+		return err
+	case *waypointStack:
+		vecs, err := luaDecodeVec3Arr(lv)
+		// Reverse stack to travel order.
+		for i, j := 0, len(vecs)-1; i < j; i, j = i+1, j-1 {
+			vecs[i], vecs[j] = vecs[j], vecs[i]
+		}
+		*dst = vecs
+		return err
+	case *[]itemID:
+		tbl, ok := lv.(*lua.LTable)
+		if !ok {
+			return fmt.Errorf("expected item array, got %v", lv)
+		}
+		*dst = make([]itemID, tbl.Len())
+		for i := range *dst {
+			if err := luaDecode(tbl.RawGetInt(i+1), &(*dst)[i]); err != nil {
+				return err
+			}
+		}
+	case *map[itemID]int:
+		tbl, ok := lv.(*lua.LTable)
+		if !ok {
+			return fmt.Errorf("expected item counts, got %v", lv)
+		}
+		*dst = map[itemID]int{}
+		var err error
+		tbl.ForEach(func(k lua.LValue, v lua.LValue) {
+			s, ok := k.(lua.LString)
+			if !ok {
+				err = fmt.Errorf("expected item id key, got %v", k)
+				return
+			}
+			n, n_err := luaDecodeInt(v)
+			if n_err != nil {
+				err = n_err
+				return
+			}
+			(*dst)[itemID(s)] = n
+		})
+		return err
+	default:
+		return fmt.Errorf("cannot decode lua to %T", dst)
+	}
+	return nil
 }
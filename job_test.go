@@ -0,0 +1,93 @@
+package main
+
+import (
+	"github.com/yuin/gopher-lua"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestJobRoundTrip(t *testing.T) {
+	item_id := itemID("minecraft:cobblestone/0")
+	tests := []*job{
+		makeJobIdle(1, 30),
+		makeJobGo(workIDTmp, []vec3{{1, 2, 3}, {4, 5, 6}, {-7, 8, -9}}),
+		makeJobSuck(3, &item_id, 64, vec3{0, -1, 0}),
+		makeJobSuck(workIDInvImpSuck, nil, 0, vec3{0, 1, 0}),
+		makeJobDrop(5, map[itemID]int{item_id: 10, "minecraft:dirt/0": 1}, vec3{1, 0, 0}),
+		makeJobDrop(6, map[itemID]int{}, vec3{0, 0, -1}),
+		makeJobRefuel(7, "minecraft:coal/0", 3),
+		makeJobQueue(workIDInvImpQueue, vec3{10, 20, 30}, vec3{1, 0, 0}, vec3{0, 0, 1}, vec3{0, 1, 0}),
+		makeJobMine(9, []vec3{{0, 100, 0}, {0, 100, 16}}, []vec3{{0, 1, 0}, {0, -1, 0}}, true, false),
+		makeJobMine(10, []vec3{{0, 100, 0}}, []vec3{}, false, true),
+		makeJobConstruct(11, "Railcraft:lantern.stone/9", []vec3{{1, 1, 1}, {1, 1, 5}}, vec3{0, -1, 0}),
+		makeJobFarm(12, []vec3{{0, 101, 0}, {8, 101, 0}}, []itemID{"minecraft:wheat_seeds/0", "minecraft:carrot/0"}, 3),
+		makeJobAudit(13, vec3{0, 0, 1}),
+	}
+	covered := map[string]bool{}
+	for _, want := range tests {
+		covered[want.Instr.jobType()] = true
+		src, err := want.luaTable()
+		if err != nil {
+			t.Fatalf("serializing %v job %v: %v", want.Instr.jobType(), want.ID, err)
+		}
+		got, err := parseJob(src)
+		if err != nil {
+			t.Errorf("parsing %v job %v: %v\n%s", want.Instr.jobType(), want.ID, err, src)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%v job %v round trip: got %+v, want %+v", want.Instr.jobType(), want.ID, got.Instr, want.Instr)
+		}
+		// The report response wraps the job in a table with other fields.
+		rsp, err := want.luaSrc()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err = parseJobResponse("{" + rsp + "fuel_items = {},}")
+		if err != nil {
+			t.Errorf("parsing %v job %v response: %v", want.Instr.jobType(), want.ID, err)
+		} else if !reflect.DeepEqual(got, want) {
+			t.Errorf("%v job %v response round trip: got %+v, want %+v", want.Instr.jobType(), want.ID, got.Instr, want.Instr)
+		}
+	}
+	for job_type := range jobTypes {
+		if !covered[job_type] {
+			t.Errorf("no round trip test for %v jobs", job_type)
+		}
+	}
+}
+
+func TestParseJobInvalid(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{`nil`, "job is not a table"},
+		{`{id = 1, type = "fly", instructions = {}}`, "unknown job type"},
+		{`{id = 1.5, type = "idle", instructions = {time = 1}}`, "id:"},
+		{`{id = 1, type = "idle"}`, "instructions is not a table"},
+		{`{id = 1, type = "idle", instructions = {time = -1}}`, "negative idle time"},
+		{`{id = 1, type = "suck", instructions = {item_id = 5, amount = 1, dir = {0, 1, 0}}}`, "item_id:"},
+		{`{id = 1, type = "drop", instructions = {items = {[1] = 2}, dir = {0, 1, 0}}}`, "expected item id key"},
+		{`{id = 1, type = "audit", instructions = {dir = {1, 1, 0}}}`, "not an orthogonal unit vector"},
+		{`{id = 1, type = "go", instructions = {waypoint_stack = {{1, 2}}}}`, "expected vector"},
+		{`(function() while true do end end)()`, "evaluating job failed"},
+	}
+	for _, test := range tests {
+		_, err := parseJob(test.src)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("parseJob(%q): got error %v, want %q", test.src, err, test.want)
+		}
+	}
+}
+
+func TestLuaSerialUnsupported(t *testing.T) {
+	if _, err := luaSerial([]luaField{{"ratio", new(float64)}}, ""); err == nil {
+		t.Errorf("serializing a float succeeded")
+	}
+	var ratio float64
+	if err := luaDecode(lua.LNumber(1), &ratio); err == nil {
+		t.Errorf("decoding a float succeeded")
+	}
+}
@@ -1,13 +1,13 @@
 package main; var lua_src_kernel = `
-version = 79
+version = 83
 
 local base_url = "http://skogen.twitverse.com:4456/72ceda8b"
 local state_root = "/state"
 
 local orient_block_name = "ExtraUtilities:color_stonebrick"
 
-local refuel_item_id = "minecraft:coal/0"
-local refuel_item_fpi = 80
+-- Fuel items and their fuel value per item, updated by the server.
+local fuel_items = {["minecraft:coal/0"] = 80}
 
 -- Look() return values.
 local look_up = 1
@@ -52,6 +52,22 @@ function split(str, pat)
    return t
 end
 
+-- Table functions.
+
+function map_equal(a, b)
+    for k, v in pairs(a) do
+        if b[k] ~= v then
+            return false
+        end
+    end
+    for k, _ in pairs(b) do
+        if a[k] == nil then
+            return false
+        end
+    end
+    return true
+end
+
 -- Vector functions.
 
 function vec_equal(a, b)
@@ -491,7 +507,8 @@ function tryRefuel(required)
     while true do
         -- Check if found fuel item in this slot.
         local detail = getItemDetail(cur_slot)
-        if detail ~= nil and detail.id == refuel_item_id then
+        local fuel_per_item = (detail ~= nil and fuel_items[detail.id] or nil)
+        if fuel_per_item ~= nil then
             -- Fuel found, select slot.
             if cur_slot ~= first_slot then
                 local success = turtle.select(cur_slot)
@@ -500,7 +517,7 @@ function tryRefuel(required)
                 end
             end
             -- Refuel the amount we want.
-            local max = math.ceil(required / refuel_item_fpi)
+            local max = math.ceil(required / fuel_per_item)
             debug("refueling " .. fmt(max) .. "@" .. fmt(cur_slot))
             local success = turtle.refuel(max)
             if not success then
@@ -565,6 +582,7 @@ function inventoryCount()
     local inv_count = {
         free_slots = 0,
         grouped = {},
+        max_stack = {},
     }
     for i = 1, 16 do
         local detail = getItemDetail(i)
@@ -573,6 +591,7 @@ function inventoryCount()
         else
             local count = inv_count.grouped[detail.id] or 0
             inv_count.grouped[detail.id] = count + detail.count
+            inv_count.max_stack[detail.id] = detail.count + turtle.getItemSpace(i)
         end
     end
     return inv_count
@@ -885,6 +904,122 @@ function executeWorkDrop(work)
     end
 end
 
+-- Lists the items in a container with the inventory methods of the
+-- container peripheral. Returns nil if the container is not a peripheral.
+function listContainerPeripheral(lret)
+    local side = "front"
+    if lret == look_up then
+        side = "top"
+    elseif lret == look_down then
+        side = "bottom"
+    end
+    if peripheral == nil or not peripheral.isPresent(side) then
+        return nil
+    end
+    local has_list = false
+    for _, method in ipairs(peripheral.getMethods(side)) do
+        if method == "list" then
+            has_list = true
+        end
+    end
+    if not has_list then
+        return nil
+    end
+    local items = {}
+    for _, stack in pairs(peripheral.call(side, "list")) do
+        local id = stack.name .. "/" .. tostring(stack.damage or 0)
+        items[id] = (items[id] or 0) + stack.count
+    end
+    return items
+end
+
+-- Lists the items in a container by sucking all items and dropping them
+-- back. Returns the items and true if the container was emptied, or false
+-- if the turtle ran out of free slots first. Items that do not fit back in
+-- the container stay in the turtle and are not listed.
+function listContainerSuck(lret)
+    local pre_count = inventoryCount().grouped
+    local emptied = false
+    while true do
+        local dst_slot = 0
+        for i = 1, 16 do
+            if turtle.getItemCount(i) == 0 then
+                dst_slot = i
+                break
+            end
+        end
+        if dst_slot == 0 then
+            break
+        end
+        turtle.select(dst_slot)
+        local suck_ok
+        if lret == look_fwd then
+            suck_ok = turtle.suck()
+        elseif lret == look_up then
+            suck_ok = turtle.suckUp()
+        elseif lret == look_down then
+            suck_ok = turtle.suckDown()
+        end
+        if not suck_ok then
+            emptied = true
+            break
+        end
+        inventoryPack(dst_slot, 16, false)
+    end
+    -- Drop back what was sucked.
+    local items = {}
+    local to_drop = {}
+    for id, count in pairs(inventoryCount().grouped) do
+        local n_sucked = count - (pre_count[id] or 0)
+        if n_sucked > 0 then
+            items[id] = n_sucked
+            to_drop[id] = n_sucked
+        end
+    end
+    for i = 16, 1, -1 do
+        local detail = getItemDetail(i)
+        if detail ~= nil and (to_drop[detail.id] or 0) > 0 then
+            turtle.select(i)
+            local n_drop = math.min(detail.count, to_drop[detail.id])
+            if lret == look_fwd then
+                turtle.drop(n_drop)
+            elseif lret == look_up then
+                turtle.dropUp(n_drop)
+            elseif lret == look_down then
+                turtle.dropDown(n_drop)
+            end
+            to_drop[detail.id] = to_drop[detail.id] - (detail.count - turtle.getItemCount(i))
+        end
+    end
+    -- Items still in the turtle are not in the container.
+    for id, count in pairs(inventoryCount().grouped) do
+        if items[id] ~= nil then
+            items[id] = items[id] - (count - (pre_count[id] or 0))
+            if items[id] <= 0 then
+                items[id] = nil
+            end
+        end
+    end
+    return items, emptied
+end
+
+function executeWorkAudit(work)
+    local instr = work.instructions
+    local ok, lret = look(instr.dir)
+    if not ok then
+        workError("executeWorkAudit: turning failed")
+        return
+    end
+    local items = listContainerPeripheral(lret)
+    local complete = true
+    if items == nil then
+        items, complete = listContainerSuck(lret)
+    end
+    work.audit = {items = items, complete = complete}
+    work.complete = true
+    saveCurWork()
+end
+
 function executeWorkRefuel(work)
     local instr = work.instructions
     local remaining = instr.count
@@ -1180,6 +1315,8 @@ function executeWork(work)
         executeWorkDrop(work)
     elseif work.type == "refuel" then
         executeWorkRefuel(work)
+    elseif work.type == "audit" then
+        executeWorkAudit(work)
     elseif work.type == "queue" then
         executeWorkQueue(work)
     elseif work.type == "mine" then
@@ -1219,6 +1356,7 @@ end
     local cur_pos = fs_state_get("cur_pos", nil)
     local cur_rot = fs_state_get("cur_rot", nil)
     local cur_work = fs_state_get("cur_work", nil)
+    fuel_items = fs_state_get("fuel_items", fuel_items)
     local fatal_err = nil
     local refuel_err = nil
     local work_err = nil
@@ -1629,6 +1767,7 @@ end
                 id = cur_work.id,
                 type = cur_work.type,
                 complete = (cur_work.complete == true),
+                audit = cur_work.audit,
             }
         end
         local data = textutils.serializeJSON({
@@ -1674,6 +1813,11 @@ end
             -- We where assigned new kernel.
             new_kernel = rsp.new_kernel
         end
+        if type(rsp.fuel_items) == "table" and not map_equal(rsp.fuel_items, fuel_items) then
+            -- Fuel items changed.
+            fuel_items = rsp.fuel_items
+            fs_state_put("fuel_items", fuel_items)
+        end
         debug("reporting: completed ok")
         os.queueEvent("user.report-ok")
         return true
@@ -0,0 +1,165 @@
+package main
+
+// Minimal ComputerCraft runtime for simulated turtles. The primitive world,
+// file system and http APIs are implemented in Go (see sim.go). Everything
+// that needs to yield (events, sleeping, parallel) is implemented here on top
+// of coroutines so the Go side only needs to resume the top level thread with
+// the next event.
+var lua_src_sim_bios = `
+-- Events.
+function os.pullEventRaw(filter)
+    return coroutine.yield(filter)
+end
+
+function os.pullEvent(filter)
+    local event = {os.pullEventRaw(filter)}
+    if event[1] == "terminate" then
+        error("Terminated", 0)
+    end
+    return unpack(event)
+end
+
+function os.sleep(time)
+    local timer = os.startTimer(time or 0)
+    repeat
+        local _, param = os.pullEvent("timer")
+    until param == timer
+end
+
+sleep = os.sleep
+
+-- Parallel.
+local function runUntilLimit(routines, limit)
+    local count = #routines
+    local living = count
+    local filters = {}
+    local event = {n = 0}
+    while true do
+        for n = 1, count do
+            local r = routines[n]
+            if r then
+                if filters[r] == nil or filters[r] == event[1] or event[1] == "terminate" then
+                    local ok, param = coroutine.resume(r, unpack(event, 1, event.n))
+                    if not ok then
+                        error(param, 0)
+                    else
+                        filters[r] = param
+                    end
+                    if coroutine.status(r) == "dead" then
+                        routines[n] = nil
+                        living = living - 1
+                        if living <= limit then
+                            return n
+                        end
+                    end
+                end
+            end
+        end
+        event = {os.pullEventRaw()}
+        event.n = #event
+    end
+end
+
+parallel = {}
+
+function parallel.waitForAny(...)
+    local routines = {}
+    for i, fn in ipairs({...}) do
+        routines[i] = coroutine.create(fn)
+    end
+    return runUntilLimit(routines, #routines - 1)
+end
+
+function parallel.waitForAll(...)
+    local routines = {}
+    for i, fn in ipairs({...}) do
+        routines[i] = coroutine.create(fn)
+    end
+    return runUntilLimit(routines, 0)
+end
+
+-- Text utilities.
+textutils = {}
+
+local function serializeImpl(v, indent)
+    local t = type(v)
+    if t == "table" then
+        local next_indent = indent .. "  "
+        local parts = {}
+        local n = #v
+        for i = 1, n do
+            table.insert(parts, next_indent .. serializeImpl(v[i], next_indent) .. ",\n")
+        end
+        for k, kv in pairs(v) do
+            if type(k) ~= "number" or k < 1 or k > n or math.floor(k) ~= k then
+                table.insert(parts, next_indent .. "[" .. serializeImpl(k, next_indent) .. "] = " ..
+                    serializeImpl(kv, next_indent) .. ",\n")
+            end
+        end
+        return "{\n" .. table.concat(parts) .. indent .. "}"
+    elseif t == "string" then
+        return string.format("%q", v)
+    elseif t == "number" or t == "boolean" or t == "nil" then
+        return tostring(v)
+    end
+    error("cannot serialize type " .. t)
+end
+
+function textutils.serialize(v)
+    return serializeImpl(v, "")
+end
+
+function textutils.unserialize(s)
+    if type(s) ~= "string" then
+        return nil
+    end
+    local fn = loadstring("return " .. s)
+    if fn == nil then
+        return nil
+    end
+    setfenv(fn, {})
+    local ok, v = pcall(fn)
+    if ok then
+        return v
+    end
+    return nil
+end
+
+local function jsonString(s)
+    return '"' .. s:gsub('[%c"\\]', function(c)
+        return string.format("\\u%04x", c:byte())
+    end) .. '"'
+end
+
+local function serializeJSONImpl(v)
+    local t = type(v)
+    if t == "table" then
+        local n_keys = 0
+        for _ in pairs(v) do
+            n_keys = n_keys + 1
+        end
+        local parts = {}
+        if n_keys > 0 and n_keys == #v then
+            for i = 1, #v do
+                table.insert(parts, serializeJSONImpl(v[i]))
+            end
+            return "[" .. table.concat(parts, ",") .. "]"
+        end
+        for k, kv in pairs(v) do
+            table.insert(parts, jsonString(tostring(k)) .. ":" .. serializeJSONImpl(kv))
+        end
+        return "{" .. table.concat(parts, ",") .. "}"
+    elseif t == "string" then
+        return jsonString(v)
+    elseif t == "number" or t == "boolean" then
+        return tostring(v)
+    elseif t == "nil" then
+        return "null"
+    end
+    error("cannot serialize type " .. t)
+end
+
+function textutils.serializeJSON(v)
+    return serializeJSONImpl(v)
+end
+`
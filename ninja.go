@@ -13,17 +13,10 @@ import (
 	"strconv"
 )
 
-var turtles = map[turtleID]turtle{}
 var turtlesToDebug map[turtleID]bool
 
 var kern_version int
 
-func check(err error) {
-	if err != nil {
-		panic(err)
-	}
-}
-
 func itoa(n int) string {
 	return strconv.Itoa(n)
 }
@@ -43,31 +36,37 @@ func main() {
 	go syncGo()
 	// Read state.
 	if len(os.Args) < 2 {
-		panic("arg 1: expect state directory")
+		log.Fatal("arg 1: expect state directory")
 	}
 	state_dir := os.Args[1]
-	loadState(state_dir)
-	loadJSON(state_dir+"/turtles.debug", &turtlesToDebug)
+	if err := loadState(state_dir); err != nil {
+		log.Fatalf("loading state failed: %v", err)
+	}
+	if err := loadRegistry(state_dir); err != nil {
+		log.Fatalf("loading registry failed: %v", err)
+	}
+	if err := loadItemCatalog(state_dir); err != nil {
+		log.Fatalf("loading item catalog failed: %v", err)
+	}
+	if err := loadJSON(state_dir+"/turtles.debug", &turtlesToDebug); err != nil {
+		log.Fatalf("loading turtles.debug failed: %v", err)
+	}
 	if len(os.Args) < 3 {
-		panic("arg 2: expect web root directory")
+		log.Fatal("arg 2: expect web root directory")
 	}
 	web_root_dir = os.Args[2]
+	if err := loadItemMap(web_root_dir + "/items/item-map.json"); err != nil {
+		log.Fatalf("loading item map failed: %v", err)
+	}
 	// Start work manager.
 	go workMgrGo()
 	// Run lua script and get version.
 	log.Printf("running kernel\n")
-	kern := lua.NewState()
-	err := kern.DoString("is_server = true")
-	check(err)
-	err = kern.DoString(lua_src_json)
-	check(err)
-	kern.SetGlobal("JSON", kern.Get(-1))
-	err = kern.DoString(lua_src_kernel)
-	check(err)
-	kern_version = int(lua.LVAsNumber(kern.GetGlobal("version")))
-	if kern_version < 1 {
-		panic("failed to get global 'version' from kernel")
+	version, err := loadKernelVersion()
+	if err != nil {
+		log.Fatalf("running kernel failed: %v", err)
 	}
+	kern_version = version
 	log.Printf("kernel version %v ready\n", kern_version)
 	log.Printf("starting http server\n")
 	// Start HTTP server.
@@ -79,6 +78,27 @@ func main() {
 	os.Exit(0)
 }
 
+// Runs the kernel in server mode and returns its version.
+func loadKernelVersion() (int, error) {
+	kern := lua.NewState()
+	defer kern.Close()
+	if err := kern.DoString("is_server = true"); err != nil {
+		return 0, err
+	}
+	if err := kern.DoString(lua_src_json); err != nil {
+		return 0, err
+	}
+	kern.SetGlobal("JSON", kern.Get(-1))
+	if err := kern.DoString(lua_src_kernel); err != nil {
+		return 0, err
+	}
+	version := int(lua.LVAsNumber(kern.GetGlobal("version")))
+	if version < 1 {
+		return 0, fmt.Errorf("failed to get global 'version' from kernel")
+	}
+	return version, nil
+}
+
 var root_key = "/72ceda8b"
 
 func goHttpServer() {
@@ -89,6 +109,11 @@ func goHttpServer() {
 	http.HandleFunc(root_key+"/version", getVersion)
 	http.HandleFunc(root_key+"/report", postReport)
 	http.HandleFunc(root_key+"/export", postExport)
+	http.HandleFunc(root_key+"/areas", handleAreas)
+	http.HandleFunc(root_key+"/areas/", handleAreas)
+	http.HandleFunc(root_key+"/storage/", handleStorageQuery)
+	http.HandleFunc(root_key+"/exports/", handleExportOrders)
+	http.HandleFunc(root_key+"/federation/", handleFederation)
 	http.Handle(root_key+"/sync", websocket.Handler(wsSync))
 	log.Fatal(http.ListenAndServe(":4456", nil))
 }
@@ -118,21 +143,32 @@ func postReport(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
-	//fmt.Printf("incoming raw report: %v\n", buf.String())
-	//err := r.ParseMultipartForm(40 * 1000 * 1000)
-	var t turtle
-	err = json.Unmarshal(buf.Bytes(), &t)
+	rsp, err := processReport(buf.Bytes())
 	if err != nil {
-		log.Printf("decoding report body failed: %v\n", err)
+		log.Printf("processing report failed: %v\n", err)
+		writeRspError(w, err)
 		return
 	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(rsp))
+}
+
+// Processes a raw turtle report and returns the raw lua table response
+// with any new work for the turtle.
+func processReport(raw []byte) (string, error) {
+	//fmt.Printf("incoming raw report: %v\n", string(raw))
+	var t turtle
+	err := json.Unmarshal(raw, &t)
+	if err != nil {
+		return "", errBadRequest("decoding report body failed: %v", err)
+	}
 	debug := turtlesToDebug[t.Label]
 	if debug {
 		fmt.Printf("incoming report: %#v\n", t)
 	}
-	// Update reported turtle data.
-	turtles[t.Label] = t
-	syncNotify("turtles/"+string(t.Label), buf.String())
+	// Publish reported turtle data. The work manager records it in the
+	// turtle registry.
+	syncNotify("turtles/"+string(t.Label), string(raw))
 	// Prepare response.
 	var rsp bytes.Buffer
 	// Decide new work for turtle.
@@ -140,27 +176,39 @@ func postReport(w http.ResponseWriter, r *http.Request) {
 		fmt.Printf("existing work: %#v\n", *t.CurWork)
 	}
 	work_rsp := ""
-	work_ptr := decideWork(t)
-	if work_ptr == nil {
+	new_job, fuel_items, err := decideWork(t, raw)
+	if err != nil {
 		// Deciding work failed.
-		fmt.Printf("failed to decide work\n")
-		writeRspInternalError(w)
-		return
+		return "", err
+	}
+	if new_job != nil {
+		work_rsp, err = new_job.luaSrc()
+		if err != nil {
+			return "", err
+		}
 	}
-	work_rsp = *work_ptr
 	if debug {
 		fmt.Printf("work decision: %s\n\n", work_rsp)
 	}
 	rsp.WriteString("{")
 	rsp.WriteString(work_rsp)
+	if fuel_items != nil {
+		// Turtles only refuel with the fuel items of their area.
+		raw_fuel_items, err := luaSerial(&fuel_items, "")
+		if err != nil {
+			return "", err
+		}
+		rsp.WriteString("fuel_items = ")
+		rsp.WriteString(raw_fuel_items)
+		rsp.WriteString(",")
+	}
 	if t.Version < kern_version && !t.NewKernel {
 		rsp.WriteString("new_kernel = ")
 		rsp.WriteString(strconv.Quote(lua_src_kernel))
 		rsp.WriteString(",")
 	}
 	rsp.WriteString("}")
-	w.Header().Set("Content-Type", "text/plain")
-	w.Write(rsp.Bytes())
+	return rsp.String(), nil
 }
 
 func postExport(w http.ResponseWriter, r *http.Request) {
@@ -173,14 +221,36 @@ func postExport(w http.ResponseWriter, r *http.Request) {
 	err = json.Unmarshal(buf.Bytes(), &req)
 	if err != nil {
 		log.Printf("decoding export request failed: %v\n", err)
+		writeRspError(w, errBadRequest("decoding export request failed: %v", err))
 		return
 	}
+	if req.Requester == "" {
+		req.Requester = r.RemoteAddr
+	}
 	log.Printf("got export request: %v\n", req)
-	ret := exportItems(req)
-	raw_rsp, err := json.Marshal(ret)
-	check(err)
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(raw_rsp)
+	if req.AreaID == "" {
+		// Export from any storage area.
+		orders, err := exportItemsFederated(req)
+		if err != nil {
+			log.Printf("federated export request failed: %v\n", err)
+			writeRspError(w, err)
+			return
+		}
+		writeRspJSON(w, orders)
+		return
+	}
+	order, err := exportItems(req)
+	if err != nil {
+		log.Printf("export request failed: %v\n", err)
+		writeRspError(w, err)
+		return
+	}
+	if order == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("true"))
+		return
+	}
+	writeRspJSON(w, order)
 }
 
 func writeRspNotFound(w http.ResponseWriter) {
@@ -190,3 +260,13 @@ func writeRspNotFound(w http.ResponseWriter) {
 func writeRspInternalError(w http.ResponseWriter) {
 	http.Error(w, "<h1>Internal Server Error</h1>", http.StatusInternalServerError)
 }
+
+// Writes an error response with the status of a request error.
+func writeRspError(w http.ResponseWriter, err error) {
+	status := errStatus(err)
+	if status == http.StatusInternalServerError {
+		writeRspInternalError(w)
+		return
+	}
+	http.Error(w, err.Error(), status)
+}
@@ -0,0 +1,820 @@
+package main
+
+import (
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Headless turtle simulator. Each simulated turtle boots the real kernel in
+// its own lua state against mocked turtle, fs, http, os and textutils APIs.
+// The world is an in-memory voxel map with chests. Reports are processed by
+// processReport() and therefore talk to the real work manager through
+// decideWork(), which requires the server to be booted (see simBootServer).
+//
+// Time is virtual. The simulation advances by delivering queued events to
+// turtles and by jumping the clock to the next timer when all turtles sleep.
+
+var sim_boot sync.Once
+
+// Whether a work manager of a previous boot is running.
+var sim_mgr_running bool
+
+// Boots the server side of a simulation: loads all areas, the turtle
+// registry and the item catalog in the state directory. The first boot
+// starts the sync goroutine, later boots stop the work manager of the
+// previous one and replace its state so every test has its own state
+// directory.
+func simBootServer(state_dir string) error {
+	sim_boot.Do(func() {
+		go syncGo()
+		version, err := loadKernelVersion()
+		if err != nil {
+			panic(err)
+		}
+		kern_version = version
+	})
+	if sim_mgr_running {
+		workMgrExit()
+		sim_mgr_running = false
+	}
+	areas = map[areaID]area{}
+	turtleRegistry = map[turtleID]*turtleRecord{}
+	turtleFailures = map[turtleID]*turtleFailure{}
+	item_catalog = map[itemID]*itemCatalogEntry{}
+	if err := loadState(state_dir); err != nil {
+		return err
+	}
+	if err := loadRegistry(state_dir); err != nil {
+		return err
+	}
+	if err := loadItemCatalog(state_dir); err != nil {
+		return err
+	}
+	go workMgrGo()
+	sim_mgr_running = true
+	return nil
+}
+
+// Number of slots in a simulated turtle inventory.
+const simTurtleSlots = 16
+
+// Maximum fuel level of a simulated turtle.
+const simFuelLimit = 20000
+
+type simBlock struct {
+	Name string
+	Meta int
+}
+
+type simStack struct {
+	Name   string
+	Damage int
+	Count  int
+}
+
+func (st simStack) id() itemID {
+	return itemID(fmt.Sprintf("%s/%d", st.Name, st.Damage))
+}
+
+// Max stack size of simulated items that do not stack to 64.
+var simMaxStack = map[itemID]int{
+	"minecraft:ender_pearl/0":   16,
+	"minecraft:bucket/0":        16,
+	"minecraft:lava_bucket/0":   1,
+	"minecraft:diamond_sword/0": 1,
+}
+
+func (st simStack) maxCount() int {
+	if n := simMaxStack[st.id()]; n > 0 {
+		return n
+	}
+	return 64
+}
+
+func simStackOf(item_id itemID, count int) *simStack {
+	name := string(item_id)
+	damage := 0
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		damage = atoi(name[i+1:])
+		name = name[:i]
+	}
+	return &simStack{Name: name, Damage: damage, Count: count}
+}
+
+// A simulated inventory, used for both turtles and chests.
+type simInv []*simStack
+
+// Inserts up to n items of a stack into the inventory starting at slot
+// start (zero based). Same items are stacked before using empty slots
+// in the same pass. Returns the number of inserted items.
+func (inv simInv) insert(st simStack, n int, start int) int {
+	n_left := n
+	for pass := 0; pass < 2 && n_left > 0; pass++ {
+		for i := 0; i < len(inv) && n_left > 0; i++ {
+			slot := (start + i) % len(inv)
+			cur := inv[slot]
+			switch {
+			case cur == nil && pass == 1:
+				n_here := n_left
+				if n_here > st.maxCount() {
+					n_here = st.maxCount()
+				}
+				inv[slot] = &simStack{Name: st.Name, Damage: st.Damage, Count: n_here}
+				n_left -= n_here
+			case cur != nil && cur.id() == st.id():
+				n_here := cur.maxCount() - cur.Count
+				if n_here > n_left {
+					n_here = n_left
+				}
+				cur.Count += n_here
+				n_left -= n_here
+			}
+		}
+	}
+	return n - n_left
+}
+
+// Returns the total count of an item in the inventory.
+func (inv simInv) count(item_id itemID) int {
+	n := 0
+	for _, st := range inv {
+		if st != nil && st.id() == item_id {
+			n += st.Count
+		}
+	}
+	return n
+}
+
+// Returns the grouped item counts of the inventory.
+func (inv simInv) grouped() map[itemID]int {
+	out := map[itemID]int{}
+	for _, st := range inv {
+		if st != nil {
+			out[st.id()] += st.Count
+		}
+	}
+	return out
+}
+
+type simWorld struct {
+	blocks map[vec3]simBlock
+	chests map[vec3]simInv
+	// items dropped into the world (not into a chest)
+	dropped map[itemID]int
+}
+
+func newSimWorld() *simWorld {
+	return &simWorld{
+		blocks:  map[vec3]simBlock{},
+		chests:  map[vec3]simInv{},
+		dropped: map[itemID]int{},
+	}
+}
+
+// Fills the cuboid between a and b (inclusive) with a block.
+func (w *simWorld) fill(a, b vec3, block simBlock) {
+	var lo, hi vec3
+	for i := range a {
+		lo[i] = int(math.Min(float64(a[i]), float64(b[i])))
+		hi[i] = int(math.Max(float64(a[i]), float64(b[i])))
+	}
+	for x := lo[0]; x <= hi[0]; x++ {
+		for y := lo[1]; y <= hi[1]; y++ {
+			for z := lo[2]; z <= hi[2]; z++ {
+				w.blocks[vec3{x, y, z}] = block
+			}
+		}
+	}
+}
+
+// Places a chest with the specified number of slots.
+func (w *simWorld) addChest(pos vec3, n_slots int) simInv {
+	delete(w.blocks, pos)
+	inv := make(simInv, n_slots)
+	w.chests[pos] = inv
+	return inv
+}
+
+type simTurtle struct {
+	sim   *sim
+	label turtleID
+	pos   vec3
+	rot   vec3
+	fuel  int
+	inv   simInv
+	// selected slot (zero based)
+	sel int
+	// file system, path -> content
+	fs map[string]string
+	// lua state and top level kernel thread
+	L      *lua.LState
+	thread *lua.LState
+	fn     *lua.LFunction
+	// event filter of the last yield, empty string = any event
+	filter string
+	events [][]lua.LValue
+	timers map[int]float64
+	// set when the turtle requested a reboot
+	reboot bool
+	dead   bool
+	err    error
+}
+
+type sim struct {
+	world   *simWorld
+	turtles []*simTurtle
+	clock   float64
+	timerID int
+	// print turtle debug output to log
+	verbose bool
+}
+
+func newSim(world *simWorld) *sim {
+	return &sim{world: world}
+}
+
+// Adds a turtle and boots its kernel. The position and rotation is written to
+// the turtle state directory so that orientation is not required.
+func (s *sim) addTurtle(label turtleID, pos vec3, rot vec3, fuel int) *simTurtle {
+	t := &simTurtle{
+		sim:    s,
+		label:  label,
+		pos:    pos,
+		rot:    rot,
+		fuel:   fuel,
+		inv:    make(simInv, simTurtleSlots),
+		fs:     map[string]string{},
+		timers: map[int]float64{},
+	}
+	t.fs["/state/cur_pos"] = luaSerialVec3(pos)
+	t.fs["/state/cur_rot"] = luaSerialVec3(rot)
+	s.turtles = append(s.turtles, t)
+	t.boot()
+	return t
+}
+
+// Returns the simulated turtle with the specified label.
+func (s *sim) turtle(label turtleID) *simTurtle {
+	for _, t := range s.turtles {
+		if t.label == label {
+			return t
+		}
+	}
+	return nil
+}
+
+// Returns true if the position is occupied by a block, chest or turtle.
+func (s *sim) occupied(pos vec3) bool {
+	if _, ok := s.world.blocks[pos]; ok {
+		return true
+	}
+	if _, ok := s.world.chests[pos]; ok {
+		return true
+	}
+	for _, t := range s.turtles {
+		if !t.dead && vec3Equal(t.pos, pos) {
+			return true
+		}
+	}
+	return false
+}
+
+// Runs the simulation until done returns true or the virtual clock has
+// advanced by max_time seconds.
+func (s *sim) run(max_time float64, done func() bool) error {
+	end_time := s.clock + max_time
+	for s.clock <= end_time {
+		for _, t := range s.turtles {
+			if t.err != nil {
+				return fmt.Errorf("sim: turtle %v: %v", t.label, t.err)
+			}
+		}
+		if done != nil && done() {
+			return nil
+		}
+		if !s.step() {
+			return fmt.Errorf("sim: deadlock, no events or timers pending")
+		}
+	}
+	if done == nil {
+		return nil
+	}
+	return fmt.Errorf("sim: timeout after %v seconds", max_time)
+}
+
+// Delivers one pending event to every turtle that has one. When no events
+// are pending the clock is advanced to the next timer. Returns false if
+// nothing can happen anymore.
+func (s *sim) step() bool {
+	delivered := false
+	for _, t := range s.turtles {
+		if t.dead || len(t.events) == 0 {
+			continue
+		}
+		event := t.events[0]
+		t.events = t.events[1:]
+		delivered = true
+		name := lua.LVAsString(event[0])
+		if t.filter != "" && name != t.filter && name != "terminate" {
+			// Discard event like the computer would.
+			continue
+		}
+		t.resume(event)
+	}
+	if delivered {
+		return true
+	}
+	next := math.Inf(1)
+	for _, t := range s.turtles {
+		for _, at := range t.timers {
+			if !t.dead && at < next {
+				next = at
+			}
+		}
+	}
+	if math.IsInf(next, 1) {
+		return false
+	}
+	if next > s.clock {
+		s.clock = next
+	}
+	for _, t := range s.turtles {
+		ids := []int{}
+		for id, at := range t.timers {
+			if at <= s.clock {
+				ids = append(ids, id)
+			}
+		}
+		sort.Ints(ids)
+		for _, id := range ids {
+			delete(t.timers, id)
+			t.queueEvent("timer", lua.LNumber(id))
+		}
+	}
+	return true
+}
+
+func (t *simTurtle) queueEvent(name string, args ...lua.LValue) {
+	event := append([]lua.LValue{lua.LString(name)}, args...)
+	t.events = append(t.events, event)
+}
+
+// Boots (or reboots) the kernel. A flashed startup file is preferred over
+// the server kernel, like a real turtle would.
+func (t *simTurtle) boot() {
+	if t.L != nil {
+		t.L.Close()
+	}
+	t.L = lua.NewState()
+	t.filter = ""
+	t.events = nil
+	t.timers = map[int]float64{}
+	t.reboot = false
+	t.registerAPIs()
+	if err := t.L.DoString(lua_src_sim_bios); err != nil {
+		panic(err)
+	}
+	src, ok := t.fs["/startup"]
+	if !ok {
+		src = lua_src_kernel
+	}
+	fn, err := t.L.LoadString(src)
+	t.fn = fn
+	if err != nil {
+		t.err = err
+		t.dead = true
+		return
+	}
+	t.thread, _ = t.L.NewThread()
+	t.resume(nil)
+}
+
+// Resumes the kernel thread with an event.
+func (t *simTurtle) resume(event []lua.LValue) {
+	st, err, values := t.L.Resume(t.thread, t.fn, event...)
+	switch {
+	case t.reboot:
+		t.boot()
+	case st == lua.ResumeError:
+		t.err = err
+		t.dead = true
+	case st == lua.ResumeOK:
+		// Kernel returned, the computer shuts down.
+		t.dead = true
+	default:
+		t.filter = ""
+		if len(values) > 0 {
+			if filter, ok := values[0].(lua.LString); ok {
+				t.filter = string(filter)
+			}
+		}
+	}
+}
+
+// Decodes and validates the work currently stored by the kernel.
+// Returns nil if the turtle has no work.
+func (t *simTurtle) curWork() (*job, error) {
+	src := t.fs["/state/cur_work"]
+	if src == "" || src == "nil" {
+		return nil, nil
+	}
+	return parseJob(src)
+}
+
+// Returns the position in front of, above or below the turtle.
+func (t *simTurtle) target(dir string) vec3 {
+	switch dir {
+	case "up":
+		return vec3Add(t.pos, vec3{0, 1, 0})
+	case "down":
+		return vec3Add(t.pos, vec3{0, -1, 0})
+	default:
+		return vec3Add(t.pos, t.rot)
+	}
+}
+
+func (t *simTurtle) move(dst vec3) bool {
+	if t.fuel <= 0 || t.sim.occupied(dst) {
+		return false
+	}
+	t.pos = dst
+	t.fuel--
+	return true
+}
+
+func (t *simTurtle) registerAPIs() {
+	L := t.L
+	w := t.sim.world
+	// Returns selected slot from optional 1 based slot argument.
+	slotArg := func(L *lua.LState, n int) int {
+		return L.OptInt(n, t.sel+1) - 1
+	}
+	// Turtle API.
+	api := map[string]lua.LGFunction{
+		"getSelectedSlot": func(L *lua.LState) int {
+			L.Push(lua.LNumber(t.sel + 1))
+			return 1
+		},
+		"select": func(L *lua.LState) int {
+			slot := L.CheckInt(1) - 1
+			if slot < 0 || slot >= len(t.inv) {
+				L.ArgError(1, "slot number out of range")
+			}
+			t.sel = slot
+			L.Push(lua.LTrue)
+			return 1
+		},
+		"getItemCount": func(L *lua.LState) int {
+			n := 0
+			if st := t.inv[slotArg(L, 1)]; st != nil {
+				n = st.Count
+			}
+			L.Push(lua.LNumber(n))
+			return 1
+		},
+		"getItemSpace": func(L *lua.LState) int {
+			n := 64
+			if st := t.inv[slotArg(L, 1)]; st != nil {
+				n = st.maxCount() - st.Count
+			}
+			L.Push(lua.LNumber(n))
+			return 1
+		},
+		"getItemDetail": func(L *lua.LState) int {
+			st := t.inv[slotArg(L, 1)]
+			if st == nil {
+				L.Push(lua.LNil)
+				return 1
+			}
+			detail := L.NewTable()
+			detail.RawSetString("name", lua.LString(st.Name))
+			detail.RawSetString("damage", lua.LNumber(st.Damage))
+			detail.RawSetString("count", lua.LNumber(st.Count))
+			L.Push(detail)
+			return 1
+		},
+		"transferTo": func(L *lua.LState) int {
+			dst := L.CheckInt(1) - 1
+			src := t.inv[t.sel]
+			if src == nil || dst < 0 || dst >= len(t.inv) || dst == t.sel {
+				L.Push(lua.LFalse)
+				return 1
+			}
+			n := L.OptInt(2, src.Count)
+			if n > src.Count {
+				n = src.Count
+			}
+			n = t.inv[dst:dst+1].insert(*src, n, 0)
+			src.Count -= n
+			if src.Count == 0 {
+				t.inv[t.sel] = nil
+			}
+			L.Push(lua.LBool(n > 0))
+			return 1
+		},
+		"getFuelLevel": func(L *lua.LState) int {
+			L.Push(lua.LNumber(t.fuel))
+			return 1
+		},
+		"refuel": func(L *lua.LState) int {
+			st := t.inv[t.sel]
+			if st == nil || defaultFuelValues[st.id()] == 0 {
+				L.Push(lua.LFalse)
+				return 1
+			}
+			n := L.OptInt(1, st.Count)
+			if n > st.Count {
+				n = st.Count
+			}
+			t.fuel += n * defaultFuelValues[st.id()]
+			if t.fuel > simFuelLimit {
+				t.fuel = simFuelLimit
+			}
+			st.Count -= n
+			if st.id() == "minecraft:lava_bucket/0" {
+				// Lava buckets do not stack and leave an empty bucket.
+				t.inv[t.sel] = simStackOf("minecraft:bucket/0", 1)
+			} else if st.Count == 0 {
+				t.inv[t.sel] = nil
+			}
+			L.Push(lua.LTrue)
+			return 1
+		},
+		"turnLeft": func(L *lua.LState) int {
+			t.rot = vec3{t.rot[2], t.rot[1], -t.rot[0]}
+			L.Push(lua.LTrue)
+			return 1
+		},
+		"turnRight": func(L *lua.LState) int {
+			t.rot = vec3{-t.rot[2], t.rot[1], t.rot[0]}
+			L.Push(lua.LTrue)
+			return 1
+		},
+	}
+	for dir, suffix := range map[string]string{"": "", "up": "Up", "down": "Down"} {
+		dir := dir
+		move_name := map[string]string{"": "forward", "up": "up", "down": "down"}[dir]
+		api[move_name] = func(L *lua.LState) int {
+			L.Push(lua.LBool(t.move(t.target(dir))))
+			return 1
+		}
+		api["detect"+suffix] = func(L *lua.LState) int {
+			L.Push(lua.LBool(t.sim.occupied(t.target(dir))))
+			return 1
+		}
+		api["inspect"+suffix] = func(L *lua.LState) int {
+			pos := t.target(dir)
+			var block simBlock
+			if b, ok := w.blocks[pos]; ok {
+				block = b
+			} else if _, ok := w.chests[pos]; ok {
+				block = simBlock{Name: "minecraft:chest"}
+			} else if t.sim.occupied(pos) {
+				block = simBlock{Name: "ComputerCraft:CC-Turtle"}
+			} else {
+				L.Push(lua.LFalse)
+				L.Push(lua.LString("No block to inspect"))
+				return 2
+			}
+			detail := L.NewTable()
+			detail.RawSetString("name", lua.LString(block.Name))
+			detail.RawSetString("metadata", lua.LNumber(block.Meta))
+			L.Push(lua.LTrue)
+			L.Push(detail)
+			return 2
+		}
+		api["dig"+suffix] = func(L *lua.LState) int {
+			pos := t.target(dir)
+			block, ok := w.blocks[pos]
+			if !ok {
+				L.Push(lua.LFalse)
+				return 1
+			}
+			delete(w.blocks, pos)
+			drop := simStack{Name: block.Name, Damage: block.Meta, Count: 1}
+			if t.inv.insert(drop, 1, t.sel) == 0 {
+				w.dropped[drop.id()]++
+			}
+			L.Push(lua.LTrue)
+			return 1
+		}
+		api["attack"+suffix] = func(L *lua.LState) int {
+			L.Push(lua.LFalse)
+			return 1
+		}
+		api["place"+suffix] = func(L *lua.LState) int {
+			pos := t.target(dir)
+			st := t.inv[t.sel]
+			if st == nil || t.sim.occupied(pos) {
+				L.Push(lua.LFalse)
+				return 1
+			}
+			w.blocks[pos] = simBlock{Name: st.Name}
+			st.Count--
+			if st.Count == 0 {
+				t.inv[t.sel] = nil
+			}
+			L.Push(lua.LTrue)
+			return 1
+		}
+		api["suck"+suffix] = func(L *lua.LState) int {
+			chest := w.chests[t.target(dir)]
+			n := L.OptInt(1, 64)
+			for i, st := range chest {
+				if st == nil {
+					continue
+				}
+				if n > st.Count {
+					n = st.Count
+				}
+				n = t.inv.insert(*st, n, t.sel)
+				st.Count -= n
+				if st.Count == 0 {
+					chest[i] = nil
+				}
+				L.Push(lua.LBool(n > 0))
+				return 1
+			}
+			L.Push(lua.LFalse)
+			return 1
+		}
+		api["drop"+suffix] = func(L *lua.LState) int {
+			st := t.inv[t.sel]
+			if st == nil {
+				L.Push(lua.LFalse)
+				return 1
+			}
+			n := L.OptInt(1, st.Count)
+			if n > st.Count {
+				n = st.Count
+			}
+			if chest, ok := w.chests[t.target(dir)]; ok {
+				n = chest.insert(*st, n, 0)
+			} else {
+				w.dropped[st.id()] += n
+			}
+			st.Count -= n
+			if st.Count == 0 {
+				t.inv[t.sel] = nil
+			}
+			L.Push(lua.LBool(n > 0))
+			return 1
+		}
+	}
+	L.SetGlobal("turtle", L.SetFuncs(L.NewTable(), api))
+	// File system API.
+	L.SetGlobal("fs", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"makeDir": func(L *lua.LState) int {
+			return 0
+		},
+		"exists": func(L *lua.LState) int {
+			_, ok := t.fs[L.CheckString(1)]
+			L.Push(lua.LBool(ok))
+			return 1
+		},
+		"delete": func(L *lua.LState) int {
+			delete(t.fs, L.CheckString(1))
+			return 0
+		},
+		"move": func(L *lua.LState) int {
+			src, dst := L.CheckString(1), L.CheckString(2)
+			t.fs[dst] = t.fs[src]
+			delete(t.fs, src)
+			return 0
+		},
+		"open": func(L *lua.LState) int {
+			path, mode := L.CheckString(1), L.CheckString(2)
+			h := L.NewTable()
+			switch mode {
+			case "r":
+				data, ok := t.fs[path]
+				if !ok {
+					L.Push(lua.LNil)
+					return 1
+				}
+				L.SetFuncs(h, map[string]lua.LGFunction{
+					"readAll": func(L *lua.LState) int {
+						L.Push(lua.LString(data))
+						return 1
+					},
+					"close": func(L *lua.LState) int {
+						return 0
+					},
+				})
+			case "w":
+				var buf strings.Builder
+				L.SetFuncs(h, map[string]lua.LGFunction{
+					"write": func(L *lua.LState) int {
+						buf.WriteString(L.CheckString(1))
+						return 0
+					},
+					"close": func(L *lua.LState) int {
+						t.fs[path] = buf.String()
+						return 0
+					},
+				})
+			default:
+				L.ArgError(2, "unsupported mode")
+			}
+			L.Push(h)
+			return 1
+		},
+	}))
+	// HTTP API. Requests are served synchronously.
+	request := func(L *lua.LState) int {
+		url := L.CheckString(1)
+		body := L.OptString(2, "")
+		code, rsp := t.sim.serve(url, body)
+		h := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+			"getResponseCode": func(L *lua.LState) int {
+				L.Push(lua.LNumber(code))
+				return 1
+			},
+			"readAll": func(L *lua.LState) int {
+				L.Push(lua.LString(rsp))
+				return 1
+			},
+			"close": func(L *lua.LState) int {
+				return 0
+			},
+		})
+		L.Push(h)
+		return 1
+	}
+	L.SetGlobal("http", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"get":  request,
+		"post": request,
+	}))
+	// OS API. Event and sleep functions are defined by the bios.
+	L.SetFuncs(L.GetGlobal("os").(*lua.LTable), map[string]lua.LGFunction{
+		"clock": func(L *lua.LState) int {
+			L.Push(lua.LNumber(t.sim.clock))
+			return 1
+		},
+		"time": func(L *lua.LState) int {
+			L.Push(lua.LNumber(int(t.sim.clock)))
+			return 1
+		},
+		"startTimer": func(L *lua.LState) int {
+			t.sim.timerID++
+			t.timers[t.sim.timerID] = t.sim.clock + float64(L.CheckNumber(1))
+			L.Push(lua.LNumber(t.sim.timerID))
+			return 1
+		},
+		"queueEvent": func(L *lua.LState) int {
+			args := []lua.LValue{}
+			for i := 2; i <= L.GetTop(); i++ {
+				args = append(args, L.Get(i))
+			}
+			t.queueEvent(L.CheckString(1), args...)
+			return 0
+		},
+		"getComputerLabel": func(L *lua.LState) int {
+			L.Push(lua.LString(t.label))
+			return 1
+		},
+		"reboot": func(L *lua.LState) int {
+			t.reboot = true
+			L.RaiseError("reboot")
+			return 0
+		},
+	})
+	L.SetGlobal("print", L.NewFunction(func(L *lua.LState) int {
+		if t.sim.verbose {
+			parts := []string{}
+			for i := 1; i <= L.GetTop(); i++ {
+				parts = append(parts, L.ToStringMeta(L.Get(i)).String())
+			}
+			log.Printf("sim: %v: %v", t.label, strings.Join(parts, " "))
+		}
+		return 0
+	}))
+}
+
+// Serves a simulated http request to the server.
+func (s *sim) serve(url string, body string) (int, string) {
+	i := strings.Index(url, root_key+"/")
+	if i < 0 {
+		return 404, ""
+	}
+	switch url[i+len(root_key):] {
+	case "/version":
+		return 200, itoa(kern_version)
+	case "/kernel":
+		return 200, lua_src_kernel
+	case "/report":
+		rsp, err := processReport([]byte(body))
+		if err != nil {
+			log.Printf("sim: processing report failed: %v\n", err)
+			return 500, ""
+		}
+		return 200, rsp
+	default:
+		return 404, ""
+	}
+}
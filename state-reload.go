@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Live reload of areas from the state directory.
+// The work manager periodically compares the files in every area directory
+// with a snapshot of their modification time and size. The snapshot is
+// taken when the area is loaded and updated by every write of the server
+// itself, so only external changes trigger a reload. Reloaded areas keep
+// the allocations of the previously loaded area, edits of the kept fields
+// are logged and ignored. Areas whose directory was removed are unloaded.
+// Crashed transactions are only recovered at startup, a transaction of the
+// server itself is never in flight while the work manager reloads.
+
+// How often the work manager looks for changed area directories.
+const stateReloadInterval = 5 * time.Second
+
+type fileStamp struct {
+	mod_time time.Time
+	size     int64
+}
+
+// Map from area directory to file name to stamp of its last known version.
+var state_stamps = map[string]map[string]fileStamp{}
+var state_stamps_mtx sync.Mutex
+
+// Returns true if the file in an area directory is part of the area state.
+func isStateFile(info os.FileInfo) bool {
+	name := info.Name()
+	return !info.IsDir() && name != txnJournalName && name != ledgerFileName && !strings.HasSuffix(name, tmpFileSuffix)
+}
+
+func readStateStamps(dir string) (map[string]fileStamp, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	stamps := map[string]fileStamp{}
+	for _, file := range files {
+		if isStateFile(file) {
+			stamps[file.Name()] = fileStamp{file.ModTime(), file.Size()}
+		}
+	}
+	return stamps, nil
+}
+
+// Takes a snapshot of an area directory. Must be called before the area
+// files are read so that changes made while loading are detected.
+func snapshotStateDir(dir string) error {
+	stamps, err := readStateStamps(dir)
+	if err != nil {
+		return err
+	}
+	state_stamps_mtx.Lock()
+	defer state_stamps_mtx.Unlock()
+	state_stamps[path.Clean(dir)] = stamps
+	return nil
+}
+
+// Notes that the server itself wrote a file so the write does not
+// trigger a reload.
+func stampStateFile(fs_path string) {
+	info, err := os.Stat(fs_path)
+	if err != nil || !isStateFile(info) {
+		return
+	}
+	state_stamps_mtx.Lock()
+	defer state_stamps_mtx.Unlock()
+	if stamps := state_stamps[path.Dir(path.Clean(fs_path))]; stamps != nil {
+		stamps[info.Name()] = fileStamp{info.ModTime(), info.Size()}
+	}
+}
+
+// Returns true if an area directory changed since its last snapshot.
+func stateDirChanged(dir string) (bool, error) {
+	cur, err := readStateStamps(dir)
+	if err != nil {
+		return false, err
+	}
+	state_stamps_mtx.Lock()
+	defer state_stamps_mtx.Unlock()
+	known := state_stamps[path.Clean(dir)]
+	if known == nil || len(known) != len(cur) {
+		return true, nil
+	}
+	for name, stamp := range cur {
+		known_stamp, ok := known[name]
+		if !ok || known_stamp.size != stamp.size || !known_stamp.mod_time.Equal(stamp.mod_time) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Reloads all new and changed areas in the state directory.
+func mgrReloadState() error {
+	area_dirs, err := ioutil.ReadDir(state_dir_path)
+	if err != nil {
+		return err
+	}
+	for _, area_dir := range area_dirs {
+		if !isAreaDir(area_dir) {
+			continue
+		}
+		area_id := areaID(area_dir.Name())
+		area_dir := path.Join(state_dir_path, string(area_id))
+		changed, err := stateDirChanged(area_dir)
+		if err != nil {
+			log.Printf("state reload: error: %v: %v", area_id, err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+		if err := mgrReloadArea(area_id, area_dir); err != nil {
+			log.Printf("state reload: error: %v: rejected change: %v", area_id, err)
+		}
+	}
+	for area_id := range areas {
+		area_dir := path.Join(state_dir_path, string(area_id))
+		if _, err := os.Stat(area_dir); os.IsNotExist(err) {
+			mgrUnloadArea(area_id, area_dir)
+		}
+	}
+	return nil
+}
+
+func mgrReloadArea(area_id areaID, area_dir string) error {
+	// Changes are only reported once, even if they are rejected.
+	if err := snapshotStateDir(area_dir); err != nil {
+		return err
+	}
+	a, err := newArea(area_id)
+	if err != nil {
+		return err
+	}
+	if err := a.load(area_id, area_dir); err != nil {
+		return err
+	}
+	// Clients only see changes that were accepted.
+	if err := syncAreaDir(area_dir); err != nil {
+		return err
+	}
+	if old := areas[area_id]; old != nil {
+		a.keepAllocations(old)
+		log.Printf("state reload: reloaded %v", area_id)
+	} else {
+		log.Printf("state reload: loaded new %v", area_id)
+	}
+	areas[area_id] = a
+	return nil
+}
+
+// Unloads an area whose directory was removed and removes its files from
+// sync clients.
+func mgrUnloadArea(area_id areaID, area_dir string) {
+	state_stamps_mtx.Lock()
+	stamps := state_stamps[path.Clean(area_dir)]
+	delete(state_stamps, path.Clean(area_dir))
+	state_stamps_mtx.Unlock()
+	delete(areas, area_id)
+	for name := range stamps {
+		syncNotify(pathSyncKey(path.Join(area_dir, name)), "null")
+	}
+	log.Printf("state reload: unloaded %v, its directory was removed", area_id)
+}
+
+// Logs that an edit of a field kept over a reload is ignored. Fields are
+// compared by their JSON encoding.
+func warnKeptField(area_id areaID, name string, kept interface{}, loaded interface{}) {
+	raw_kept, _ := json.Marshal(kept)
+	raw_loaded, _ := json.Marshal(loaded)
+	if !bytes.Equal(raw_kept, raw_loaded) {
+		log.Printf("state reload warning: %v: ignoring edited %v, it is kept by the server", area_id, name)
+	}
+}
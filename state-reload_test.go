@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+// Returns the data last published to sync clients for each key.
+func syncLatest() map[string]string {
+	req := syncRefreshReq{last_seq: 0, rsp_ch: make(chan syncRefreshRsp, 1)}
+	syncChan <- req
+	return (<-req.rsp_ch).update
+}
+
+func TestReloadState(t *testing.T) {
+	const details = `{"ID": "storage.0", "Pos": [50, 121, 822], "XLen": 4, "ZLen": 4, "Rows": 2}`
+	dir := simStateDir(t, map[string]string{"storage.0/details": details})
+	if err := simBootServer(dir); err != nil {
+		t.Fatal(err)
+	}
+	s := areas["storage.0"]
+	details_path := path.Join(dir, "storage.0", "details")
+	reload := func(raw string) {
+		if err := os.WriteFile(details_path, []byte(raw), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := mgrCall(mgrReloadState); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A rejected change is not published.
+	reload(`{"ID": "storage.0", "Rows": 3`)
+	if areas["storage.0"] != s {
+		t.Errorf("malformed details were loaded")
+	}
+	if got := syncLatest()["storage.0/details"]; got != details {
+		t.Errorf("published %v after rejected change", got)
+	}
+	const edited = `{"ID": "storage.0", "Pos": [50, 121, 822], "XLen": 4, "ZLen": 4, "Rows": 3}`
+	reload(edited)
+	if s2, ok := areas["storage.0"].(*storageArea); !ok || s2 == s || s2.Layout.Rows != 3 {
+		t.Errorf("edited details were not loaded: %+v", areas["storage.0"])
+	}
+	if got := syncLatest()["storage.0/details"]; got != edited {
+		t.Errorf("published %v after accepted change", got)
+	}
+	// Removing the directory unloads the area.
+	if err := os.RemoveAll(path.Dir(details_path)); err != nil {
+		t.Fatal(err)
+	}
+	if err := mgrCall(mgrReloadState); err != nil {
+		t.Fatal(err)
+	}
+	if areas["storage.0"] != nil {
+		t.Errorf("removed area is still loaded")
+	}
+	if got := syncLatest()["storage.0/details"]; got != "null" {
+		t.Errorf("published %v after removal", got)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+// Crash safe state storage.
+// Single files are written atomically by writing a temporary file that is
+// synced and then renamed over the destination. Multiple files in the same
+// directory are committed together in a transaction. Before a transaction
+// touches any file the previous content of all its files is written to an
+// undo journal. The journal is removed when the commit is complete, so a
+// journal found on startup means that a commit was interrupted and must be
+// rolled back.
+
+const txnJournalName = "txn.journal"
+
+// Suffix of temporary files that are renamed over their destination.
+const tmpFileSuffix = ".tmp"
+
+// Syncs a directory so that renames and removals in it are durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Writes a file atomically. A crash leaves either the old or the new file
+// content, never a truncated file.
+func writeFileAtomic(fs_path string, raw []byte) error {
+	tmp_path := fs_path + tmpFileSuffix
+	f, err := os.OpenFile(tmp_path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(raw)
+	if err == nil {
+		err = f.Sync()
+	}
+	if close_err := f.Close(); err == nil {
+		err = close_err
+	}
+	if err != nil {
+		os.Remove(tmp_path)
+		return err
+	}
+	if err := os.Rename(tmp_path, fs_path); err != nil {
+		return err
+	}
+	stampStateFile(fs_path)
+	return syncDir(path.Dir(fs_path))
+}
+
+type txnJournal struct {
+	Files []txnJournalFile
+}
+
+type txnJournalFile struct {
+	Name string
+	// false if the file did not exist before the transaction
+	Exists bool
+	Data   []byte
+}
+
+// A state transaction collects file writes in one directory that must be
+// committed together.
+type stateTxn struct {
+	dir    string
+	writes []stateWrite
+	err    error
+}
+
+type stateWrite struct {
+	name string
+	raw  []byte
+	sync bool
+}
+
+func newStateTxn(dir string) *stateTxn {
+	return &stateTxn{dir: path.Clean(dir)}
+}
+
+// Adds a JSON file write to the transaction. The write is synced to web
+// clients when the transaction is committed.
+func (txn *stateTxn) storeJSON(fs_path string, src interface{}) {
+	txn.storeJSONSync(fs_path, src, true)
+}
+
+func (txn *stateTxn) storeJSONSync(fs_path string, src interface{}, sync bool) {
+	if txn.err != nil {
+		return
+	}
+	if path.Dir(fs_path) != txn.dir {
+		txn.err = fmt.Errorf("state txn: %v is not in %v", fs_path, txn.dir)
+		return
+	}
+	raw, err := json.MarshalIndent(src, "", "\t")
+	if err != nil {
+		txn.err = err
+		return
+	}
+	name := path.Base(fs_path)
+	for i, w := range txn.writes {
+		if w.name == name {
+			// Replace earlier write of same file.
+			txn.writes[i] = stateWrite{name, raw, sync}
+			return
+		}
+	}
+	txn.writes = append(txn.writes, stateWrite{name, raw, sync})
+}
+
+// Commits all writes in the transaction.
+func (txn *stateTxn) commit() error {
+	if txn.err != nil {
+		return txn.err
+	}
+	if len(txn.writes) == 0 {
+		return nil
+	}
+	// Write undo journal.
+	var journal txnJournal
+	for _, w := range txn.writes {
+		raw, err := ioutil.ReadFile(path.Join(txn.dir, w.name))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		journal.Files = append(journal.Files, txnJournalFile{
+			Name:   w.name,
+			Exists: err == nil,
+			Data:   raw,
+		})
+	}
+	raw_journal, err := json.Marshal(journal)
+	if err != nil {
+		return err
+	}
+	journal_path := path.Join(txn.dir, txnJournalName)
+	if err := writeFileAtomic(journal_path, raw_journal); err != nil {
+		return err
+	}
+	// Write files.
+	for _, w := range txn.writes {
+		if err := writeFileAtomic(path.Join(txn.dir, w.name), w.raw); err != nil {
+			return err
+		}
+	}
+	// Commit complete, remove journal.
+	if err := os.Remove(journal_path); err != nil {
+		return err
+	}
+	if err := syncDir(txn.dir); err != nil {
+		return err
+	}
+	for _, w := range txn.writes {
+		if w.sync {
+			fs_path := path.Join(txn.dir, w.name)
+			syncNotify(pathSyncKey(fs_path), string(w.raw))
+		}
+	}
+	return nil
+}
+
+// Recovers a state directory after a crash: rolls back any partially
+// committed transaction and removes stale temporary files.
+func recoverState(dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), tmpFileSuffix) {
+			log.Printf("state recovery: %v: removing stale %v\n", dir, file.Name())
+			if err := os.Remove(path.Join(dir, file.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	journal_path := path.Join(dir, txnJournalName)
+	raw_journal, err := ioutil.ReadFile(journal_path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var journal txnJournal
+	if err := json.Unmarshal(raw_journal, &journal); err != nil {
+		return fmt.Errorf("state recovery: %v: corrupt journal: %v", dir, err)
+	}
+	for _, file := range journal.Files {
+		fs_path := path.Join(dir, file.Name)
+		if file.Exists {
+			err = writeFileAtomic(fs_path, file.Data)
+		} else {
+			err = os.Remove(fs_path)
+			if os.IsNotExist(err) {
+				err = nil
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(journal_path); err != nil {
+		return err
+	}
+	log.Printf("state recovery: %v: rolled back partial commit of %d files\n", dir, len(journal.Files))
+	return syncDir(dir)
+}
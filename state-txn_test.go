@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+)
+
+// Returns the content of a file, "" if it does not exist.
+func readTestFile(t *testing.T, fs_path string) string {
+	raw, err := os.ReadFile(fs_path)
+	if os.IsNotExist(err) {
+		return ""
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return string(raw)
+}
+
+func TestTxnCommit(t *testing.T) {
+	dir := t.TempDir()
+	txn := newStateTxn(dir)
+	txn.storeJSONSync(path.Join(dir, "a"), 1, false)
+	txn.storeJSONSync(path.Join(dir, "b"), 2, false)
+	// A later write of the same file replaces the earlier one.
+	txn.storeJSONSync(path.Join(dir, "a"), 3, false)
+	if err := txn.commit(); err != nil {
+		t.Fatal(err)
+	}
+	if a, b := readTestFile(t, path.Join(dir, "a")), readTestFile(t, path.Join(dir, "b")); a != "3" || b != "2" {
+		t.Errorf("committed a = %q, b = %q, want 3 and 2", a, b)
+	}
+	if _, err := os.Stat(path.Join(dir, txnJournalName)); !os.IsNotExist(err) {
+		t.Errorf("journal left after commit: %v", err)
+	}
+	// Files outside the directory of the transaction are rejected.
+	txn = newStateTxn(dir)
+	txn.storeJSONSync(path.Join(t.TempDir(), "c"), 1, false)
+	if err := txn.commit(); err == nil {
+		t.Errorf("commit of a file outside %v succeeded", dir)
+	}
+}
+
+func TestRecoverState(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		if err := os.WriteFile(path.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A commit of a and b that was interrupted after writing both files:
+	// a existed before, b did not.
+	journal, err := json.Marshal(txnJournal{Files: []txnJournalFile{
+		{Name: "a", Exists: true, Data: []byte("old")},
+		{Name: "b", Exists: false},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(txnJournalName, string(journal))
+	write("a", "new")
+	write("b", "new")
+	write("c"+tmpFileSuffix, "partial")
+	if err := recoverState(dir); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"a": "old", "b": "", "c" + tmpFileSuffix: "", txnJournalName: ""}
+	for name, content := range want {
+		if got := readTestFile(t, path.Join(dir, name)); got != content {
+			t.Errorf("%v: got %q after recovery, want %q", name, got, content)
+		}
+	}
+	// A corrupt journal is not applied.
+	write(txnJournalName, "{")
+	if err := recoverState(dir); err == nil {
+		t.Errorf("recovery with a corrupt journal succeeded")
+	}
+}
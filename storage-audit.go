@@ -0,0 +1,143 @@
+package main
+
+import (
+	"log"
+	"sort"
+)
+
+// Storage audits. Box contents are bookkeeping updated from turtle inventory
+// deltas, so miscounts are never corrected by themselves. An audit queues
+// boxes that turtles visit when they have nothing better to do. The turtle
+// lists the real contents of the box and the recorded contents are corrected
+// from the result. Every discrepancy is logged.
+
+type auditOrder struct {
+	// work id of the audit job, zero while the turtle goes to the box
+	ID    workID
+	BoxID int `json:"box_id"`
+}
+
+// Queues all boxes for audit.
+func (s *storageArea) startAudit() {
+	queued := map[int]bool{}
+	for _, box_id := range s.AuditQueue {
+		queued[box_id] = true
+	}
+	for _, a := range s.Audits {
+		queued[a.BoxID] = true
+	}
+	for id, box := range s.Boxes {
+		if box.Amount >= 0 && !queued[id] {
+			s.AuditQueue = append(s.AuditQueue, id)
+		}
+	}
+	log.Printf("storage audit: %v: %v boxes queued", s.ID, len(s.AuditQueue))
+}
+
+// Queues boxes for audit that are not queued or audited already.
+func (s *storageArea) queueAudit(box_ids []int) {
+	queued := s.auditBoxes()
+	for _, box_id := range s.AuditQueue {
+		queued[box_id] = true
+	}
+	for _, box_id := range box_ids {
+		if box_id < 0 || box_id >= len(s.Boxes) || s.Boxes[box_id].Amount < 0 || queued[box_id] {
+			continue
+		}
+		s.AuditQueue = append(s.AuditQueue, box_id)
+		queued[box_id] = true
+	}
+}
+
+// Returns the set of boxes that are being audited. Nothing is loaded into
+// or from these boxes.
+func (s storageArea) auditBoxes() map[int]bool {
+	boxes := map[int]bool{}
+	for _, a := range s.Audits {
+		boxes[a.BoxID] = true
+	}
+	return boxes
+}
+
+// Selects the closest queued box for a turtle to audit and removes it from
+// the queue. Boxes that are loaded or reserved by turtles are skipped.
+// Returns nil if no box can be audited now.
+func (s *storageArea) takeAuditBox(t turtle) *auditOrder {
+	busy := s.defragSources()
+	for box_id := range s.rebalanceBoxes() {
+		busy[box_id] = true
+	}
+	for _, lo := range s.LoadOrders {
+		busy[lo.BoxID] = true
+	}
+	for box_id := range s.reservedLoads(t.Label) {
+		busy[box_id] = true
+	}
+	best_i, best_dist := -1, 0
+	for i, box_id := range s.AuditQueue {
+		if busy[box_id] {
+			continue
+		}
+		dist := vec3L1Dist(t.CurPos, s.getBoxOrient(box_id).loadPos())
+		if best_i < 0 || dist < best_dist {
+			best_i, best_dist = i, dist
+		}
+	}
+	if best_i < 0 {
+		return nil
+	}
+	a := &auditOrder{BoxID: s.AuditQueue[best_i]}
+	s.AuditQueue = append(s.AuditQueue[:best_i], s.AuditQueue[best_i+1:]...)
+	return a
+}
+
+// Corrects the recorded contents of a box from the audit result of a
+// turtle.
+func (s *storageArea) reconcileAudit(label turtleID, a auditOrder, result auditResult) {
+	box_id := a.BoxID
+	box := &s.Boxes[box_id]
+	var found []itemID
+	for item_id, count := range result.Items {
+		if count > 0 {
+			found = append(found, item_id)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i] < found[j]
+	})
+	if len(found) > 1 {
+		// Boxes hold one item. Only the recorded item is corrected, the
+		// others must be removed by hand.
+		log.Printf("storage audit: %v: box %v: holds mixed items: %v", s.ID, box_id, result.Items)
+	}
+	name, amount := itemID(""), 0
+	switch {
+	case len(found) == 1:
+		name, amount = found[0], result.Items[found[0]]
+	case len(found) > 1 && result.Items[box.Name] > 0:
+		name, amount = box.Name, result.Items[box.Name]
+	case len(found) > 1:
+		name, amount = found[0], result.Items[found[0]]
+	}
+	if !result.Complete {
+		// Partial listings are lower bounds, they only prove that the box
+		// holds more of the recorded item.
+		if box.Name == "" || result.Items[box.Name] <= box.Amount {
+			return
+		}
+		name, amount = box.Name, result.Items[box.Name]
+	}
+	if name == box.Name && amount == box.Amount {
+		return
+	}
+	log.Printf("storage audit: %v: box %v: recorded %v %v, found %v %v (complete: %v)",
+		s.ID, box_id, box.Amount, box.Name, amount, name, result.Complete)
+	if name == box.Name {
+		s.record(ledgerAudit, label, a.ID, name, amount-box.Amount, box_id)
+	} else {
+		s.record(ledgerAudit, label, a.ID, box.Name, -box.Amount, box_id)
+		s.record(ledgerAudit, label, a.ID, name, amount, box_id)
+	}
+	box.Name, box.Amount = name, amount
+	s.dirtyPlanes[box_id/s.nBoxesPerPlane()] = true
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestReconcileAudit(t *testing.T) {
+	const cobble = itemID("minecraft:cobblestone/0")
+	const dirt = itemID("minecraft:dirt/0")
+	tests := []struct {
+		name        string
+		result      auditResult
+		want_name   itemID
+		want_amount int
+	}{
+		{"match", auditResult{map[itemID]int{cobble: 64}, true}, cobble, 64},
+		{"miscounted", auditResult{map[itemID]int{cobble: 60}, true}, cobble, 60},
+		{"empty", auditResult{map[itemID]int{}, true}, "", 0},
+		{"other item", auditResult{map[itemID]int{dirt: 5}, true}, dirt, 5},
+		{"mixed", auditResult{map[itemID]int{cobble: 50, dirt: 5}, true}, cobble, 50},
+		{"partial lower bound", auditResult{map[itemID]int{cobble: 10}, false}, cobble, 64},
+		{"partial more", auditResult{map[itemID]int{cobble: 70}, false}, cobble, 70},
+		{"partial empty", auditResult{map[itemID]int{}, false}, cobble, 64},
+		{"partial other item", auditResult{map[itemID]int{dirt: 5}, false}, cobble, 64},
+		{"partial mixed more", auditResult{map[itemID]int{cobble: 70, dirt: 5}, false}, cobble, 70},
+	}
+	for _, test := range tests {
+		s := bootCobbleStorage(t)
+		s.reconcileAudit("storage.0.1", auditOrder{ID: 1, BoxID: 0}, test.result)
+		box := s.Boxes[0]
+		if box.Name != test.want_name || box.Amount != test.want_amount {
+			t.Errorf("%v: box holds %v %v, want %v %v", test.name, box.Amount, box.Name, test.want_amount, test.want_name)
+		}
+		if changed := box.Amount != 64 || box.Name != cobble; changed != s.dirtyPlanes[0] {
+			t.Errorf("%v: plane 0 dirty %v, want %v", test.name, s.dirtyPlanes[0], changed)
+		}
+		// The ledger entries add up to the corrected contents.
+		n_cobble := 64
+		for _, entry := range s.pendingLedger {
+			if entry.Kind != ledgerAudit || entry.BoxID != 0 {
+				t.Errorf("%v: unexpected ledger entry %+v", test.name, entry)
+			}
+			if entry.ItemID == cobble {
+				n_cobble += entry.Amount
+			}
+		}
+		want_cobble := 0
+		if test.want_name == cobble {
+			want_cobble = test.want_amount
+		}
+		if n_cobble != want_cobble {
+			t.Errorf("%v: ledger leaves %v cobblestone, want %v", test.name, n_cobble, want_cobble)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// Bulk exports. Export orders with at least threshold items left to export
+// are bulk exports and only served by the turtles of the bulk export pool,
+// which holds up to turtles turtles. Bulk exports are off while turtles is
+// zero, the default, except in areas with the large stack turtle of older
+// versions, which is moved to the pool on load. While a bulk export is
+// waiting and the pool is short, the turtle of the area with the least
+// load, then closest to the exported items, joins the pool. Of the pool members the same rule picks the turtle
+// that serves a bulk export. Lost turtles leave the pool and are replaced
+// by the next bulk export. The pool is edited with the "bulk_export" area
+// field, e.g.
+//
+//	{"threshold": 512, "turtles": 2, "pool": ["storage.0.1"]}
+
+// Bulk export pool of a storage area. A zero threshold is replaced by the
+// default on load.
+type bulkExportPolicy struct {
+	// orders of at least threshold items are bulk exports
+	Threshold int `json:"threshold"`
+	// maximum number of turtles in the pool, 0 = no bulk exports
+	Turtles int `json:"turtles"`
+	// labels of the turtles in the pool
+	Pool []turtleID `json:"pool"`
+}
+
+func (p *bulkExportPolicy) init() {
+	if p.Threshold == 0 {
+		p.Threshold = 512
+	}
+}
+
+func (p bulkExportPolicy) validate() error {
+	if p.Threshold <= 0 || p.Turtles < 0 {
+		return errBadRequest("invalid bulk_export threshold %v and turtles %v", p.Threshold, p.Turtles)
+	}
+	if len(p.Pool) > p.Turtles {
+		return errBadRequest("bulk_export pool %v exceeds %v turtles", p.Pool, p.Turtles)
+	}
+	return nil
+}
+
+// Decodes an edited bulk export pool. Fields that are not given keep their
+// current value.
+func (p *bulkExportPolicy) edit(raw json.RawMessage) error {
+	edited := *p
+	edited.Pool = append([]turtleID{}, p.Pool...)
+	if err := json.Unmarshal(raw, &edited); err != nil {
+		return errBadRequest("invalid bulk_export: %v", err)
+	}
+	edited.init()
+	if err := edited.validate(); err != nil {
+		return err
+	}
+	*p = edited
+	return nil
+}
+
+func (p bulkExportPolicy) inPool(label turtleID) bool {
+	for _, member := range p.Pool {
+		if member == label {
+			return true
+		}
+	}
+	return false
+}
+
+// Removes a turtle from the pool. Returns true if it was a member.
+func (p *bulkExportPolicy) leave(label turtleID) bool {
+	for i, member := range p.Pool {
+		if member == label {
+			p.Pool = append(p.Pool[:i], p.Pool[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if an order is a bulk export by the items it has left to
+// export.
+func (s storageArea) isBulkOrder(order *exportOrder) bool {
+	n_left := order.Queued + order.Allocated + order.InTransit
+	return s.BulkExport.Turtles > 0 && n_left >= s.BulkExport.Threshold
+}
+
+// Returns the number of items a turtle carries or is allocated for export.
+func (s storageArea) turtleLoad(label turtleID) int {
+	n := 0
+	for _, count := range s.ExportAllocs[label] {
+		n += count
+	}
+	for _, count := range s.lastInv[label] {
+		n += count
+	}
+	return n
+}
+
+// Returns the distance from a position to the closest box holding an item.
+func (s storageArea) itemDist(item_id itemID, pos vec3) int {
+	dist := -1
+	for id, box := range s.Boxes {
+		if box.Amount <= 0 || box.Name != item_id {
+			continue
+		}
+		if d := vec3L1Dist(pos, s.getBoxOrient(id).loadPos()); dist < 0 || d < dist {
+			dist = d
+		}
+	}
+	return dist
+}
+
+// Returns the candidate with the least load, then closest to the items.
+// Candidates that have not reported their position are skipped.
+func (s storageArea) bestBulkTurtle(item_id itemID, candidates []turtleID) turtleID {
+	var best turtleID
+	best_load, best_dist := 0, 0
+	for _, label := range candidates {
+		pos, ok := s.lastPos[label]
+		if !ok {
+			continue
+		}
+		load, dist := s.turtleLoad(label), s.itemDist(item_id, pos)
+		if best == "" || load < best_load || (load == best_load && (dist < best_dist || (dist == best_dist && label < best))) {
+			best, best_load, best_dist = label, load, dist
+		}
+	}
+	return best
+}
+
+// Adds a turtle to the pool if the pool is short and the turtle is the best
+// of the turtles outside the pool to export an item. Returns true if the
+// turtle joined.
+func (s *storageArea) joinBulkPool(label turtleID, item_id itemID) bool {
+	if s.BulkExport.inPool(label) || len(s.BulkExport.Pool) >= s.BulkExport.Turtles {
+		return false
+	}
+	var candidates []turtleID
+	for other := range s.lastPos {
+		if !s.BulkExport.inPool(other) {
+			candidates = append(candidates, other)
+		}
+	}
+	if s.bestBulkTurtle(item_id, candidates) != label {
+		return false
+	}
+	s.BulkExport.Pool = append(s.BulkExport.Pool, label)
+	log.Printf("storage: %v: turtle %v joined the bulk export pool", s.ID, label)
+	return true
+}
+
+// Returns true if a turtle may be allocated items of a bulk order: it is in
+// the pool and the best of the pool members that do not serve the order
+// yet.
+func (s storageArea) mayServeBulk(label turtleID, order *exportOrder) bool {
+	if !s.BulkExport.inPool(label) {
+		return false
+	}
+	var candidates []turtleID
+	for _, member := range s.BulkExport.Pool {
+		if member == label || !s.servesOrder(member, order.ID) {
+			candidates = append(candidates, member)
+		}
+	}
+	return s.bestBulkTurtle(order.ItemID, candidates) == label
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestBulkExportLoad(t *testing.T) {
+	tests := []struct {
+		name         string
+		details      string
+		want_turtles int
+		want_pool    []turtleID
+	}{
+		{"default", `{"ID": "storage.0", "Pos": [50, 121, 822], "XLen": 4, "ZLen": 4, "Rows": 2}`, 0, nil},
+		{"configured", `{"ID": "storage.0", "Pos": [50, 121, 822], "XLen": 4, "ZLen": 4, "Rows": 2,
+			"bulk_export": {"turtles": 2}}`, 2, nil},
+		{"migrated", `{"ID": "storage.0", "Pos": [50, 121, 822], "XLen": 4, "ZLen": 4, "Rows": 2,
+			"large_stack_turtle": "storage.0.1"}`, 1, []turtleID{"storage.0.1"}},
+	}
+	for _, test := range tests {
+		simBootAreas(t, map[areaID]string{"storage.0": test.details})
+		p := areas["storage.0"].(*storageArea).BulkExport
+		if p.Turtles != test.want_turtles || !reflect.DeepEqual(p.Pool, test.want_pool) || p.Threshold != 512 {
+			t.Errorf("%v: got %+v, want %v turtles and pool %v", test.name, p, test.want_turtles, test.want_pool)
+		}
+	}
+}
+
+func TestBulkExportEdit(t *testing.T) {
+	tests := []struct {
+		edit         string
+		want_err     bool
+		want_turtles int
+	}{
+		{`{"threshold": 256}`, false, 0},
+		{`{"turtles": 2}`, false, 2},
+		{`{"turtles": -1}`, true, 0},
+		{`{"pool": ["storage.0.1"]}`, true, 0},
+	}
+	for _, test := range tests {
+		var p bulkExportPolicy
+		p.init()
+		err := p.edit(json.RawMessage(test.edit))
+		if (err != nil) != test.want_err {
+			t.Errorf("%v: got error %v, want error %v", test.edit, err, test.want_err)
+		}
+		if p.Turtles != test.want_turtles {
+			t.Errorf("%v: %v turtles, want %v", test.edit, p.Turtles, test.want_turtles)
+		}
+	}
+}
+
+func TestIsBulkOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		turtles int
+		order   exportOrder
+		want    bool
+	}{
+		{"disabled", 0, exportOrder{Count: 600, Queued: 600}, false},
+		{"queued", 1, exportOrder{Count: 600, Queued: 600}, true},
+		{"allocated", 1, exportOrder{Count: 600, Queued: 300, Allocated: 100, InTransit: 200}, true},
+		{"mostly delivered", 1, exportOrder{Count: 600, Queued: 100, Delivered: 500}, false},
+		{"mostly cancelled", 1, exportOrder{Count: 600, Queued: 100, Cancelled: 500}, false},
+	}
+	for _, test := range tests {
+		s := storageArea{BulkExport: bulkExportPolicy{Turtles: test.turtles}}
+		s.BulkExport.init()
+		if got := s.isBulkOrder(&test.order); got != test.want {
+			t.Errorf("%v: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
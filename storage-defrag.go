@@ -0,0 +1,108 @@
+package main
+
+// Storage defragmentation. Turtles that wait for imports without anything
+// to import consolidate items that are spread over several partially filled
+// boxes. The least-full box of such an item is sucked and its items are
+// dropped into the other partially filled boxes of the item until the box is
+// empty. Sucking and dropping are normal load orders, so box counts stay
+// exact.
+
+type defragOrder struct {
+	BoxID  int    `json:"box_id"`
+	ItemID itemID `json:"item_id"`
+	// number of items to suck from the box
+	Count int
+	// true when the items were sucked and are being dropped
+	Fetched bool
+}
+
+// Returns the set of boxes that are being emptied by defragmentation.
+// Nothing is dropped into these boxes.
+func (s storageArea) defragSources() map[int]bool {
+	sources := map[int]bool{}
+	for _, d := range s.Defrags {
+		sources[d.BoxID] = true
+	}
+	return sources
+}
+
+// Returns true if a box is a partially filled box of an item.
+func (s storageArea) isPartialBox(box_id int, item_id itemID) bool {
+	box := s.Boxes[box_id]
+	return box.Amount > 0 && box.Amount < s.boxCapacity(box.Name) && box.Name == item_id
+}
+
+// Selects a box for a turtle to defragment. Returns nil if nothing should
+// be defragmented, or the least-full box of an item with several partially
+// filled boxes together with the number of items to suck from it. The
+// amount is limited to the free space in the other partially filled boxes
+// of the item so that the items never need a new box.
+func (s storageArea) defragCandidate(t turtle) (*boxCandidate, int) {
+	sources := s.defragSources()
+	// Boxes that are being loaded or are reserved by turtles are left alone.
+	loading := map[int]bool{}
+	for _, lo := range s.LoadOrders {
+		loading[lo.BoxID] = true
+	}
+	for box_id := range s.reservedLoads(t.Label) {
+		loading[box_id] = true
+	}
+	for box_id := range s.auditBoxes() {
+		loading[box_id] = true
+	}
+	for box_id := range s.rebalanceBoxes() {
+		loading[box_id] = true
+	}
+	// Items that are exported are left alone.
+	exporting := map[itemID]bool{}
+	for item_id := range s.Exporting {
+		exporting[item_id] = true
+	}
+	for _, item_map := range s.ExportAllocs {
+		for item_id := range item_map {
+			exporting[item_id] = true
+		}
+	}
+	// Free space in the partially filled boxes of each item.
+	item_room := map[itemID]int{}
+	for id, box := range s.Boxes {
+		if !sources[id] && s.isPartialBox(id, box.Name) {
+			item_room[box.Name] += s.boxCapacity(box.Name) - box.Amount
+		}
+	}
+	var cand *boxCandidate
+	n_cand, n_room := 0, 0
+	for id, box := range s.Boxes {
+		if sources[id] || loading[id] || exporting[box.Name] || !s.isPartialBox(id, box.Name) {
+			continue
+		}
+		if cand != nil && box.Amount >= n_cand {
+			continue
+		}
+		// Free space in the other partially filled boxes of the item.
+		room := item_room[box.Name] - (s.boxCapacity(box.Name) - box.Amount)
+		if room <= 0 {
+			continue
+		}
+		cand = &boxCandidate{
+			dist:    vec3L1Dist(t.CurPos, s.getBoxOrient(id).loadPos()),
+			id:      id,
+			item_id: box.Name,
+		}
+		n_cand, n_room = box.Amount, room
+	}
+	if cand == nil {
+		return nil, 0
+	}
+	n_suck := n_cand
+	if n_suck > n_room {
+		n_suck = n_room
+	}
+	if n_max := t.InvCount.FreeSlots * itemMaxStack(cand.item_id); n_suck > n_max {
+		n_suck = n_max
+	}
+	if n_suck <= 0 {
+		return nil, 0
+	}
+	return cand, n_suck
+}
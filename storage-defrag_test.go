@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDefragCandidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		plane     string
+		exporting bool
+		want_box  int
+		want_suck int
+	}{
+		{"least full", `[{"Amount": 10, "Name": "minecraft:cobblestone/0"},
+			{"Amount": 2000, "Name": "minecraft:cobblestone/0"},
+			{"Amount": 100, "Name": "minecraft:dirt/0"}]`, false, 0, 10},
+		{"limited by room", `[{"Amount": 2045, "Name": "minecraft:cobblestone/0"},
+			{"Amount": 10, "Name": "minecraft:cobblestone/0"}]`, false, 1, 3},
+		{"single partial box", `[{"Amount": 2048, "Name": "minecraft:cobblestone/0"},
+			{"Amount": 10, "Name": "minecraft:cobblestone/0"}]`, false, -1, 0},
+		{"exporting", `[{"Amount": 10, "Name": "minecraft:cobblestone/0"},
+			{"Amount": 2000, "Name": "minecraft:cobblestone/0"}]`, true, -1, 0},
+	}
+	for _, test := range tests {
+		err := simBootServer(simStateDir(t, map[string]string{
+			"storage.0/details": `{"ID": "storage.0", "Pos": [50, 121, 822], "XLen": 4, "ZLen": 4, "Rows": 2}`,
+			"storage.0/plane.0": test.plane,
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := areas["storage.0"].(*storageArea)
+		if test.exporting {
+			s.Exporting["minecraft:cobblestone/0"] = 1
+		}
+		tur := turtle{Label: "storage.0.1", CurPos: s.Pos, InvCount: icount{FreeSlots: 16}}
+		cand, n_suck := s.defragCandidate(tur)
+		got_box := -1
+		if cand != nil {
+			got_box = cand.id
+		}
+		if got_box != test.want_box || n_suck != test.want_suck {
+			t.Errorf("%v: got box %v and %v items, want box %v and %v items", test.name, got_box, n_suck, test.want_box, test.want_suck)
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Federation of all storage areas. Exports without an area id are sent to
+// the storage areas that hold the item, split over several areas when one
+// area does not hold enough. A federated export creates the orders in all
+// areas or in none.
+//
+// Imports are not balanced between areas: items are imported where they
+// are put in an import chest and moving them to another hall needs a
+// transport job that does not exist yet. The import query suggests the
+// area that accepts the most items, and a turtle that finds no box for an
+// imported item logs the area that has room for it.
+//
+//  GET <root_key>/federation/items   per-item totals of all storage areas
+//  GET <root_key>/federation/import  storage areas ranked by free capacity
+//
+// The items query takes the same filters as the storage items query. The
+// import query takes an optional "item" to rank by free capacity for.
+
+type federatedItemTotal struct {
+	storageItemTotal
+	// map from storage area ids to the number of items in the area
+	Areas map[areaID]int `json:"areas"`
+}
+
+// Export order created by a federated export, with the area it was sent to.
+type federatedExportOrder struct {
+	AreaID areaID `json:"area_id"`
+	exportOrder
+}
+
+type federatedImportTarget struct {
+	AreaID areaID `json:"area_id"`
+	// number of items that fit in the area
+	FreeCapacity int `json:"free_capacity"`
+	FreeBoxes    int `json:"free_boxes"`
+}
+
+// Returns all storage areas ordered by id.
+func storageAreas() []*storageArea {
+	var out []*storageArea
+	for _, a := range areas {
+		if s, ok := a.(*storageArea); ok {
+			out = append(out, s)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// Returns the number of items that are in storage and neither exported nor
+// delivered: queued exports and items allocated to turtles that did not
+// suck them yet are not available.
+func (s storageArea) nAvailable(item_id itemID) int {
+	n_total := 0
+	for _, box := range s.Boxes {
+		if box.Amount > 0 && box.Name == item_id {
+			n_total += box.Amount
+		}
+	}
+	n_allocated := 0
+	for _, order := range s.itemExportOrders(item_id) {
+		n_allocated += order.Allocated
+	}
+	return n_total - s.Exporting[item_id] - n_allocated - s.nDelivering(item_id)
+}
+
+// Returns the number of items of an item the area accepts on import: the
+// free space of the boxes the item may be dropped in, less the drops other
+// turtles reserved, limited by the routing rules.
+func (s storageArea) freeCapacity(item_id itemID) int {
+	rule := s.itemRule(item_id)
+	if rule != nil && (rule.Action == routeActionExport || rule.Action == routeActionReject) {
+		return 0
+	}
+	reserved := s.reservedLoads("")
+	n_free, n_stored := 0, 0
+	for id, box := range s.Boxes {
+		if box.Amount > 0 && box.Name == item_id {
+			n_stored += box.Amount
+		}
+		if box.Amount < 0 || (box.Amount > 0 && box.Name != item_id) || !s.routeAllows(item_id, id) {
+			continue
+		}
+		n_box := s.boxCapacity(item_id) - box.Amount
+		if load := reserved[id]; load != nil {
+			if load.itemID != item_id {
+				// An empty box reserved for another item.
+				continue
+			}
+			n_box -= load.nDrop
+		}
+		if n_box > 0 {
+			n_free += n_box
+		}
+	}
+	if rule != nil && rule.Action == routeActionCap {
+		n_room := rule.Max - n_stored
+		if n_room < 0 {
+			n_room = 0
+		}
+		if n_free > n_room {
+			n_free = n_room
+		}
+	}
+	return n_free
+}
+
+// Exports items from the storage areas that hold them. Areas with the most
+// available items are used first so an export is split over as few areas
+// as possible. Negative counts cancel queued exports of the item in all
+// areas. Returns the new export orders.
+func mgrHandleFederatedExport(er exportRequest) ([]federatedExportOrder, error) {
+	if er.MaxTurtles < 0 {
+		return nil, errBadRequest("invalid max_turtles: %v", er.MaxTurtles)
+	}
+	orders := []federatedExportOrder{}
+	s_areas := storageAreas()
+	if er.Count < 0 {
+		n_cancel := -er.Count
+		for _, s := range s_areas {
+			if n_cancel <= 0 {
+				break
+			}
+			if n_cancelled := s.cancelItemExports(er.ItemID, n_cancel); n_cancelled > 0 {
+				n_cancel -= n_cancelled
+				if err := s.store(); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return orders, nil
+	}
+	sort.SliceStable(s_areas, func(i, j int) bool {
+		return s_areas[i].nAvailable(er.ItemID) > s_areas[j].nAvailable(er.ItemID)
+	})
+	// Split the export over the areas before any order is created.
+	var parts []exportRequest
+	n_left := er.Count
+	for _, s := range s_areas {
+		n_available := s.nAvailable(er.ItemID)
+		if n_left <= 0 || n_available <= 0 {
+			break
+		}
+		part := er
+		part.AreaID = s.ID
+		part.Count = n_left
+		if part.Count > n_available {
+			part.Count = n_available
+		}
+		parts = append(parts, part)
+		n_left -= part.Count
+	}
+	if len(parts) == 0 {
+		return nil, errConflict("no %v available to export in any storage area", er.ItemID)
+	}
+	var undos []federatedExportUndo
+	for _, part := range parts {
+		s := areas[part.AreaID].(*storageArea)
+		undos = append(undos, federatedExportUndo{s, s.ExportOrderSeq, s.ExportScores[er.ItemID]})
+		order, err := s.handleExport(part)
+		if order != nil {
+			orders = append(orders, federatedExportOrder{part.AreaID, *order})
+		}
+		if err != nil {
+			// Only storing an area can fail after the split. No turtle
+			// was allocated items of the new orders yet, removing them
+			// undoes the export.
+			mgrRollbackFederatedExport(er.ItemID, undos)
+			return nil, err
+		}
+	}
+	for _, order := range orders {
+		log.Printf("federated export: %v %v from %v", order.Count, er.ItemID, order.AreaID)
+	}
+	return orders, nil
+}
+
+// The export bookkeeping of a storage area before a federated export.
+type federatedExportUndo struct {
+	area     *storageArea
+	orderSeq int
+	score    *exportScore
+}
+
+// Undoes a failed federated export of an item: removes the new orders and
+// restores the order sequence and export score of the areas.
+func mgrRollbackFederatedExport(item_id itemID, undos []federatedExportUndo) {
+	for _, u := range undos {
+		s := u.area
+		orders := s.ExportOrders[:0]
+		for _, order := range s.ExportOrders {
+			if order.ID <= u.orderSeq {
+				orders = append(orders, order)
+				continue
+			}
+			s.Exporting[order.ItemID] -= order.Queued
+			if s.Exporting[order.ItemID] <= 0 {
+				delete(s.Exporting, order.ItemID)
+			}
+		}
+		s.ExportOrders = orders
+		s.ExportOrderSeq = u.orderSeq
+		if u.score != nil {
+			s.ExportScores[item_id] = u.score
+		} else {
+			delete(s.ExportScores, item_id)
+		}
+		if err := s.store(); err != nil {
+			log.Printf("federated export: error: %v: removing the orders of a failed export failed: %v", s.ID, err)
+		}
+	}
+}
+
+// Requests a federated export. Returns the new export orders.
+func exportItemsFederated(er exportRequest) ([]federatedExportOrder, error) {
+	var orders []federatedExportOrder
+	err := mgrCall(func() (err error) {
+		orders, err = mgrHandleFederatedExport(er)
+		return err
+	})
+	return orders, err
+}
+
+func handleFederation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeRspError(w, &reqError{http.StatusMethodNotAllowed, "method not allowed"})
+		return
+	}
+	query := strings.TrimPrefix(r.URL.Path, root_key+"/federation/")
+	filter := parseItemFilter(r)
+	import_item := itemID(r.URL.Query().Get("item"))
+	var rsp interface{}
+	err := mgrCall(func() error {
+		switch query {
+		case "items":
+			rsp = mgrFederatedItems(filter)
+		case "import":
+			rsp = mgrFederatedImportTargets(import_item)
+		default:
+			return errNotFound("invalid federation query: %v", query)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("federation query %v failed: %v\n", r.URL.Path, err)
+		writeRspError(w, err)
+		return
+	}
+	writeRspJSON(w, rsp)
+}
+
+func mgrFederatedItems(filter itemFilter) []federatedItemTotal {
+	totals := map[itemID]*federatedItemTotal{}
+	for _, s := range storageAreas() {
+		for _, item_total := range s.queryItems(filter) {
+			total := totals[item_total.ItemID]
+			if total == nil {
+				total = &federatedItemTotal{
+					storageItemTotal: storageItemTotal{
+						ItemID:      item_total.ItemID,
+						DisplayName: item_total.DisplayName,
+					},
+					Areas: map[areaID]int{},
+				}
+				totals[item_total.ItemID] = total
+			}
+			total.Count += item_total.Count
+			total.Boxes += item_total.Boxes
+			total.Exporting += item_total.Exporting
+			if item_total.Count > 0 {
+				total.Areas[s.ID] = item_total.Count
+			}
+		}
+	}
+	rsp := []federatedItemTotal{}
+	for _, total := range totals {
+		rsp = append(rsp, *total)
+	}
+	sort.Slice(rsp, func(i, j int) bool {
+		return rsp[i].ItemID < rsp[j].ItemID
+	})
+	return rsp
+}
+
+// Returns the storage areas ordered by free capacity for an item, the best
+// area to import the item to first. Without an item areas are ordered by
+// free boxes. The ranking is a suggestion for where to put items in an
+// import chest, imports are never moved between areas.
+func mgrFederatedImportTargets(item_id itemID) []federatedImportTarget {
+	rsp := []federatedImportTarget{}
+	for _, s := range storageAreas() {
+		rsp = append(rsp, federatedImportTarget{
+			AreaID:       s.ID,
+			FreeCapacity: s.freeCapacity(item_id),
+			FreeBoxes:    s.queryFree().Free,
+		})
+	}
+	sort.SliceStable(rsp, func(i, j int) bool {
+		if item_id != "" && rsp[i].FreeCapacity != rsp[j].FreeCapacity {
+			return rsp[i].FreeCapacity > rsp[j].FreeCapacity
+		}
+		return rsp[i].FreeBoxes > rsp[j].FreeBoxes
+	})
+	return rsp
+}
+
+// Returns the storage area other than exclude with the most free capacity
+// for an item, nil if no other area has room.
+func mgrFederatedImportTarget(item_id itemID, exclude areaID) *federatedImportTarget {
+	for _, target := range mgrFederatedImportTargets(item_id) {
+		if target.AreaID != exclude && target.FreeCapacity > 0 {
+			return &target
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Boots two storage areas holding 64 and 30 cobblestone. Returns the state
+// directory.
+func bootFederation(t *testing.T) string {
+	dir := simStateDir(t, map[string]string{
+		"storage.0/details": `{"ID": "storage.0", "Pos": [50, 121, 822], "XLen": 4, "ZLen": 4, "Rows": 2}`,
+		"storage.0/plane.0": `[{"Amount": 64, "Name": "minecraft:cobblestone/0"}]`,
+		"storage.1/details": `{"ID": "storage.1", "Pos": [50, 121, 850], "XLen": 4, "ZLen": 4, "Rows": 2}`,
+		"storage.1/plane.0": `[{"Amount": 30, "Name": "minecraft:cobblestone/0"}]`,
+	})
+	if err := simBootServer(dir); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestFederatedExport(t *testing.T) {
+	const item_id = itemID("minecraft:cobblestone/0")
+	bootFederation(t)
+	orders, err := exportItemsFederated(exportRequest{ItemID: item_id, Count: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orders) != 2 || orders[0].AreaID != "storage.0" || orders[0].Count != 64 ||
+		orders[1].AreaID != "storage.1" || orders[1].Count != 16 {
+		t.Errorf("got orders %+v, want 64 from storage.0 and 16 from storage.1", orders)
+	}
+	// Invalid requests are refused before any area is changed.
+	if _, err := exportItemsFederated(exportRequest{ItemID: item_id, Count: 10, MaxTurtles: -1}); err == nil {
+		t.Errorf("export with negative max_turtles succeeded")
+	}
+	if n := areas["storage.1"].(*storageArea).Exporting[item_id]; n != 16 {
+		t.Errorf("storage.1 exporting %v, want 16", n)
+	}
+}
+
+func TestFederatedExportRollback(t *testing.T) {
+	const item_id = itemID("minecraft:cobblestone/0")
+	dir := bootFederation(t)
+	// Storing storage.1 fails without its directory.
+	if err := os.RemoveAll(path.Join(dir, "storage.1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := exportItemsFederated(exportRequest{ItemID: item_id, Count: 80}); err == nil {
+		t.Fatalf("export succeeded without storing storage.1")
+	}
+	for _, area_id := range []areaID{"storage.0", "storage.1"} {
+		s := areas[area_id].(*storageArea)
+		if len(s.ExportOrders) != 0 || s.ExportOrderSeq != 0 {
+			t.Errorf("%v: orders of failed export left: %v, sequence %v", area_id, s.ExportOrders, s.ExportOrderSeq)
+		}
+		if n := s.Exporting[item_id]; n != 0 {
+			t.Errorf("%v: exporting %v after failed export", area_id, n)
+		}
+		if e := s.ExportScores[item_id]; e != nil {
+			t.Errorf("%v: export score %+v after failed export", area_id, *e)
+		}
+	}
+	// The stored state of storage.0 has no trace of the failed export.
+	if raw := readTestFile(t, path.Join(dir, "storage.0", "details")); strings.Contains(raw, string(item_id)) {
+		t.Errorf("stored storage.0 details: %v", raw)
+	}
+}
+
+func TestFreeCapacity(t *testing.T) {
+	const item_id = itemID("minecraft:cobblestone/0")
+	bootFederation(t)
+	s := areas["storage.0"].(*storageArea)
+	n_box := s.boxCapacity(item_id)
+	n_free := n_box*(s.nBoxes()-len(s.Layout.Holes)) - 64
+	tests := []struct {
+		name    string
+		routing []routingRule
+		// reserves box 1 for an item
+		reserve itemID
+		want    int
+	}{
+		{"no rules", nil, "", n_free},
+		{"export", []routingRule{{Pattern: string(item_id), Action: routeActionExport}}, "", 0},
+		{"reject", []routingRule{{Pattern: "minecraft:", Match: routeMatchPrefix, Action: routeActionReject}}, "", 0},
+		{"cap", []routingRule{{Pattern: string(item_id), Action: routeActionCap, Max: 100}}, "", 36},
+		{"route", []routingRule{{Pattern: string(item_id), Action: routeActionRoute, FirstBox: 0, LastBox: 1}}, "", 2*n_box - 64},
+		{"other route", []routingRule{{Pattern: "minecraft:dirt/0", Action: routeActionRoute, FirstBox: 1, LastBox: 2}}, "", n_free - 2*n_box},
+		{"reserved for other item", nil, "minecraft:dirt/0", n_free - n_box},
+		{"reserved for item", nil, item_id, n_free - 10},
+	}
+	for _, test := range tests {
+		var got int
+		err := mgrCall(func() error {
+			s.Routing = test.routing
+			if err := initRoutingRules(s.Routing, s.nBoxes()); err != nil {
+				return err
+			}
+			s.reservations = map[turtleID]*boxReservation{}
+			if test.reserve != "" {
+				s.reservations["storage.0.1"] = &boxReservation{
+					boxID: 1, itemID: test.reserve, drop: true, amount: 10, expires: time.Now().Add(time.Minute),
+				}
+			}
+			got = s.freeCapacity(item_id)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("%v: free capacity %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestFederatedImportTarget(t *testing.T) {
+	const item_id = itemID("minecraft:cobblestone/0")
+	bootFederation(t)
+	s1 := areas["storage.1"].(*storageArea)
+	err := mgrCall(func() error {
+		if target := mgrFederatedImportTarget(item_id, "storage.0"); target == nil || target.AreaID != "storage.1" {
+			t.Errorf("import target: got %+v, want storage.1", target)
+		}
+		// An area that rejects the item has no room for it.
+		s1.Routing = []routingRule{{Pattern: string(item_id), Action: routeActionReject}}
+		if err := initRoutingRules(s1.Routing, s1.nBoxes()); err != nil {
+			return err
+		}
+		if target := mgrFederatedImportTarget(item_id, "storage.0"); target != nil {
+			t.Errorf("import target with storage.1 rejecting: got %+v, want none", *target)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAvailableAllocated(t *testing.T) {
+	const item_id = itemID("minecraft:cobblestone/0")
+	const label = turtleID("storage.0.1")
+	s := bootCobbleStorage(t)
+	if _, err := exportItems(exportRequest{ItemID: item_id, Count: 20, AreaID: "storage.0"}); err != nil {
+		t.Fatal(err)
+	}
+	err := mgrCall(func() error {
+		if n := s.nAvailable(item_id); n != 44 {
+			t.Errorf("queued: available %v, want 44", n)
+		}
+		// Allocated items are still in storage until the turtle sucks them.
+		if n := s.allocateExport(label, item_id, 20); n != 20 {
+			t.Errorf("allocated %v, want 20", n)
+		}
+		if n := s.nAvailable(item_id); n != 44 {
+			t.Errorf("allocated: available %v, want 44", n)
+		}
+		s.Boxes[0].Amount -= 8
+		s.moveTurtleExportItems(label, item_id, 8, []exportStage{exportAllocated}, exportInTransit)
+		if n := s.nAvailable(item_id); n != 44 {
+			t.Errorf("partly sucked: available %v, want 44", n)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Further exports are limited to the available items.
+	order, err := exportItems(exportRequest{ItemID: item_id, Count: 64, AreaID: "storage.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.Count != 44 {
+		t.Errorf("second export of %v items, want 44", order.Count)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Storage layouts. The "layout" field of the storage details describes
+// where the boxes, holes and queues of a storage area are. Positions are
+// relative to the area position. Shapes:
+//
+//	ring      boxes around a shaft, one ring per plane, planes go down
+//	wall      boxes on one side of a lane, one row per plane, rows go down
+//	corridor  boxes on both sides of a lane, the facing side first
+//
+// Areas without a layout get the ring layout of XLen, ZLen and Rows with
+// the I/O hole in boxes 4 to 6, the only layout before layouts existed.
+//
+// Example of a corridor of 2x10 boxes per plane along x, with the import
+// chest above the west end of the lane and the export chest above the east
+// end. Queues extend away from the lane:
+//
+//	{"shape": "corridor", "length": 10, "rows": 4,
+//	 "lane": [1, 0, 0], "facing": [0, 0, -1], "holes": [],
+//	 "import": {"station": [-1, 0, 0], "facing": [0, 1, 0], "dir": [1, 0, 0],
+//	            "station_q0": [-1, 0, 0], "q0_t0": [0, 0, 1]},
+//	 "export": {"station": [10, 0, 0], "facing": [0, 1, 0], "dir": [-1, 0, 0],
+//	            "station_q0": [1, 0, 0], "q0_t0": [0, 0, 1]}}
+
+const (
+	layoutRing     = "ring"
+	layoutWall     = "wall"
+	layoutCorridor = "corridor"
+)
+
+type storageLayout struct {
+	Shape string `json:"shape"`
+	// ring size
+	XLen int `json:"x_len,omitempty"`
+	ZLen int `json:"z_len,omitempty"`
+	// number of boxes along the lane of walls and corridors
+	Length int `json:"length,omitempty"`
+	// number of planes
+	Rows int `json:"rows"`
+	// direction of the lane and direction from the lane to the boxes of
+	// walls and corridors
+	Lane   vec3 `json:"lane"`
+	Facing vec3 `json:"facing"`
+	// ids of boxes that are reserved or missing
+	Holes  []int       `json:"holes"`
+	Import queueLayout `json:"import"`
+	Export queueLayout `json:"export"`
+}
+
+type queueLayout struct {
+	// position where the turtle at the head of the queue loads
+	Station vec3 `json:"station"`
+	// direction of the chest from the station
+	Facing vec3 `json:"facing"`
+	// direction of the queue, station -> first queue position and first
+	// queue position -> first waiting turtle
+	Dir       vec3 `json:"dir"`
+	StationQ0 vec3 `json:"station_q0"`
+	Q0T0      vec3 `json:"q0_t0"`
+}
+
+// Returns the layout of storage areas without one.
+func ringLayout(x_len, z_len, rows int) storageLayout {
+	return storageLayout{
+		Shape: layoutRing,
+		XLen:  x_len,
+		ZLen:  z_len,
+		Rows:  rows,
+		Holes: []int{4, 5, 6},
+		Import: queueLayout{
+			Station:   vec3{-4, -1, 1},
+			Facing:    vec3{0, 1, 0},
+			Dir:       vec3{0, 0, -1},
+			StationQ0: vec3{0, -1, 0},
+			Q0T0:      vec3{1, 0, 0},
+		},
+		Export: queueLayout{
+			Station:   vec3{-2, -1, 1},
+			Facing:    vec3{0, 1, 0},
+			Dir:       vec3{0, 0, -1},
+			StationQ0: vec3{0, -1, 0},
+			Q0T0:      vec3{-1, 0, 0},
+		},
+	}
+}
+
+func (l storageLayout) validate() error {
+	if l.Rows <= 0 {
+		return fmt.Errorf("invalid layout rows: %v", l.Rows)
+	}
+	switch l.Shape {
+	case layoutRing:
+		if l.XLen <= 0 || l.ZLen <= 0 {
+			return fmt.Errorf("invalid ring size %vx%v", l.XLen, l.ZLen)
+		}
+	case layoutWall, layoutCorridor:
+		if l.Length <= 0 {
+			return fmt.Errorf("invalid layout length: %v", l.Length)
+		}
+		if !vec3IsUnit(l.Lane) || !vec3IsUnit(l.Facing) || vec3Dim(l.Lane) == vec3Dim(l.Facing) {
+			return fmt.Errorf("layout lane %v and facing %v must be perpendicular unit vectors", l.Lane, l.Facing)
+		}
+		if l.Facing[1] != 0 || l.Lane[1] != 0 {
+			return fmt.Errorf("layout lane %v and facing %v must be horizontal", l.Lane, l.Facing)
+		}
+	default:
+		return fmt.Errorf("invalid layout shape %q", l.Shape)
+	}
+	for _, box_id := range l.Holes {
+		if box_id < 0 || box_id >= l.nBoxes() {
+			return fmt.Errorf("invalid layout hole %v", box_id)
+		}
+	}
+	for name, q := range map[string]queueLayout{"import": l.Import, "export": l.Export} {
+		if !vec3IsUnit(q.Facing) || !vec3IsUnit(q.Dir) || !vec3IsUnit(q.StationQ0) || !vec3IsUnit(q.Q0T0) {
+			return fmt.Errorf("%v queue directions must be unit vectors", name)
+		}
+	}
+	return nil
+}
+
+func (l storageLayout) nBoxesPerPlane() int {
+	switch l.Shape {
+	case layoutWall:
+		return l.Length
+	case layoutCorridor:
+		return l.Length * 2
+	default:
+		return l.XLen*2 + l.ZLen*2
+	}
+}
+
+func (l storageLayout) nBoxes() int {
+	return l.nBoxesPerPlane() * l.Rows
+}
+
+// Returns the position of a box relative to the area position and the
+// direction to load it from.
+func (l storageLayout) boxOrient(id int) boxOrient {
+	if l.Shape == layoutRing {
+		return l.ringBoxOrient(id)
+	}
+	pp := l.nBoxesPerPlane()
+	plane_id, plane_offs := id/pp, id%pp
+	load_dir := l.Facing
+	if plane_offs >= l.Length {
+		// Opposite side of a corridor.
+		load_dir = vec3Scale(l.Facing, -1)
+	}
+	load_pos := vec3Add(vec3Scale(l.Lane, plane_offs%l.Length), vec3{0, -plane_id, 0})
+	return boxOrient{
+		boxPos:  vec3Add(load_pos, load_dir),
+		loadDir: load_dir,
+	}
+}
+
+func (l storageLayout) ringBoxOrient(id int) boxOrient {
+	out := boxOrient{}
+	pp := l.nBoxesPerPlane()
+	out.boxPos[1] = -id/pp - 2
+	plane_id := id % pp
+	if plane_id < l.XLen*2 {
+		out.boxPos[0] = -l.XLen + (plane_id % l.XLen)
+		if plane_id < l.XLen {
+			out.boxPos[2] = -l.ZLen - 1
+			out.loadDir = vec3{0, 0, -1}
+		} else {
+			out.boxPos[2] = 0
+			out.loadDir = vec3{0, 0, 1}
+		}
+	} else {
+		z_id := (plane_id - l.XLen*2)
+		out.boxPos[2] = -l.ZLen + (z_id % l.ZLen)
+		if z_id < l.ZLen {
+			out.boxPos[0] = -l.XLen - 1
+			out.loadDir = vec3{-1, 0, 0}
+		} else {
+			out.boxPos[0] = 0
+			out.loadDir = vec3{1, 0, 0}
+		}
+	}
+	return out
+}
+
+// Returns the queue coordinates of a queue layout for an area at pos.
+func (q queueLayout) coords(pos vec3) qCoords {
+	return qCoords{
+		face_dir:  q.Facing,
+		origin:    vec3Add(pos, q.Station),
+		q_dir:     q.Dir,
+		o_q0_dir:  q.StationQ0,
+		q0_t0_dir: q.Q0T0,
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLayoutValidate(t *testing.T) {
+	corridor := func() storageLayout {
+		l := ringLayout(4, 4, 2)
+		l.Shape, l.XLen, l.ZLen, l.Length = layoutCorridor, 0, 0, 10
+		l.Lane, l.Facing, l.Holes = vec3{1, 0, 0}, vec3{0, 0, -1}, nil
+		return l
+	}
+	tests := []struct {
+		name   string
+		layout func() storageLayout
+		want   string
+	}{
+		{"ring", func() storageLayout { return ringLayout(4, 4, 2) }, ""},
+		{"corridor", corridor, ""},
+		{"no rows", func() storageLayout { return ringLayout(4, 4, 0) }, "invalid layout rows"},
+		{"empty ring", func() storageLayout { return ringLayout(0, 4, 2) }, "invalid ring size"},
+		{"bad shape", func() storageLayout {
+			l := ringLayout(4, 4, 2)
+			l.Shape = "spiral"
+			return l
+		}, "invalid layout shape"},
+		{"hole outside", func() storageLayout {
+			l := ringLayout(4, 4, 2)
+			l.Holes = append(l.Holes, 32)
+			return l
+		}, "invalid layout hole"},
+		{"no length", func() storageLayout {
+			l := corridor()
+			l.Length = 0
+			return l
+		}, "invalid layout length"},
+		{"parallel lane", func() storageLayout {
+			l := corridor()
+			l.Facing = vec3{-1, 0, 0}
+			return l
+		}, "perpendicular"},
+		{"vertical lane", func() storageLayout {
+			l := corridor()
+			l.Lane = vec3{0, -1, 0}
+			return l
+		}, "horizontal"},
+		{"queue direction", func() storageLayout {
+			l := corridor()
+			l.Export.Dir = vec3{1, 1, 0}
+			return l
+		}, "export queue directions"},
+	}
+	for _, test := range tests {
+		err := test.layout().validate()
+		if test.want == "" && err != nil {
+			t.Errorf("%v: got error %v", test.name, err)
+		} else if test.want != "" && (err == nil || !strings.Contains(err.Error(), test.want)) {
+			t.Errorf("%v: got error %v, want %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestLayoutBoxOrient(t *testing.T) {
+	ring := ringLayout(4, 3, 2)
+	corridor := storageLayout{Shape: layoutCorridor, Length: 10, Rows: 2, Lane: vec3{1, 0, 0}, Facing: vec3{0, 0, -1}}
+	wall := storageLayout{Shape: layoutWall, Length: 5, Rows: 3, Lane: vec3{0, 0, 1}, Facing: vec3{1, 0, 0}}
+	if n := ring.nBoxes(); n != 28 {
+		t.Errorf("ring boxes: got %v, want 28", n)
+	}
+	if n := corridor.nBoxes(); n != 40 {
+		t.Errorf("corridor boxes: got %v, want 40", n)
+	}
+	if n := wall.nBoxes(); n != 15 {
+		t.Errorf("wall boxes: got %v, want 15", n)
+	}
+	tests := []struct {
+		name   string
+		layout storageLayout
+		id     int
+		want   boxOrient
+	}{
+		{"ring first", ring, 0, boxOrient{boxPos: vec3{-4, -2, -4}, loadDir: vec3{0, 0, -1}}},
+		{"ring south", ring, 5, boxOrient{boxPos: vec3{-3, -2, 0}, loadDir: vec3{0, 0, 1}}},
+		{"ring west", ring, 8, boxOrient{boxPos: vec3{-5, -2, -3}, loadDir: vec3{-1, 0, 0}}},
+		{"ring east lower", ring, 14 + 13, boxOrient{boxPos: vec3{0, -3, -1}, loadDir: vec3{1, 0, 0}}},
+		{"corridor facing", corridor, 3, boxOrient{boxPos: vec3{3, 0, -1}, loadDir: vec3{0, 0, -1}}},
+		{"corridor opposite", corridor, 13, boxOrient{boxPos: vec3{3, 0, 1}, loadDir: vec3{0, 0, 1}}},
+		{"corridor lower", corridor, 20, boxOrient{boxPos: vec3{0, -1, -1}, loadDir: vec3{0, 0, -1}}},
+		{"wall lower", wall, 12, boxOrient{boxPos: vec3{1, -2, 2}, loadDir: vec3{1, 0, 0}}},
+	}
+	for _, test := range tests {
+		if got := test.layout.boxOrient(test.id); got != test.want {
+			t.Errorf("%v: box %v: got %+v, want %+v", test.name, test.id, got, test.want)
+		}
+	}
+}
+
+func TestLayoutHoles(t *testing.T) {
+	err := simBootServer(simStateDir(t, map[string]string{
+		"storage.0/details": `{"ID": "storage.0", "Pos": [50, 121, 822], "layout": {"shape": "wall", "length": 4, "rows": 1,
+			"lane": [1, 0, 0], "facing": [0, 0, -1], "holes": [2],
+			"import": {"station": [-1, 0, 0], "facing": [0, 1, 0], "dir": [-1, 0, 0], "station_q0": [-1, 0, 0], "q0_t0": [0, 0, 1]},
+			"export": {"station": [4, 0, 0], "facing": [0, 1, 0], "dir": [1, 0, 0], "station_q0": [1, 0, 0], "q0_t0": [0, 0, 1]}}}`,
+		"storage.0/plane.0": `[{"Amount": 64, "Name": "minecraft:cobblestone/0"}, {}, {"Amount": 5, "Name": "minecraft:dirt/0"}]`,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := areas["storage.0"].(*storageArea)
+	want := []storageBox{{Amount: 64, Name: "minecraft:cobblestone/0"}, {}, {Amount: -1}, {}}
+	if len(s.Boxes) != len(want) {
+		t.Fatalf("got boxes %v, want %v", s.Boxes, want)
+	}
+	for i, box := range want {
+		if s.Boxes[i] != box {
+			t.Errorf("box %v: got %+v, want %+v", i, s.Boxes[i], box)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+// Storage ledger. Every box delta, export drop, rejected import and supply
+// delivery is appended as a JSON line to "ledger" in the area directory.
+// Entries are collected while deciding work and appended after the area
+// state is committed, so the ledger never records changes that were not
+// stored.
+//
+//  GET <root_key>/storage/<id>/ledger  ledger entries, oldest first
+//
+// The ledger query takes the item filters of the other storage queries and
+// optional "turtle", "since" and "until" (RFC3339 times) and "limit" (only
+// the newest entries, defaults to 1000).
+
+const (
+	// box delta of a load order
+	ledgerLoad = "load"
+	// box correction of an audit
+	ledgerAudit = "audit"
+	// items sucked from the import chest
+	ledgerImport = "import"
+	// items dropped in the export chest
+	ledgerExport = "export"
+	// imported items refused by a reject routing rule and dropped in the
+	// export chest
+	ledgerReject = "reject"
+	// items dropped in the supply box of another area
+	ledgerDelivery = "delivery"
+)
+
+const (
+	ledgerFileName     = "ledger"
+	ledgerDefaultLimit = 1000
+)
+
+type ledgerEntry struct {
+	Time   string   `json:"time"`
+	Kind   string   `json:"kind"`
+	Turtle turtleID `json:"turtle"`
+	WorkID workID   `json:"work_id"`
+	ItemID itemID   `json:"item_id"`
+	// change of the box contents, or number of items moved for entries
+	// without a box
+	Amount int `json:"amount"`
+	// -1 for entries without a box
+	BoxID int `json:"box_id"`
+}
+
+func (s storageArea) ledgerPath() string {
+	return path.Join(path.Dir(s.Path), ledgerFileName)
+}
+
+// Adds an entry that is appended to the ledger by the next store.
+func (s *storageArea) record(kind string, label turtleID, work_id workID, item_id itemID, amount int, box_id int) {
+	if amount == 0 {
+		return
+	}
+	s.pendingLedger = append(s.pendingLedger, ledgerEntry{
+		Time:   time.Now().UTC().Format(time.RFC3339),
+		Kind:   kind,
+		Turtle: label,
+		WorkID: work_id,
+		ItemID: item_id,
+		Amount: amount,
+		BoxID:  box_id,
+	})
+}
+
+// Appends the pending entries to the ledger. A failed append is truncated
+// away so the entries are written once by the next flush.
+func (s *storageArea) flushLedger() error {
+	if len(s.pendingLedger) == 0 {
+		return nil
+	}
+	f, err := os.OpenFile(s.ledgerPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := writeLedgerEntries(f, s.pendingLedger); err != nil {
+		if trunc_err := f.Truncate(size); trunc_err != nil {
+			log.Printf("storage ledger error: %v: truncating failed append: %v", s.ID, trunc_err)
+		}
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	s.pendingLedger = nil
+	return nil
+}
+
+// Writes ledger entries as JSON lines and syncs them to disk.
+func writeLedgerEntries(f *os.File, entries []ledgerEntry) error {
+	w := bufio.NewWriter(f)
+	for _, entry := range entries {
+		raw, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		w.Write(raw)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// Records items a turtle sucked from the import chest since its last
+// report. The inventory of every report is remembered for this.
+func (s *storageArea) recordImports(t turtle) {
+	last, ok := s.lastInv[t.Label]
+	if ok && t.CurWork != nil && t.CurWork.ID == workIDInvImpSuck {
+		for item_id, count := range t.InvCount.Grouped {
+			if n_delta := count - last[item_id]; n_delta > 0 {
+				s.record(ledgerImport, t.Label, workIDInvImpSuck, item_id, n_delta, -1)
+			}
+		}
+	}
+	inv := map[itemID]int{}
+	for item_id, count := range t.InvCount.Grouped {
+		inv[item_id] = count
+	}
+	s.lastInv[t.Label] = inv
+}
+
+type ledgerFilter struct {
+	itemFilter
+	turtle turtleID
+	since  time.Time
+	until  time.Time
+	limit  int
+}
+
+func parseLedgerFilter(r *http.Request) (ledgerFilter, error) {
+	q := r.URL.Query()
+	filter := ledgerFilter{
+		itemFilter: parseItemFilter(r),
+		turtle:     turtleID(q.Get("turtle")),
+		limit:      ledgerDefaultLimit,
+	}
+	var err error
+	if v := q.Get("since"); v != "" {
+		if filter.since, err = time.Parse(time.RFC3339, v); err != nil {
+			return filter, errBadRequest("invalid since: %v", err)
+		}
+	}
+	if v := q.Get("until"); v != "" {
+		if filter.until, err = time.Parse(time.RFC3339, v); err != nil {
+			return filter, errBadRequest("invalid until: %v", err)
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if filter.limit, err = strconv.Atoi(v); err != nil || filter.limit <= 0 {
+			return filter, errBadRequest("invalid limit: %v", v)
+		}
+	}
+	return filter, nil
+}
+
+func (f ledgerFilter) match(entry ledgerEntry) bool {
+	if !f.itemFilter.match(entry.ItemID) || (f.turtle != "" && entry.Turtle != f.turtle) {
+		return false
+	}
+	if f.since.IsZero() && f.until.IsZero() {
+		return true
+	}
+	entry_time, err := time.Parse(time.RFC3339, entry.Time)
+	if err != nil {
+		return false
+	}
+	return !entry_time.Before(f.since) && (f.until.IsZero() || entry_time.Before(f.until))
+}
+
+// Reads the ledger entries matching a filter. The ledger is appended to by
+// the work manager while it is read, a partially written last line is
+// skipped.
+func queryLedger(ledger_path string, filter ledgerFilter) ([]ledgerEntry, error) {
+	rsp := []ledgerEntry{}
+	f, err := os.Open(ledger_path)
+	if os.IsNotExist(err) {
+		return rsp, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry ledgerEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		if !filter.match(entry) {
+			continue
+		}
+		rsp = append(rsp, entry)
+		if len(rsp) > 2*filter.limit {
+			// Only the newest entries are returned.
+			rsp = append(rsp[:0], rsp[len(rsp)-filter.limit:]...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(rsp) > filter.limit {
+		rsp = rsp[len(rsp)-filter.limit:]
+	}
+	return rsp, nil
+}
+
+func handleStorageLedger(w http.ResponseWriter, r *http.Request, area_id areaID) {
+	filter, err := parseLedgerFilter(r)
+	if err != nil {
+		writeRspError(w, err)
+		return
+	}
+	var ledger_path string
+	err = mgrCall(func() error {
+		s, ok := areas[area_id].(*storageArea)
+		if !ok {
+			return errNotFound("invalid storage area id: %v", area_id)
+		}
+		ledger_path = s.ledgerPath()
+		return nil
+	})
+	var rsp []ledgerEntry
+	if err == nil {
+		// The ledger is read outside of the work manager, it may be large.
+		rsp, err = queryLedger(ledger_path, filter)
+	}
+	if err != nil {
+		log.Printf("storage ledger query %v failed: %v\n", r.URL.Path, err)
+		writeRspError(w, err)
+		return
+	}
+	writeRspJSON(w, rsp)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestLedgerAppend(t *testing.T) {
+	const label = turtleID("storage.0.1")
+	s := bootCobbleStorage(t)
+	err := mgrCall(func() error {
+		s.record(ledgerLoad, label, 1, "minecraft:cobblestone/0", 10, 0)
+		s.record(ledgerLoad, label, 1, "minecraft:dirt/0", 0, 1)
+		if err := s.store(); err != nil {
+			return err
+		}
+		// Later entries are appended.
+		s.record(ledgerExport, "storage.0.2", 2, "minecraft:dirt/0", 5, ExportVBoxID)
+		s.record(ledgerDelivery, label, 3, "minecraft:coal/0", 8, -1)
+		return s.store()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.pendingLedger) != 0 {
+		t.Errorf("pending entries after store: %v", s.pendingLedger)
+	}
+	// A partially written line is skipped.
+	f, err := os.OpenFile(s.ledgerPath(), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"time": "2026-`)
+	f.Close()
+	tests := []struct {
+		name   string
+		filter ledgerFilter
+		want   []string
+	}{
+		{"all", ledgerFilter{limit: ledgerDefaultLimit}, []string{ledgerLoad, ledgerExport, ledgerDelivery}},
+		{"newest", ledgerFilter{limit: 2}, []string{ledgerExport, ledgerDelivery}},
+		{"turtle", ledgerFilter{turtle: label, limit: ledgerDefaultLimit}, []string{ledgerLoad, ledgerDelivery}},
+		{"item", ledgerFilter{itemFilter: itemFilter{item: "minecraft:dirt/0"}, limit: ledgerDefaultLimit}, []string{ledgerExport}},
+	}
+	for _, test := range tests {
+		entries, err := queryLedger(s.ledgerPath(), test.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, entry := range entries {
+			got = append(got, entry.Kind)
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%v: got entries %v, want %v", test.name, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%v: got entries %v, want %v", test.name, got, test.want)
+				break
+			}
+		}
+	}
+	if entries, err := queryLedger(path.Join(t.TempDir(), ledgerFileName), ledgerFilter{limit: 1}); err != nil || len(entries) != 0 {
+		t.Errorf("missing ledger: got %v, %v", entries, err)
+	}
+}
+
+func TestLedgerFlushError(t *testing.T) {
+	const label = turtleID("storage.0.1")
+	s := bootCobbleStorage(t)
+	ledger_path := s.ledgerPath()
+	flush := func(amount int) error {
+		return mgrCall(func() error {
+			s.record(ledgerLoad, label, 1, "minecraft:cobblestone/0", amount, 0)
+			return s.flushLedger()
+		})
+	}
+	if err := flush(10); err != nil {
+		t.Fatal(err)
+	}
+	// Appending to a full disk fails and keeps the entries pending.
+	if err := os.Rename(ledger_path, ledger_path+".moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/dev/full", ledger_path); err != nil {
+		t.Fatal(err)
+	}
+	if err := flush(5); err == nil {
+		t.Errorf("flush to a full disk succeeded")
+	}
+	if len(s.pendingLedger) != 1 {
+		t.Errorf("pending entries after failed flush: %v, want one", s.pendingLedger)
+	}
+	if err := os.Remove(ledger_path); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(ledger_path+".moved", ledger_path); err != nil {
+		t.Fatal(err)
+	}
+	// The next flush writes the pending entries once.
+	if err := flush(3); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := queryLedger(ledger_path, ledgerFilter{limit: ledgerDefaultLimit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []int
+	for _, entry := range entries {
+		got = append(got, entry.Amount)
+	}
+	if len(got) != 3 || got[0] != 10 || got[1] != 5 || got[2] != 3 {
+		t.Errorf("ledger amounts %v, want [10 5 3]", got)
+	}
+}
+
+func TestRecordImports(t *testing.T) {
+	const label = turtleID("storage.0.1")
+	s := &storageArea{lastInv: map[turtleID]map[itemID]int{}}
+	suck := &work{ID: workIDInvImpSuck, Type: "suck"}
+	// The first report is remembered only.
+	s.recordImports(turtle{Label: label, CurWork: suck, InvCount: icount{Grouped: map[itemID]int{"minecraft:dirt/0": 3}}})
+	s.recordImports(turtle{Label: label, CurWork: suck, InvCount: icount{Grouped: map[itemID]int{"minecraft:dirt/0": 10, "minecraft:sand/0": 4}}})
+	// Inventory changes of other work are not imports.
+	s.recordImports(turtle{Label: label, CurWork: &work{ID: 7, Type: "drop"}, InvCount: icount{Grouped: map[itemID]int{}}})
+	s.recordImports(turtle{Label: label, CurWork: suck, InvCount: icount{Grouped: map[itemID]int{"minecraft:sand/0": 1}}})
+	got := map[itemID]int{}
+	for _, entry := range s.pendingLedger {
+		if entry.Kind != ledgerImport || entry.Turtle != label {
+			t.Errorf("unexpected entry %+v", entry)
+		}
+		got[entry.ItemID] += entry.Amount
+	}
+	if len(got) != 2 || got["minecraft:dirt/0"] != 7 || got["minecraft:sand/0"] != 5 {
+		t.Errorf("got imports %v, want 7 dirt and 5 sand", got)
+	}
+}
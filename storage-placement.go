@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"time"
+)
+
+// Access-frequency placement. Every export order and supply delivery of an
+// item raises its export score by one, and scores halve every half_life
+// hours. Items with a score of at least hot are hot: new boxes for them are
+// taken closest to the export station instead of closest to the turtle.
+// Turtles without anything else to do rebalance storage by moving cold items
+// from boxes close to the export station to free boxes that are at least
+// min_gain blocks further away, which frees the close boxes for hot items.
+// The policy is edited with the "placement" area field.
+
+// Placement policy of a storage area. Zero values are replaced by defaults
+// on load.
+type placementPolicy struct {
+	// hours until an export score halves
+	HalfLife float64 `json:"half_life"`
+	// export score from which an item is hot
+	Hot float64 `json:"hot"`
+	// minimum distance a cold box is moved away from the export station,
+	// negative to disable rebalancing
+	MinGain int `json:"min_gain"`
+}
+
+func (p *placementPolicy) init() {
+	if p.HalfLife == 0 {
+		p.HalfLife = 7 * 24
+	}
+	if p.Hot == 0 {
+		p.Hot = 3
+	}
+	if p.MinGain == 0 {
+		p.MinGain = 4
+	}
+}
+
+func (p placementPolicy) validate() error {
+	if p.HalfLife <= 0 || p.Hot <= 0 {
+		return errBadRequest("invalid placement half_life %v and hot %v", p.HalfLife, p.Hot)
+	}
+	return nil
+}
+
+// Decodes an edited placement policy. Fields that are not given keep their
+// current value.
+func (p *placementPolicy) edit(raw json.RawMessage) error {
+	edited := *p
+	if err := json.Unmarshal(raw, &edited); err != nil {
+		return errBadRequest("invalid placement: %v", err)
+	}
+	edited.init()
+	if err := edited.validate(); err != nil {
+		return err
+	}
+	*p = edited
+	return nil
+}
+
+// Decayed export score of an item.
+type exportScore struct {
+	Score float64
+	// time the score was last decayed
+	Updated string
+}
+
+// Returns the export score decayed to now.
+func (e exportScore) at(now time.Time, half_life float64) float64 {
+	updated, err := time.Parse(time.RFC3339, e.Updated)
+	if err != nil {
+		return e.Score
+	}
+	hours := now.Sub(updated).Hours()
+	if hours <= 0 {
+		return e.Score
+	}
+	return e.Score * math.Pow(0.5, hours/half_life)
+}
+
+// Records an export of an item.
+func (s *storageArea) recordExport(item_id itemID) {
+	now := time.Now().UTC()
+	score := 0.0
+	if e := s.ExportScores[item_id]; e != nil {
+		score = e.at(now, s.Placement.HalfLife)
+	}
+	s.ExportScores[item_id] = &exportScore{
+		Score:   score + 1,
+		Updated: now.Format(time.RFC3339),
+	}
+}
+
+// Removes scores that decayed to nothing.
+func (s *storageArea) pruneExportScores() {
+	now := time.Now()
+	for item_id, e := range s.ExportScores {
+		if e.at(now, s.Placement.HalfLife) < 0.01 {
+			delete(s.ExportScores, item_id)
+		}
+	}
+}
+
+func (s storageArea) isHot(item_id itemID) bool {
+	e := s.ExportScores[item_id]
+	return e != nil && e.at(time.Now(), s.Placement.HalfLife) >= s.Placement.Hot
+}
+
+// Returns the distance of a box from the export station.
+func (s storageArea) exportDist(box_id int) int {
+	return vec3L1Dist(s.getExportQ().origin, s.getBoxOrient(box_id).loadPos())
+}
+
+type rebalanceOrder struct {
+	BoxID  int    `json:"box_id"`
+	ItemID itemID `json:"item_id"`
+	Count  int
+	// free box the items are moved to
+	TargetID int `json:"target_id"`
+	// true when the items were sucked and are being dropped
+	Fetched bool
+}
+
+// Returns the set of boxes that are being rebalanced, both sources and
+// targets. Other turtles drop nothing into these boxes.
+func (s storageArea) rebalanceBoxes() map[int]bool {
+	boxes := map[int]bool{}
+	for _, r := range s.Rebalances {
+		boxes[r.BoxID] = true
+		boxes[r.TargetID] = true
+	}
+	return boxes
+}
+
+// Selects a cold box for a turtle to move further away from the export
+// station and the free box to move it to. Returns nil if nothing should be
+// rebalanced.
+func (s storageArea) rebalanceCandidate(t turtle) *rebalanceOrder {
+	if s.Placement.MinGain < 0 {
+		return nil
+	}
+	// Boxes that are being loaded, reserved, audited, defragmented or
+	// visited by pickup trips are left alone.
+	busy := s.rebalanceBoxes()
+	for box_id := range s.tripBoxes() {
+		busy[box_id] = true
+	}
+	for _, lo := range s.LoadOrders {
+		busy[lo.BoxID] = true
+	}
+	for box_id := range s.reservedLoads(t.Label) {
+		busy[box_id] = true
+	}
+	for box_id := range s.auditBoxes() {
+		busy[box_id] = true
+	}
+	for box_id := range s.defragSources() {
+		busy[box_id] = true
+	}
+	// Free boxes, furthest from the export station first.
+	dists := make([]int, len(s.Boxes))
+	var free []int
+	for id, box := range s.Boxes {
+		dists[id] = s.exportDist(id)
+		if box.Amount == 0 && box.Name == "" && !busy[id] {
+			free = append(free, id)
+		}
+	}
+	sort.Slice(free, func(i, j int) bool {
+		return dists[free[i]] > dists[free[j]]
+	})
+	hot := map[itemID]bool{}
+	var r *rebalanceOrder
+	best_gain := 0
+	for id, box := range s.Boxes {
+		if box.Amount <= 0 || busy[id] || s.Exporting[box.Name] > 0 {
+			continue
+		}
+		if _, ok := hot[box.Name]; !ok {
+			hot[box.Name] = s.isHot(box.Name)
+		}
+		if hot[box.Name] {
+			continue
+		}
+		if box.Amount > t.InvCount.FreeSlots*itemMaxStack(box.Name) {
+			// The turtle cannot carry the box.
+			continue
+		}
+		for _, target_id := range free {
+			gain := dists[target_id] - dists[id]
+			if gain < s.Placement.MinGain || gain <= best_gain {
+				break
+			}
+			if s.routeAllows(box.Name, target_id) {
+				r = &rebalanceOrder{BoxID: id, ItemID: box.Name, Count: box.Amount, TargetID: target_id}
+				best_gain = gain
+				break
+			}
+		}
+	}
+	return r
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExportScore(t *testing.T) {
+	const item_id = itemID("minecraft:cobblestone/0")
+	s := &storageArea{ExportScores: map[itemID]*exportScore{}}
+	s.Placement.init()
+	// Scores decay from the moment they are recorded, so a fourth export
+	// keeps the item above the hot score of 3.
+	for i := 0; i < 4; i++ {
+		s.recordExport(item_id)
+	}
+	if !s.isHot(item_id) {
+		t.Errorf("%v not hot after 4 exports", item_id)
+	}
+	// Half the score is left after the half life.
+	updated := time.Now().Add(-time.Duration(s.Placement.HalfLife) * time.Hour)
+	s.ExportScores[item_id].Updated = updated.UTC().Format(time.RFC3339)
+	if score := s.ExportScores[item_id].at(time.Now(), s.Placement.HalfLife); score < 1.99 || score > 2.01 {
+		t.Errorf("score after half life: got %v, want 2", score)
+	}
+	if s.isHot(item_id) {
+		t.Errorf("%v still hot after half life", item_id)
+	}
+	s.recordExport(item_id)
+	if score := s.ExportScores[item_id].Score; score < 2.99 || score > 3.01 {
+		t.Errorf("score after another export: got %v, want 3", score)
+	}
+	// Scores that decayed to nothing are pruned.
+	updated = time.Now().Add(-time.Duration(s.Placement.HalfLife*10) * time.Hour)
+	s.ExportScores[item_id].Updated = updated.UTC().Format(time.RFC3339)
+	s.pruneExportScores()
+	if len(s.ExportScores) != 0 {
+		t.Errorf("scores left after pruning: %v", s.ExportScores)
+	}
+}
+
+func TestRebalanceCandidate(t *testing.T) {
+	const item_id = itemID("minecraft:cobblestone/0")
+	tests := []struct {
+		name      string
+		hot       bool
+		min_gain  int
+		exporting bool
+		want      bool
+	}{
+		{"cold", false, 0, false, true},
+		{"hot", true, 0, false, false},
+		{"disabled", false, -1, false, false},
+		{"exporting", false, 0, true, false},
+	}
+	for _, test := range tests {
+		s := bootCobbleStorage(t)
+		// Box 7 is next to the export station.
+		s.Boxes[0], s.Boxes[7] = storageBox{}, s.Boxes[0]
+		if test.min_gain != 0 {
+			s.Placement.MinGain = test.min_gain
+		}
+		if test.hot {
+			s.ExportScores[item_id] = &exportScore{Score: s.Placement.Hot + 1, Updated: time.Now().UTC().Format(time.RFC3339)}
+		}
+		if test.exporting {
+			s.Exporting[item_id] = 1
+		}
+		r := s.rebalanceCandidate(turtle{Label: "storage.0.1", CurPos: s.Pos, InvCount: icount{FreeSlots: 16}})
+		if (r != nil) != test.want {
+			t.Errorf("%v: got rebalance %+v, want one: %v", test.name, r, test.want)
+			continue
+		}
+		if r == nil {
+			continue
+		}
+		// The box is moved to the free box furthest from the export station.
+		max_dist := 0
+		for id, box := range s.Boxes {
+			if box.Amount == 0 && s.exportDist(id) > max_dist {
+				max_dist = s.exportDist(id)
+			}
+		}
+		if r.BoxID != 7 || r.ItemID != item_id || r.Count != 64 || s.exportDist(r.TargetID) != max_dist {
+			t.Errorf("%v: got rebalance %+v to distance %v, want box 7 to distance %v", test.name, *r, s.exportDist(r.TargetID), max_dist)
+		}
+	}
+}
+
+func TestHotPlacement(t *testing.T) {
+	const item_id = itemID("minecraft:dirt/0")
+	s := bootCobbleStorage(t)
+	// The turtle is furthest from the export station.
+	far_id := 0
+	for id := range s.Boxes {
+		if s.exportDist(id) > s.exportDist(far_id) {
+			far_id = id
+		}
+	}
+	pos := s.getBoxOrient(far_id).loadPos()
+	if cand := s.closestBox("storage.0.1", pos, item_id, true); cand == nil || s.Boxes[cand.id].Amount != 0 || cand.dist != 0 {
+		t.Errorf("cold item: got box %+v, want the free box at the turtle", cand)
+	}
+	s.ExportScores[item_id] = &exportScore{Score: s.Placement.Hot + 1, Updated: time.Now().UTC().Format(time.RFC3339)}
+	min_dist := -1
+	for id, box := range s.Boxes {
+		if box.Amount == 0 && (min_dist < 0 || s.exportDist(id) < min_dist) {
+			min_dist = s.exportDist(id)
+		}
+	}
+	if cand := s.closestBox("storage.0.1", pos, item_id, true); cand == nil || s.exportDist(cand.id) != min_dist {
+		t.Errorf("hot item: got box %+v, want a free box at export distance %v", cand, min_dist)
+	}
+}
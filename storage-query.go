@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Storage inventory query API. Aggregation is done in the work manager
+// goroutine on the current storage state.
+//
+//  GET <root_key>/storage/<id>/items   per-item totals
+//  GET <root_key>/storage/<id>/boxes   boxes holding items
+//  GET <root_key>/storage/<id>/free    free box counts
+//  GET <root_key>/storage/<id>/planes  per-plane fill
+//
+// The items and boxes queries take optional filters: "item" (exact item
+// id), "prefix" (item id prefix) and "name" (case insensitive part of the
+// display name).
+
+// Map from item id to display name, from the item map in the web root.
+var item_display_names = map[itemID]string{}
+
+// Loads the item map if it exists. Must be called before serving requests.
+func loadItemMap(fs_path string) error {
+	raw, err := ioutil.ReadFile(fs_path)
+	if os.IsNotExist(err) {
+		log.Printf("no item map at %v, display names unavailable\n", fs_path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(raw, &item_display_names); err != nil {
+		return fmt.Errorf("decoding %v failed: %v", fs_path, err)
+	}
+	return nil
+}
+
+// Returns the display name of an item. Items with unknown metadata fall back
+// to the name of metadata 0.
+func itemDisplayName(item_id itemID) string {
+	if name, ok := item_display_names[item_id]; ok {
+		return name
+	}
+	name := string(item_id)
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		return item_display_names[itemID(name[:i]+"/0")]
+	}
+	return ""
+}
+
+type itemFilter struct {
+	item   itemID
+	prefix string
+	name   string
+}
+
+func parseItemFilter(r *http.Request) itemFilter {
+	q := r.URL.Query()
+	return itemFilter{
+		item:   itemID(q.Get("item")),
+		prefix: q.Get("prefix"),
+		name:   strings.ToLower(q.Get("name")),
+	}
+}
+
+func (f itemFilter) match(item_id itemID) bool {
+	if f.item != "" && item_id != f.item {
+		return false
+	}
+	if f.prefix != "" && !strings.HasPrefix(string(item_id), f.prefix) {
+		return false
+	}
+	if f.name != "" && !strings.Contains(strings.ToLower(itemDisplayName(item_id)), f.name) {
+		return false
+	}
+	return true
+}
+
+type storageItemTotal struct {
+	ItemID      itemID `json:"item_id"`
+	DisplayName string `json:"display_name"`
+	Count       int    `json:"count"`
+	Boxes       int    `json:"boxes"`
+	// items requested for export but not allocated to a turtle yet
+	Exporting int `json:"exporting"`
+}
+
+type storageBoxInfo struct {
+	BoxID  int    `json:"box_id"`
+	Plane  int    `json:"plane"`
+	Pos    vec3   `json:"pos"`
+	ItemID itemID `json:"item_id"`
+	Amount int    `json:"amount"`
+}
+
+type storageFreeInfo struct {
+	Free  int `json:"free"`
+	Used  int `json:"used"`
+	Holes int `json:"holes"`
+}
+
+type storagePlaneInfo struct {
+	Plane    int `json:"plane"`
+	Free     int `json:"free"`
+	Used     int `json:"used"`
+	Items    int `json:"items"`
+	Capacity int `json:"capacity"`
+	// items / capacity
+	Fill float64 `json:"fill"`
+}
+
+func handleStorageQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeRspError(w, &reqError{http.StatusMethodNotAllowed, "method not allowed"})
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, root_key+"/storage/"), "/")
+	if len(parts) != 2 {
+		writeRspNotFound(w)
+		return
+	}
+	area_id, query := areaID(parts[0]), parts[1]
+	if query == "ledger" {
+		handleStorageLedger(w, r, area_id)
+		return
+	}
+	filter := parseItemFilter(r)
+	var rsp interface{}
+	err := mgrCall(func() error {
+		s, ok := areas[area_id].(*storageArea)
+		if !ok {
+			return errNotFound("invalid storage area id: %v", area_id)
+		}
+		switch query {
+		case "items":
+			rsp = s.queryItems(filter)
+		case "boxes":
+			rsp = s.queryBoxes(filter)
+		case "free":
+			rsp = s.queryFree()
+		case "planes":
+			rsp = s.queryPlanes()
+		default:
+			return errNotFound("invalid storage query: %v", query)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("storage query %v failed: %v\n", r.URL.Path, err)
+		writeRspError(w, err)
+		return
+	}
+	writeRspJSON(w, rsp)
+}
+
+func (s storageArea) queryItems(filter itemFilter) []storageItemTotal {
+	totals := map[itemID]*storageItemTotal{}
+	getTotal := func(item_id itemID) *storageItemTotal {
+		total := totals[item_id]
+		if total == nil {
+			total = &storageItemTotal{
+				ItemID:      item_id,
+				DisplayName: itemDisplayName(item_id),
+			}
+			totals[item_id] = total
+		}
+		return total
+	}
+	for _, box := range s.Boxes {
+		if box.Amount <= 0 || !filter.match(box.Name) {
+			continue
+		}
+		total := getTotal(box.Name)
+		total.Count += box.Amount
+		total.Boxes++
+	}
+	for item_id, n_exporting := range s.Exporting {
+		if filter.match(item_id) {
+			getTotal(item_id).Exporting = n_exporting
+		}
+	}
+	rsp := []storageItemTotal{}
+	for _, total := range totals {
+		rsp = append(rsp, *total)
+	}
+	sort.Slice(rsp, func(i, j int) bool {
+		return rsp[i].ItemID < rsp[j].ItemID
+	})
+	return rsp
+}
+
+func (s storageArea) queryBoxes(filter itemFilter) []storageBoxInfo {
+	rsp := []storageBoxInfo{}
+	for id, box := range s.Boxes {
+		if box.Amount <= 0 || !filter.match(box.Name) {
+			continue
+		}
+		rsp = append(rsp, storageBoxInfo{
+			BoxID:  id,
+			Plane:  id / s.nBoxesPerPlane(),
+			Pos:    s.getBoxOrient(id).boxPos,
+			ItemID: box.Name,
+			Amount: box.Amount,
+		})
+	}
+	return rsp
+}
+
+func (s storageArea) queryFree() storageFreeInfo {
+	var rsp storageFreeInfo
+	for _, box := range s.Boxes {
+		switch {
+		case box.Amount < 0:
+			rsp.Holes++
+		case box.Amount == 0:
+			rsp.Free++
+		default:
+			rsp.Used++
+		}
+	}
+	return rsp
+}
+
+func (s storageArea) queryPlanes() []storagePlaneInfo {
+	n_pp := s.nBoxesPerPlane()
+	rsp := make([]storagePlaneInfo, s.Layout.Rows)
+	for plane_id := range rsp {
+		plane := &rsp[plane_id]
+		plane.Plane = plane_id
+		for _, box := range s.Boxes[n_pp*plane_id : n_pp*(plane_id+1)] {
+			if box.Amount < 0 {
+				continue
+			}
+			plane.Capacity += s.boxCapacity(box.Name)
+			if box.Amount == 0 {
+				plane.Free++
+			} else {
+				plane.Used++
+				plane.Items += box.Amount
+			}
+		}
+		if plane.Capacity > 0 {
+			plane.Fill = float64(plane.Items) / float64(plane.Capacity)
+		}
+	}
+	return rsp
+}
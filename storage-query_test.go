@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// Sends a storage query and decodes the response into rsp.
+func storageQuery(t *testing.T, url_path string, rsp interface{}) {
+	r := httptest.NewRequest(http.MethodGet, root_key+url_path, nil)
+	w := httptest.NewRecorder()
+	handleStorageQuery(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("%v: got status %v (%v)", url_path, w.Code, w.Body.String())
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), rsp); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStorageQuery(t *testing.T) {
+	err := simBootServer(simStateDir(t, map[string]string{
+		"storage.0/details": `{"ID": "storage.0", "Pos": [50, 121, 822], "XLen": 4, "ZLen": 4, "Rows": 2}`,
+		"storage.0/plane.0": `[{"Amount": 64, "Name": "minecraft:cobblestone/0"},
+			{"Amount": 10, "Name": "minecraft:cobblestone/0"},
+			{"Amount": 5, "Name": "minecraft:dirt/0"}]`,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(names map[itemID]string) { item_display_names = names }(item_display_names)
+	item_display_names = map[itemID]string{"minecraft:cobblestone/0": "Cobblestone", "minecraft:dirt/0": "Dirt"}
+	var items []storageItemTotal
+	storageQuery(t, "/storage/storage.0/items?name=cobble", &items)
+	want_items := []storageItemTotal{{ItemID: "minecraft:cobblestone/0", DisplayName: "Cobblestone", Count: 74, Boxes: 2}}
+	if !reflect.DeepEqual(items, want_items) {
+		t.Errorf("items: got %+v, want %+v", items, want_items)
+	}
+	var boxes []storageBoxInfo
+	storageQuery(t, "/storage/storage.0/boxes?item=minecraft:dirt/0", &boxes)
+	if len(boxes) != 1 || boxes[0].BoxID != 2 || boxes[0].Amount != 5 {
+		t.Errorf("dirt boxes: got %+v, want box 2 with 5", boxes)
+	}
+	var free storageFreeInfo
+	storageQuery(t, "/storage/storage.0/free", &free)
+	if want := (storageFreeInfo{Free: 26, Used: 3, Holes: 3}); free != want {
+		t.Errorf("free: got %+v, want %+v", free, want)
+	}
+	var planes []storagePlaneInfo
+	storageQuery(t, "/storage/storage.0/planes", &planes)
+	if len(planes) != 2 || planes[0].Items != 79 || planes[0].Used != 3 || planes[1].Used != 0 {
+		t.Errorf("planes: got %+v", planes)
+	}
+	w := httptest.NewRecorder()
+	handleStorageQuery(w, httptest.NewRequest(http.MethodGet, root_key+"/storage/mine.0/items", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("query of a missing area: got status %v, want %v", w.Code, http.StatusNotFound)
+	}
+}
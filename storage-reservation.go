@@ -0,0 +1,77 @@
+package main
+
+import (
+	"time"
+)
+
+// Soft box reservations. A turtle that is sent to load a box reserves it
+// until its load order completes, so other turtles do not pick the same
+// empty box for a different item or plan to suck items that are already
+// taken. Reservations are only kept in memory. They are dropped when the
+// turtle is given other work or is lost, and expire after a while in case
+// the turtle never reports back.
+
+// Time until a reservation expires.
+const boxReservationTTL = 5 * time.Minute
+
+type boxReservation struct {
+	boxID   int
+	itemID  itemID
+	drop    bool
+	amount  int
+	expires time.Time
+}
+
+// Sum of the loads reserved for a box.
+type reservedLoad struct {
+	itemID itemID
+	nDrop  int
+	nSuck  int
+}
+
+// Reserves a box for a turtle, replacing any previous reservation.
+func (s *storageArea) reserveBox(label turtleID, cand *boxCandidate, drop bool, amount int) {
+	s.reservations[label] = &boxReservation{
+		boxID:   cand.id,
+		itemID:  cand.item_id,
+		drop:    drop,
+		amount:  amount,
+		expires: time.Now().Add(boxReservationTTL),
+	}
+}
+
+func (s *storageArea) releaseReservation(label turtleID) {
+	delete(s.reservations, label)
+}
+
+// Returns the loads reserved by other turtles than the given one, by box.
+func (s storageArea) reservedLoads(label turtleID) map[int]*reservedLoad {
+	now := time.Now()
+	loads := map[int]*reservedLoad{}
+	for res_label, res := range s.reservations {
+		if res_label == label || now.After(res.expires) {
+			continue
+		}
+		load := loads[res.boxID]
+		if load == nil {
+			load = &reservedLoad{itemID: res.itemID}
+			loads[res.boxID] = load
+		}
+		if res.drop {
+			load.nDrop += res.amount
+		} else {
+			load.nSuck += res.amount
+		}
+	}
+	return loads
+}
+
+// Removes expired reservations.
+func (s *storageArea) pruneReservations() {
+	now := time.Now()
+	for label, res := range s.reservations {
+		if now.After(res.expires) {
+			delete(s.reservations, label)
+		}
+	}
+}
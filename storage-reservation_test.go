@@ -0,0 +1,36 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReservationTTL(t *testing.T) {
+	s := &storageArea{reservations: map[turtleID]*boxReservation{}}
+	s.reserveBox("storage.0.1", &boxCandidate{id: 3, item_id: "minecraft:dirt/0"}, true, 10)
+	s.reserveBox("storage.0.2", &boxCandidate{id: 3, item_id: "minecraft:dirt/0"}, false, 4)
+	s.reserveBox("storage.0.3", &boxCandidate{id: 5, item_id: "minecraft:sand/0"}, true, 64)
+	// A turtle does not see its own reservation.
+	want := map[int]*reservedLoad{
+		3: {itemID: "minecraft:dirt/0", nDrop: 10},
+		5: {itemID: "minecraft:sand/0", nDrop: 64},
+	}
+	if got := s.reservedLoads("storage.0.2"); !reflect.DeepEqual(got, want) {
+		t.Errorf("reserved loads: got %+v, want %+v", got, want)
+	}
+	// Expired reservations are ignored and pruned.
+	s.reservations["storage.0.3"].expires = time.Now().Add(-time.Second)
+	delete(want, 5)
+	if got := s.reservedLoads("storage.0.2"); !reflect.DeepEqual(got, want) {
+		t.Errorf("reserved loads after expiry: got %+v, want %+v", got, want)
+	}
+	s.pruneReservations()
+	if _, ok := s.reservations["storage.0.3"]; ok || len(s.reservations) != 2 {
+		t.Errorf("reservations after pruning: %v", s.reservations)
+	}
+	s.releaseReservation("storage.0.1")
+	if got := s.reservedLoads("storage.0.2"); len(got) != 0 {
+		t.Errorf("reserved loads after release: %+v", got)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Item routing rules of a storage area, stored in "routing" in the area
+// directory and editable with the "routing" area field. The first rule that
+// matches an item decides how it is stored:
+//
+//	export  always exported when a turtle holds it
+//	reject  never stored, refused imports are dropped in the export chest
+//	        and recorded as "reject" in the ledger instead of "export"
+//	route   only dropped in the boxes first_box to last_box
+//	cap     at most max items are stored, the rest is exported
+//
+// Rejected items pass through the export chest on purpose. Turtles suck
+// the whole import chest and cannot leave items behind in it, so refused
+// items are carried to the export chest, the only place they can go
+// without being stored. They are never dropped in a box.
+//
+// Boxes in a route range only accept the items routed to them. Route
+// ranges are checked against the layout whenever the area is loaded, so a
+// reload with a layout that no longer has the routed boxes is rejected.
+
+const (
+	routeActionExport = "export"
+	routeActionReject = "reject"
+	routeActionRoute  = "route"
+	routeActionCap    = "cap"
+)
+
+const (
+	routeMatchExact    = "exact"
+	routeMatchPrefix   = "prefix"
+	routeMatchWildcard = "wildcard" // "*" matches any text, "?" any character
+)
+
+type routingRule struct {
+	// defaults to exact
+	Match   string `json:"match"`
+	Pattern string `json:"pattern"`
+	Action  string `json:"action"`
+	// box range of route rules, inclusive
+	FirstBox int `json:"first_box,omitempty"`
+	LastBox  int `json:"last_box,omitempty"`
+	// maximum number of stored items of cap rules
+	Max int `json:"max,omitempty"`
+	// compiled wildcard pattern
+	rgx *regexp.Regexp
+}
+
+// Rules of areas without a routing file. Some items are exported
+// immediately because we can't distinguish different items that can't be
+// stacked. This is caused by mods not using damage/metadata properly.
+var defaultRoutingRules = []routingRule{
+	{Pattern: "Thaumcraft:ItemWispEssence/0", Action: routeActionExport},
+	{Pattern: "Thaumcraft:ItemManaBean/0", Action: routeActionExport},
+}
+
+// Validates the rule for an area with n_boxes boxes and compiles its
+// pattern.
+func (r *routingRule) init(n_boxes int) error {
+	if r.Match == "" {
+		r.Match = routeMatchExact
+	}
+	switch r.Match {
+	case routeMatchExact, routeMatchPrefix:
+	case routeMatchWildcard:
+		rgx_src := regexp.QuoteMeta(r.Pattern)
+		rgx_src = strings.Replace(rgx_src, `\*`, ".*", -1)
+		rgx_src = strings.Replace(rgx_src, `\?`, ".", -1)
+		r.rgx = regexp.MustCompile("^" + rgx_src + "$")
+	default:
+		return fmt.Errorf("invalid routing match %q", r.Match)
+	}
+	if r.Pattern == "" {
+		return fmt.Errorf("empty routing pattern")
+	}
+	switch r.Action {
+	case routeActionExport, routeActionReject:
+	case routeActionRoute:
+		if r.FirstBox < 0 || r.LastBox < r.FirstBox || r.LastBox >= n_boxes {
+			return fmt.Errorf("invalid route box range %v-%v for %v, the layout has %v boxes", r.FirstBox, r.LastBox, r.Pattern, n_boxes)
+		}
+	case routeActionCap:
+		if r.Max < 0 {
+			return fmt.Errorf("invalid cap %v for %v", r.Max, r.Pattern)
+		}
+	default:
+		return fmt.Errorf("invalid routing action %q for %v", r.Action, r.Pattern)
+	}
+	return nil
+}
+
+func (r routingRule) matches(item_id itemID) bool {
+	switch r.Match {
+	case routeMatchPrefix:
+		return strings.HasPrefix(string(item_id), r.Pattern)
+	case routeMatchWildcard:
+		return r.rgx.MatchString(string(item_id))
+	default:
+		return string(item_id) == r.Pattern
+	}
+}
+
+// Validates rules and compiles their patterns.
+func initRoutingRules(rules []routingRule, n_boxes int) error {
+	for i := range rules {
+		if err := rules[i].init(n_boxes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the first rule matching an item, nil if none.
+func (s storageArea) itemRule(item_id itemID) *routingRule {
+	for i := range s.Routing {
+		if s.Routing[i].matches(item_id) {
+			return &s.Routing[i]
+		}
+	}
+	return nil
+}
+
+// Returns the number of items a turtle holding has_count items should
+// export instead of storing. Rejected items are exported too.
+func (s storageArea) nRoutedExport(item_id itemID, has_count int) int {
+	rule := s.itemRule(item_id)
+	if rule == nil {
+		return 0
+	}
+	switch rule.Action {
+	case routeActionExport, routeActionReject:
+		return has_count
+	case routeActionCap:
+		n_stored := 0
+		for _, box := range s.Boxes {
+			if box.Amount > 0 && box.Name == item_id {
+				n_stored += box.Amount
+			}
+		}
+		n_room := rule.Max - n_stored
+		if n_room < 0 {
+			n_room = 0
+		}
+		if has_count > n_room {
+			return has_count - n_room
+		}
+	}
+	return 0
+}
+
+// Returns true if an item may be dropped in a box.
+func (s storageArea) routeAllows(item_id itemID, box_id int) bool {
+	if rule := s.itemRule(item_id); rule != nil && rule.Action == routeActionRoute {
+		return box_id >= rule.FirstBox && box_id <= rule.LastBox
+	}
+	for _, rule := range s.Routing {
+		if rule.Action == routeActionRoute && box_id >= rule.FirstBox && box_id <= rule.LastBox {
+			return false
+		}
+	}
+	return true
+}
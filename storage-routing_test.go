@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestRejectDrop(t *testing.T) {
+	const item_id = itemID("minecraft:dirt/0")
+	const label = turtleID("storage.0.1")
+	tests := []struct {
+		action      string
+		want_export int
+		want_reject int
+	}{
+		{routeActionExport, 5, 0},
+		{routeActionReject, 0, 5},
+	}
+	for _, test := range tests {
+		s := bootCobbleStorage(t)
+		err := mgrCall(func() error {
+			s.Routing = []routingRule{{Pattern: string(item_id), Action: test.action}}
+			if err := initRoutingRules(s.Routing, s.nBoxes()); err != nil {
+				return err
+			}
+			// An imported item dropped in the export chest.
+			s.LoadOrders[label] = &loadOrder{
+				ID:    1,
+				BoxID: ExportVBoxID,
+				Items: map[itemID]itemLoadCount{item_id: {PreCount: 5, AbsDelta: 5}},
+				Drop:  true,
+			}
+			_, err := mgrDecideStorageWork(turtle{
+				Label:    label,
+				CurWork:  &work{ID: 1, Type: "drop", Complete: true},
+				InvCount: icount{FreeSlots: 16, Grouped: map[itemID]int{}},
+			}, s)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := queryLedger(s.ledgerPath(), ledgerFilter{limit: ledgerDefaultLimit})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := map[string]int{}
+		for _, entry := range entries {
+			got[entry.Kind] += entry.Amount
+		}
+		if got[ledgerExport] != test.want_export || got[ledgerReject] != test.want_reject {
+			t.Errorf("%v: ledger %v, want %v exported and %v rejected", test.action, got, test.want_export, test.want_reject)
+		}
+	}
+}
+
+func TestReloadRouteRange(t *testing.T) {
+	dir := simStateDir(t, map[string]string{
+		"storage.0/details": `{"ID": "storage.0", "Pos": [50, 121, 822], "XLen": 4, "ZLen": 4, "Rows": 2}`,
+		"storage.0/routing": `[{"pattern": "minecraft:dirt/0", "action": "route", "first_box": 20, "last_box": 23}]`,
+	})
+	if err := simBootServer(dir); err != nil {
+		t.Fatal(err)
+	}
+	s := areas["storage.0"]
+	// One row has fewer boxes than the route range.
+	raw := `{"ID": "storage.0", "Pos": [50, 121, 822], "XLen": 4, "ZLen": 4, "Rows": 1}`
+	if err := os.WriteFile(path.Join(dir, "storage.0", "details"), []byte(raw), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := mgrCall(func() error {
+		return mgrReloadArea("storage.0", path.Join(dir, "storage.0"))
+	})
+	if err == nil || !strings.Contains(err.Error(), "invalid route box range") {
+		t.Errorf("got error %v, want invalid route box range", err)
+	}
+	if areas["storage.0"] != s {
+		t.Errorf("layout without the routed boxes was loaded")
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Replenishment of the supply boxes of consuming areas, e.g. the fuel box of
+// a mine. The contents of supply boxes are not observed, the consuming area
+// estimates them: the items a turtle is sent to fetch are taken, delivered
+// items are added and a box a turtle could not fetch enough from is empty.
+// The estimate of a box starts at the minimum of its stock rule. When it
+// falls below the minimum the storage area creates a delivery: a storage
+// turtle fetches the items from storage and drops them in the supply box
+// before it serves exports. Items of pending deliveries are not available
+// for export.
+//
+// Stock rules are edited with the "stock" field of the storage area, e.g.
+//
+//	{"area_id": "mine.0", "box": "fuel", "item_id": "minecraft:coal/0", "min": 256}
+
+// Implemented by areas with supply boxes that storage areas deliver to.
+type supplyArea interface {
+	// Returns the position a turtle loads a supply box from and the
+	// direction of the box, false if the area has no such box.
+	supplyBox(box string) (pos vec3, dir vec3, ok bool)
+	// Returns the map from supply boxes to the estimated number of items
+	// in them.
+	supplyLevels() map[string]int
+}
+
+// Stock rule of a storage area. Min items are delivered to the supply box
+// of the area when fewer than min items are left in it.
+type stockRule struct {
+	AreaID areaID `json:"area_id"`
+	Box    string `json:"box"`
+	ItemID itemID `json:"item_id"`
+	Min    int    `json:"min"`
+}
+
+func (r stockRule) validate() error {
+	if r.AreaID == "" || r.Box == "" || r.ItemID == "" {
+		return fmt.Errorf("stock rule needs area_id, box and item_id: %+v", r)
+	}
+	if r.Min <= 0 {
+		return fmt.Errorf("invalid stock min %v for %v", r.Min, r.ItemID)
+	}
+	return nil
+}
+
+type delivery struct {
+	ID      int
+	AreaID  areaID `json:"area_id"`
+	Box     string
+	ItemID  itemID `json:"item_id"`
+	Count   int
+	Created string
+	// turtle assigned to the delivery, empty if not assigned yet
+	Turtle turtleID
+	// number of items the turtle fetched from storage so far and true
+	// when the turtle fetched the items and is dropping them
+	Picked  int `json:"picked"`
+	Fetched bool
+	// work id of the drop job and number of items held before it
+	WorkID   workID `json:"work_id"`
+	PreCount int    `json:"pre_count"`
+}
+
+// Requests supplies for a supply box with level items left. Creates a
+// delivery in the first storage area with a matching stock rule whose
+// minimum is above the level, unless a delivery for the box is pending
+// already.
+func mgrRequestSupply(area_id areaID, box string, item_id itemID, level int) {
+	for _, s := range storageAreas() {
+		for _, rule := range s.Stock {
+			if rule.AreaID != area_id || rule.Box != box || rule.ItemID != item_id || level >= rule.Min {
+				continue
+			}
+			for _, d := range s.Deliveries {
+				if d.AreaID == area_id && d.Box == box {
+					return
+				}
+			}
+			count := rule.Min
+			if n_available := s.nAvailable(item_id); count > n_available {
+				count = n_available
+			}
+			if count <= 0 {
+				log.Printf("supply: %v/%v: no %v available in %v", area_id, box, item_id, s.ID)
+				continue
+			}
+			s.DeliverySeq++
+			s.Deliveries = append(s.Deliveries, &delivery{
+				ID:      s.DeliverySeq,
+				AreaID:  area_id,
+				Box:     box,
+				ItemID:  item_id,
+				Count:   count,
+				Created: time.Now().UTC().Format(time.RFC3339),
+			})
+			s.recordExport(item_id)
+			log.Printf("supply: %v/%v: delivering %v %v from %v", area_id, box, count, item_id, s.ID)
+			if err := s.store(); err != nil {
+				log.Printf("supply: error: %v: %v", s.ID, err)
+			}
+			return
+		}
+	}
+}
+
+// Returns the minimum of the first stock rule of a supply box, 0 if no
+// storage area stocks the box.
+func mgrStockMin(area_id areaID, box string, item_id itemID) int {
+	for _, s := range storageAreas() {
+		for _, rule := range s.Stock {
+			if rule.AreaID == area_id && rule.Box == box && rule.ItemID == item_id {
+				return rule.Min
+			}
+		}
+	}
+	return 0
+}
+
+// Returns true if the turtle completed a supply suck job and is sent to
+// suck again, meaning the box did not hold enough.
+func suckedShort(t turtle) bool {
+	return t.CurWork != nil && t.CurWork.ID == workIDSupplySuck && t.CurWork.Complete
+}
+
+// Returns the job of a turtle at a supply box of an area that needs n more
+// items from it and updates the estimated level of the box. Supplies are
+// requested when the level falls below the minimum. When the box ran dry
+// the turtle waits for the delivery away from the box so the storage
+// turtle can reach it. The level is stored with the next update of the
+// area.
+func supplyFetchJob(t turtle, a supplyArea, area_id areaID, box string, item_id itemID, n int,
+	dir vec3, wait_job func(turtle) *job) *job {
+	levels := a.supplyLevels()
+	if _, ok := levels[box]; !ok {
+		// A box that was never delivered to is assumed to be stocked.
+		levels[box] = mgrStockMin(area_id, box, item_id)
+	}
+	if suckedShort(t) {
+		levels[box] = 0
+		mgrRequestSupply(area_id, box, item_id, 0)
+		return wait_job(t)
+	}
+	levels[box] -= n
+	if levels[box] < 0 {
+		levels[box] = 0
+	}
+	mgrRequestSupply(area_id, box, item_id, levels[box])
+	return makeJobSuck(workIDSupplySuck, &item_id, n, dir)
+}
+
+// Returns the number of items of an item that pending deliveries will
+// fetch from storage.
+func (s storageArea) nDelivering(item_id itemID) int {
+	n := 0
+	for _, d := range s.Deliveries {
+		if d.ItemID == item_id && !d.Fetched && d.Count > d.Picked {
+			n += d.Count - d.Picked
+		}
+	}
+	return n
+}
+
+// Returns the delivery assigned to a turtle, nil if none.
+func (s storageArea) turtleDelivery(label turtleID) *delivery {
+	for _, d := range s.Deliveries {
+		if d.Turtle == label {
+			return d
+		}
+	}
+	return nil
+}
+
+// Assigns the oldest unassigned delivery to a turtle. Returns nil if there
+// is none.
+func (s *storageArea) takeDelivery(label turtleID) *delivery {
+	for _, d := range s.Deliveries {
+		if d.Turtle == "" {
+			d.Turtle = label
+			return d
+		}
+	}
+	return nil
+}
+
+func (s *storageArea) removeDelivery(d *delivery) {
+	for i, other := range s.Deliveries {
+		if other == d {
+			s.Deliveries = append(s.Deliveries[:i], s.Deliveries[i+1:]...)
+			return
+		}
+	}
+}
+
+// Returns the load position and direction of the supply box of a delivery.
+func deliveryTarget(d delivery) (vec3, vec3, error) {
+	a, ok := areas[d.AreaID].(supplyArea)
+	if !ok {
+		return vec3{}, vec3{}, fmt.Errorf("area %v has no supply boxes", d.AreaID)
+	}
+	pos, dir, ok := a.supplyBox(d.Box)
+	if !ok {
+		return vec3{}, vec3{}, fmt.Errorf("area %v has no supply box %v", d.AreaID, d.Box)
+	}
+	return pos, dir, nil
+}
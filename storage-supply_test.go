@@ -0,0 +1,171 @@
+package main
+
+import (
+	"testing"
+)
+
+// Boots a mine and a storage area holding 64 cobblestone with a stock rule
+// of at least 20 cobblestone in the fuel box of the mine.
+func bootSupply(t *testing.T) (*mineArea, *storageArea) {
+	err := simBootServer(simStateDir(t, map[string]string{
+		"mine.0/details": `{"ID": "mine.0", "Pos": [70, 100, 822], "Depth": 4}`,
+		"storage.0/details": `{"ID": "storage.0", "Pos": [50, 121, 822], "XLen": 4, "ZLen": 4, "Rows": 2,
+			"stock": [{"area_id": "mine.0", "box": "fuel", "item_id": "minecraft:cobblestone/0", "min": 20}]}`,
+		"storage.0/plane.0": `[{"Amount": 64, "Name": "minecraft:cobblestone/0"}]`,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return areas["mine.0"].(*mineArea), areas["storage.0"].(*storageArea)
+}
+
+func TestSupplyFetchJob(t *testing.T) {
+	const item_id = itemID("minecraft:cobblestone/0")
+	m, s := bootSupply(t)
+	m.SupplyLevels["fuel"] = 30
+	tests := []struct {
+		name string
+		// work the turtle completed before
+		prev           *work
+		n_fetch        int
+		want_suck      bool
+		want_level     int
+		want_delivered int
+	}{
+		{"above min", nil, 5, true, 25, 0},
+		{"after other suck", &work{ID: workIDTmp, Type: "suck", Complete: true}, 5, true, 20, 0},
+		{"below min", nil, 10, true, 10, 20},
+		{"ran dry", &work{ID: workIDSupplySuck, Type: "suck", Complete: true}, 10, false, 0, 20},
+	}
+	for _, test := range tests {
+		tt := turtle{Label: "mine.0.1", CurWork: test.prev}
+		var j *job
+		err := mgrCall(func() error {
+			j = supplyFetchJob(tt, m, m.ID, "fuel", item_id, test.n_fetch, vec3{0, 0, 1}, m.getWaitJob)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, is_suck := j.Instr.(*jobSuck); is_suck != test.want_suck {
+			t.Errorf("%v: got job %v, want suck %v", test.name, j.Instr.jobType(), test.want_suck)
+		}
+		if m.SupplyLevels["fuel"] != test.want_level {
+			t.Errorf("%v: level %v, want %v", test.name, m.SupplyLevels["fuel"], test.want_level)
+		}
+		// A pending delivery is not requested again.
+		n_delivered := 0
+		for _, d := range s.Deliveries {
+			n_delivered += d.Count
+		}
+		if n_delivered != test.want_delivered {
+			t.Errorf("%v: delivering %v, want %v", test.name, n_delivered, test.want_delivered)
+		}
+	}
+}
+
+func TestSupplyLevelSeed(t *testing.T) {
+	const item_id = itemID("minecraft:cobblestone/0")
+	m, s := bootSupply(t)
+	err := mgrCall(func() error {
+		supplyFetchJob(turtle{Label: "mine.0.1"}, m, m.ID, "fuel", item_id, 5, vec3{0, 0, 1}, m.getWaitJob)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The box is assumed to hold the minimum before the first fetch.
+	if n := m.SupplyLevels["fuel"]; n != 15 {
+		t.Errorf("fuel box level %v, want 15", n)
+	}
+	if len(s.Deliveries) != 1 {
+		t.Errorf("got deliveries %v, want one", s.Deliveries)
+	}
+}
+
+func TestDeliveryPriority(t *testing.T) {
+	const item_id = itemID("minecraft:cobblestone/0")
+	const label = turtleID("storage.0.1")
+	m, s := bootSupply(t)
+	if _, err := exportItems(exportRequest{ItemID: item_id, Count: 10, AreaID: "storage.0"}); err != nil {
+		t.Fatal(err)
+	}
+	err := mgrCall(func() error {
+		mgrRequestSupply(m.ID, "fuel", item_id, 0)
+		_, err := mgrDecideStorageWork(turtle{
+			Label:    label,
+			InvCount: icount{FreeSlots: 16, Grouped: map[itemID]int{}},
+		}, s)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The delivery is served before the export.
+	if s.turtleDelivery(label) == nil {
+		t.Errorf("turtle not assigned the delivery: %+v", s.Deliveries)
+	}
+	if n := s.ExportAllocs[label][item_id]; n != 0 {
+		t.Errorf("turtle allocated %v exported items", n)
+	}
+}
+
+func TestDeliveryAvailable(t *testing.T) {
+	const item_id = itemID("minecraft:cobblestone/0")
+	const label = turtleID("storage.0.1")
+	m, s := bootSupply(t)
+	check := func(name string, want int) {
+		var n int
+		err := mgrCall(func() error {
+			n = s.nAvailable(item_id)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Errorf("%v: %v available, want %v", name, n, want)
+		}
+	}
+	err := mgrCall(func() error {
+		mgrRequestSupply(m.ID, "fuel", item_id, 0)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Deliveries) != 1 {
+		t.Fatalf("got deliveries %v, want one", s.Deliveries)
+	}
+	check("requested", 44)
+	if _, err := exportItems(exportRequest{ItemID: item_id, Count: 64, AreaID: "storage.0"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.Exporting[item_id]; n != 44 {
+		t.Errorf("exporting %v, want the 44 not delivered", n)
+	}
+	check("exported", 0)
+	d := s.Deliveries[0]
+	err = mgrCall(func() error {
+		d.Turtle, d.Fetched, d.Picked = label, true, 20
+		s.Boxes[0].Amount -= 20
+		// The turtle dropped 15 of the 20 items in the supply box.
+		s.WorkIDSeq++
+		d.WorkID, d.PreCount = workID(s.WorkIDSeq), 20
+		_, err := mgrDecideStorageWork(turtle{
+			Label:    label,
+			CurWork:  &work{ID: d.WorkID, Type: "drop", Complete: true},
+			InvCount: icount{FreeSlots: 15, Grouped: map[itemID]int{item_id: 5}},
+		}, s)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Deliveries) != 0 {
+		t.Errorf("delivery not complete: %+v", s.Deliveries)
+	}
+	if n := m.SupplyLevels["fuel"]; n != 15 {
+		t.Errorf("fuel box level %v, want 15", n)
+	}
+}
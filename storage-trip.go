@@ -0,0 +1,157 @@
+package main
+
+import (
+	"log"
+)
+
+// Pickup trips. A turtle serving exports plans a trip that visits several
+// boxes and sucks several items before it queues at the export station.
+// The trip first fetches the items already allocated to the turtle, then
+// serves the export queue in order as long as the fetched items fit in the
+// free inventory slots, one stop per item. Stops are visited closest first.
+// Every stop is a load order of one box, so boxes are accounted exactly as
+// for single box loads. Stops whose box changed in the meantime are
+// skipped, their allocated items are fetched by the next trip.
+
+type pickupStop struct {
+	BoxID  int    `json:"box_id"`
+	ItemID itemID `json:"item_id"`
+	Count  int
+}
+
+type pickupTrip struct {
+	// remaining stops, the next stop first
+	Stops []pickupStop
+}
+
+// Returns the number of inventory slots n items occupy.
+func itemSlots(item_id itemID, n int) int {
+	max_stack := itemMaxStack(item_id)
+	return (n + max_stack - 1) / max_stack
+}
+
+// Orders stops so that the closest stop is visited next.
+func orderStops(pos vec3, stops []pickupStop, s storageArea) []pickupStop {
+	var route []pickupStop
+	for len(stops) > 0 {
+		next, next_dist := 0, -1
+		for i, stop := range stops {
+			if d := vec3L1Dist(pos, s.getBoxOrient(stop.BoxID).loadPos()); next_dist < 0 || d < next_dist {
+				next, next_dist = i, d
+			}
+		}
+		route = append(route, stops[next])
+		pos = s.getBoxOrient(stops[next].BoxID).loadPos()
+		stops = append(stops[:next], stops[next+1:]...)
+	}
+	return route
+}
+
+// Plans a pickup trip for a turtle. inv_c holds the items the turtle wants
+// to fetch for export. Returns nil if there is nothing to fetch, and true if
+// the area was changed.
+func (s *storageArea) planTrip(t turtle, inv_c map[itemID]int) (*pickupTrip, bool) {
+	changed := false
+	n_slots := t.InvCount.FreeSlots
+	var stops []pickupStop
+	planned := map[itemID]bool{}
+	// Items allocated to the turtle are fetched first.
+	for item_id, n_alloc := range s.ExportAllocs[t.Label] {
+		n_want := inv_c[item_id]
+		if n_alloc <= 0 || n_want <= 0 {
+			continue
+		}
+		planned[item_id] = true
+		cand := s.closestBox(t.Label, t.CurPos, item_id, false)
+		if cand == nil {
+			log.Printf("storage work warning: turtle %v: out of item %v, nothing to export", t.Label, item_id)
+			// Automatically delete the export allocation of this item.
+			s.moveTurtleExportItems(t.Label, item_id, n_alloc, []exportStage{exportAllocated, exportInTransit}, exportMissing)
+			s.clearExportAlloc(t.Label, item_id)
+			changed = true
+			continue
+		}
+		if n_fit := n_slots * itemMaxStack(item_id); n_want > n_fit {
+			n_want = n_fit
+		}
+		if n_box := s.Boxes[cand.id].Amount; n_want > n_box {
+			n_want = n_box
+		}
+		if n_want <= 0 {
+			continue
+		}
+		stops = append(stops, pickupStop{BoxID: cand.id, ItemID: item_id, Count: n_want})
+		n_slots -= itemSlots(item_id, n_want)
+	}
+	// Serve the orders in the export queue that we may serve and that have
+	// items in storage.
+	for _, order := range s.exportQueue() {
+		if n_slots <= 0 {
+			break
+		}
+		n_want := inv_c[order.ItemID]
+		if n_want <= 0 || planned[order.ItemID] || !s.canServeOrder(order, t.Label) {
+			continue
+		}
+		cand := s.closestBox(t.Label, t.CurPos, order.ItemID, false)
+		if cand == nil {
+			continue
+		}
+		if s.isBulkOrder(order) {
+			// Large exports are served by the bulk export pool.
+			if s.joinBulkPool(t.Label, order.ItemID) {
+				changed = true
+			}
+			if !s.mayServeBulk(t.Label, order) {
+				continue
+			}
+		}
+		if n_fit := n_slots * itemMaxStack(order.ItemID); n_want > n_fit {
+			n_want = n_fit
+		}
+		if n_box := s.Boxes[cand.id].Amount; n_want > n_box {
+			// We do not allocate more than what's in the box. This allows
+			// parallel export of large quantities.
+			n_want = n_box
+		}
+		n_alloc := s.allocateExport(t.Label, order.ItemID, n_want)
+		if n_alloc <= 0 {
+			continue
+		}
+		changed = true
+		planned[order.ItemID] = true
+		stops = append(stops, pickupStop{BoxID: cand.id, ItemID: order.ItemID, Count: n_alloc})
+		n_slots -= itemSlots(order.ItemID, n_alloc)
+	}
+	if len(stops) == 0 {
+		return nil, changed
+	}
+	return &pickupTrip{Stops: orderStops(t.CurPos, stops, *s)}, true
+}
+
+// Removes the next stop of a turtle's trip after its box was loaded.
+func (s *storageArea) completeStop(label turtleID, lo loadOrder) {
+	trip := s.Trips[label]
+	if trip == nil || lo.Drop || len(trip.Stops) == 0 {
+		return
+	}
+	if stop := trip.Stops[0]; stop.BoxID == lo.BoxID {
+		if _, ok := lo.Items[stop.ItemID]; ok {
+			trip.Stops = trip.Stops[1:]
+		}
+	}
+	if len(trip.Stops) == 0 {
+		delete(s.Trips, label)
+	}
+}
+
+// Returns the boxes of all planned stops.
+func (s storageArea) tripBoxes() map[int]bool {
+	boxes := map[int]bool{}
+	for _, trip := range s.Trips {
+		for _, stop := range trip.Stops {
+			boxes[stop.BoxID] = true
+		}
+	}
+	return boxes
+}
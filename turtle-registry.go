@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Persistent registry of all turtles that have reported to the server.
+// Every turtle has one file in the registry directory of the state
+// directory. The registry is loaded on startup so the web UI can show all
+// known turtles before they report again.
+// A record is stored when a report changes the last job or the lost state
+// of a turtle. Other report updates are flushed every minute.
+// A watchdog in the work manager marks turtles that stop reporting as lost
+// and releases their allocations so work and exports are not stuck.
+
+const registryDirName = "registry"
+
+type turtleRecord struct {
+	Label      turtleID
+	FirstSeen  string          `json:"first_seen"`
+	LastSeen   string          `json:"last_seen"`
+	LastReport json.RawMessage `json:"last_report"`
+	// lua source of the last job issued to the turtle, empty if none
+	LastJob     string `json:"last_job"`
+	LastJobTime string `json:"last_job_time"`
+	// true if the turtle has not reported for longer than the lost timeout
+	Lost     bool   `json:"lost"`
+	LostTime string `json:"lost_time"`
+	// true if the record changed since it was stored
+	dirty bool
+}
+
+// Watchdog configuration, optionally read from "turtles.watchdog" in the
+// state directory.
+type watchdogConfig struct {
+	// minutes without a report until a turtle is considered lost
+	LostAfter int `json:"lost_after"`
+}
+
+var watchdog_cfg = watchdogConfig{
+	LostAfter: 30,
+}
+
+// How often the work manager looks for lost turtles.
+const watchdogInterval = time.Minute
+
+// How often the work manager stores records that changed without being
+// stored.
+const registryFlushInterval = time.Minute
+
+// Event published when a turtle is considered lost.
+type turtleLostEvent struct {
+	Time     string
+	LastSeen string `json:"last_seen"`
+	// true if allocations were released
+	Released bool
+}
+
+var registry_dir string
+
+// Time the registry was loaded. Turtles are not lost before lost_after has
+// passed since then, as they could not report while the server was down.
+var registry_loaded time.Time
+
+// Only accessed by the work manager after the registry has been loaded.
+var turtleRegistry = map[turtleID]*turtleRecord{}
+
+func loadRegistry(state_dir string) error {
+	registry_dir = path.Join(state_dir, registryDirName)
+	if err := os.MkdirAll(registry_dir, 0755); err != nil {
+		return err
+	}
+	if err := recoverState(registry_dir); err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(registry_dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		rec := new(turtleRecord)
+		if err := loadJSON(path.Join(registry_dir, file.Name()), rec); err != nil {
+			return err
+		}
+		if string(rec.Label) != file.Name() {
+			log.Printf("registry: ignoring %v: label mismatch: %v", file.Name(), rec.Label)
+			continue
+		}
+		turtleRegistry[rec.Label] = rec
+		// Publish last report as if the turtle had just reported.
+		if len(rec.LastReport) > 0 {
+			syncNotify("turtles/"+string(rec.Label), string(rec.LastReport))
+		}
+		if rec.Lost {
+			notifyTurtleLost(rec, false)
+		}
+	}
+	log.Printf("loaded %v turtles from registry\n", len(turtleRegistry))
+	cfg_path := path.Join(state_dir, "turtles.watchdog")
+	cfg := watchdog_cfg
+	if _, err := os.Stat(cfg_path); err == nil {
+		if err := loadJSON(cfg_path, &cfg); err != nil {
+			return err
+		}
+	}
+	if cfg.LostAfter <= 0 {
+		return fmt.Errorf("invalid watchdog lost_after: %v", cfg.LostAfter)
+	}
+	watchdog_cfg = cfg
+	registry_loaded = time.Now().UTC()
+	return nil
+}
+
+// Labels are used as file names in the registry.
+func validRegistryLabel(label turtleID) bool {
+	return label != "" && label[0] != '.' && !strings.ContainsAny(string(label), "/\\")
+}
+
+// Records a turtle report and the job issued in response to it, which is
+// nil when the turtle keeps its current job.
+func mgrRecordReport(t turtle, raw []byte, new_job *job) error {
+	if !validRegistryLabel(t.Label) {
+		return errBadRequest("invalid turtle label for registry: %q", t.Label)
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	rec := turtleRegistry[t.Label]
+	changed := false
+	if rec == nil {
+		rec = &turtleRecord{
+			Label:     t.Label,
+			FirstSeen: now,
+		}
+		turtleRegistry[t.Label] = rec
+		changed = true
+		log.Printf("registry: new turtle %v", t.Label)
+	}
+	rec.LastSeen = now
+	if rec.Lost {
+		log.Printf("registry: lost turtle %v reported again", t.Label)
+		rec.Lost = false
+		rec.LostTime = ""
+		changed = true
+		syncNotify("lost/"+string(t.Label), "null")
+	}
+	rec.LastReport = json.RawMessage(raw)
+	if new_job != nil {
+		last_job, err := new_job.luaSrc()
+		if err != nil {
+			return err
+		}
+		if last_job != rec.LastJob {
+			changed = true
+		}
+		rec.LastJob = last_job
+		rec.LastJobTime = now
+	}
+	if !changed {
+		// Stored by the next flush.
+		rec.dirty = true
+		return nil
+	}
+	return storeRecord(rec)
+}
+
+func storeRecord(rec *turtleRecord) error {
+	rec.dirty = false
+	return storeJSON(path.Join(registry_dir, string(rec.Label)), rec)
+}
+
+// Stores the records that changed since they were stored.
+func mgrFlushRegistry() {
+	for label, rec := range turtleRegistry {
+		if !rec.dirty {
+			continue
+		}
+		if err := storeRecord(rec); err != nil {
+			// Retried by the next flush.
+			rec.dirty = true
+			log.Printf("registry: error: %v: %v", label, err)
+		}
+	}
+}
+
+func notifyTurtleLost(rec *turtleRecord, released bool) {
+	raw, _ := json.Marshal(turtleLostEvent{
+		Time:     rec.LostTime,
+		LastSeen: rec.LastSeen,
+		Released: released,
+	})
+	syncNotify("lost/"+string(rec.Label), string(raw))
+}
+
+// Marks turtles that have been silent for too long as lost and releases
+// their allocations in their area.
+func mgrWatchdog() error {
+	lost_after := time.Duration(watchdog_cfg.LostAfter) * time.Minute
+	now := time.Now().UTC()
+	for label, rec := range turtleRegistry {
+		if rec.Lost {
+			continue
+		}
+		// Use zero value for last seen (1970) on parse error.
+		last_seen, _ := time.Parse(time.RFC3339, rec.LastSeen)
+		if last_seen.Before(registry_loaded) {
+			last_seen = registry_loaded
+		}
+		if now.Sub(last_seen) < lost_after {
+			continue
+		}
+		if err := mgrMarkLost(rec, now); err != nil {
+			log.Printf("watchdog: error: %v: %v", label, err)
+		}
+	}
+	return nil
+}
+
+func mgrMarkLost(rec *turtleRecord, now time.Time) error {
+	log.Printf("watchdog: turtle %v lost, last seen %v", rec.Label, rec.LastSeen)
+	released := false
+	if area_id, err := turtleAreaID(rec.Label); err == nil {
+		if area := areas[area_id]; area != nil && area.releaseTurtle(rec.Label) {
+			log.Printf("watchdog: released allocations of %v in %v", rec.Label, area_id)
+			if err := area.store(); err != nil {
+				return err
+			}
+			released = true
+		}
+	}
+	rec.Lost = true
+	rec.LostTime = now.Format(time.RFC3339)
+	notifyTurtleLost(rec, released)
+	return storeRecord(rec)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegistryReload(t *testing.T) {
+	dir := t.TempDir()
+	turtleRegistry = map[turtleID]*turtleRecord{}
+	if err := loadRegistry(dir); err != nil {
+		t.Fatal(err)
+	}
+	tur := turtle{Label: "storage.0.1"}
+	if err := mgrRecordReport(tur, []byte(`{"Label": "storage.0.1"}`), makeJobIdle(1, 5)); err != nil {
+		t.Fatal(err)
+	}
+	first_seen := turtleRegistry[tur.Label].FirstSeen
+	// A report without a new job keeps the last job.
+	if err := mgrRecordReport(tur, []byte(`{"Label": "storage.0.1", "fuel_lvl": 10}`), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := mgrRecordReport(turtle{Label: "../x"}, []byte(`{}`), nil); err == nil {
+		t.Errorf("recorded a turtle with an invalid label")
+	}
+	// The report without a new job is stored by the next flush.
+	raw, err := os.ReadFile(path.Join(dir, registryDirName, string(tur.Label)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(raw), "fuel_lvl") {
+		t.Errorf("report without a new job stored before the flush")
+	}
+	mgrFlushRegistry()
+	turtleRegistry = map[turtleID]*turtleRecord{}
+	if err := loadRegistry(dir); err != nil {
+		t.Fatal(err)
+	}
+	rec := turtleRegistry[tur.Label]
+	if len(turtleRegistry) != 1 || rec == nil {
+		t.Fatalf("reloaded registry: %v, want %v", turtleRegistry, tur.Label)
+	}
+	if rec.FirstSeen != first_seen || rec.LastJob == "" || !strings.Contains(string(rec.LastReport), "fuel_lvl") {
+		t.Errorf("reloaded record: %+v", rec)
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	turtleRegistry = map[turtleID]*turtleRecord{}
+	if err := loadRegistry(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	lost_after := time.Duration(watchdog_cfg.LostAfter) * time.Minute
+	seen := map[turtleID]time.Duration{
+		"storage.0.1": 0,
+		"storage.0.2": lost_after + time.Minute,
+	}
+	for label, ago := range seen {
+		turtleRegistry[label] = &turtleRecord{Label: label, LastSeen: now.Add(-ago).Format(time.RFC3339)}
+	}
+	// Turtles are not lost right after startup.
+	if err := mgrWatchdog(); err != nil {
+		t.Fatal(err)
+	}
+	if turtleRegistry["storage.0.2"].Lost {
+		t.Errorf("turtle lost right after startup")
+	}
+	registry_loaded = now.Add(-lost_after - time.Minute)
+	if err := mgrWatchdog(); err != nil {
+		t.Fatal(err)
+	}
+	for label, ago := range seen {
+		if want := ago > 0; turtleRegistry[label].Lost != want {
+			t.Errorf("%v last seen %v ago: lost %v, want %v", label, ago, turtleRegistry[label].Lost, want)
+		}
+	}
+	// A lost turtle that reports again is no longer lost.
+	if err := mgrRecordReport(turtle{Label: "storage.0.2"}, []byte(`{}`), nil); err != nil {
+		t.Fatal(err)
+	}
+	if rec := turtleRegistry["storage.0.2"]; rec.Lost || rec.LostTime != "" {
+		t.Errorf("turtle still lost after reporting: %+v", rec)
+	}
+}
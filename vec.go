@@ -52,3 +52,16 @@ func vec3Dim(v vec3) int {
 	}
 	return 0
 }
+
+func vec3Scale(v vec3, n int) vec3 {
+	var out vec3
+	for i, c := range v {
+		out[i] = c * n
+	}
+	return out
+}
+
+// Returns true if the vector is a unit vector along one axis.
+func vec3IsUnit(v vec3) bool {
+	return vec3L1Dist(v, vec3{}) == 1
+}
@@ -175,6 +175,10 @@ function refreshTurtleUI() {
         if (turtle.cur_dst) {
             activity += " -> " + JSON.stringify(turtle.cur_dst);
         }
+        var lost = state["lost/" + turtle.label];
+        if (lost) {
+            activity = "LOST since " + lost.Time + " (last seen " + lost.last_seen + "): " + activity;
+        }
         $(elem).find(".turtle-activity").text(activity);
         var inventory = turtle.inv_count.free_slots + "/16";
         $(elem).find(".turtle-inventory").text(inventory);
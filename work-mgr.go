@@ -5,10 +5,11 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"os"
 	"path"
-	"regexp"
-	"strconv"
 	"strings"
+	"time"
 )
 
 type areaID string
@@ -39,6 +40,15 @@ type work struct {
 	ID       workID
 	Type     string
 	Complete bool
+	// result of a completed audit job
+	Audit *auditResult `json:"audit"`
+}
+
+type auditResult struct {
+	Items map[itemID]int
+	// false if the container could only be listed partially, the counts
+	// are then lower bounds
+	Complete bool
 }
 
 type workID int
@@ -53,6 +63,9 @@ const (
 
 	workIDInvImpQueue = workID(-2) // Inventory import queueing.
 	workIDInvImpSuck  = workID(-3) // Inventory import sucking.
+
+	// Special work ID for sucking from the supply box of a consuming area.
+	workIDSupplySuck = workID(-4)
 )
 
 func (w workID) isLowPriority() bool {
@@ -67,6 +80,8 @@ func (w workID) isLowPriority() bool {
 type icount struct {
 	FreeSlots int `json:"free_slots"`
 	Grouped   map[itemID]int
+	// max stack size of the items in the inventory
+	MaxStack map[itemID]int `json:"max_stack"`
 }
 
 type qCoords struct {
@@ -77,39 +92,80 @@ type qCoords struct {
 	q0_t0_dir vec3 // q0 -> t0 direction
 }
 
-func makeQueueOrderJob(id workID, q qCoords) string {
+func makeQueueOrderJob(id workID, q qCoords) *job {
 	return makeJobQueue(id, q.origin, q.q_dir, q.o_q0_dir, q.q0_t0_dir)
 }
 
-var areas = map[areaID]interface{}{}
+var areas = map[areaID]area{}
 
 type workRequest struct {
-	t      turtle
-	rsp_ch chan *string
+	t turtle
+	// raw report, recorded in the turtle registry
+	raw    []byte
+	rsp_ch chan workResponse
+}
+
+type workResponse struct {
+	// new job, nil when the turtle should keep its current job
+	job *job
+	// fuel values of the items the turtle may refuel with, nil if the
+	// turtle is not in an area
+	fuel_items map[itemID]int
+	err        error
 }
 
 var work_mgr_ch = make(chan interface{}, 0)
 
-func decideWork(t turtle) *string {
+// Decides new work for a turtle. Returns a nil job when the turtle should
+// keep its current job, and the fuel items of the turtle's area.
+func decideWork(t turtle, raw []byte) (*job, map[itemID]int, error) {
 	req := workRequest{
 		t:      t,
-		rsp_ch: make(chan *string, 1),
+		raw:    raw,
+		rsp_ch: make(chan workResponse, 1),
 	}
 	work_mgr_ch <- req
-	return <-req.rsp_ch
+	rsp := <-req.rsp_ch
+	return rsp.job, rsp.fuel_items, rsp.err
 }
 
 type exportRequest struct {
 	ItemID itemID `json:"item_id"`
-	Count  int
-	AreaID areaID    `json:"area_id"`
-	rsp_ch chan bool `json:"-"`
+	// negative counts cancel queued exports
+	Count     int
+	AreaID    areaID `json:"area_id"`
+	Requester string
+	Priority  exportPriority
+	// maximum number of turtles serving the order at a time
+	MaxTurtles int `json:"max_turtles"`
 }
 
-func exportItems(er exportRequest) bool {
-	er.rsp_ch = make(chan bool, 1)
-	work_mgr_ch <- er
-	return <-er.rsp_ch
+// Requests an export. Returns the new export order, nil if the request did
+// not create one.
+func exportItems(er exportRequest) (*exportOrder, error) {
+	var order *exportOrder
+	err := mgrCall(func() (err error) {
+		order, err = mgrHandleExport(er)
+		return err
+	})
+	return order, err
+}
+
+// A request to run a function in the work manager goroutine, e.g. to
+// inspect or modify areas.
+type callRequest struct {
+	fn     func() error
+	rsp_ch chan error
+}
+
+// Runs fn in the work manager goroutine and returns its error.
+func mgrCall(fn func() error) error {
+	req := callRequest{
+		fn:     fn,
+		rsp_ch: make(chan error, 1),
+	}
+	work_mgr_ch <- req
+	return <-req.rsp_ch
 }
 
 type exitRequest struct{}
@@ -121,202 +177,282 @@ func workMgrExit() {
 }
 
 func workMgrGo() {
+	watchdog_ticker := time.NewTicker(watchdogInterval)
+	defer watchdog_ticker.Stop()
+	reload_ticker := time.NewTicker(stateReloadInterval)
+	defer reload_ticker.Stop()
+	registry_ticker := time.NewTicker(registryFlushInterval)
+	defer registry_ticker.Stop()
 	for {
-		req := <-work_mgr_ch
+		var req interface{}
+		select {
+		case req = <-work_mgr_ch:
+		case <-watchdog_ticker.C:
+			if err := mgrWatchdog(); err != nil {
+				log.Printf("watchdog: error: %v", err)
+			}
+			continue
+		case <-reload_ticker.C:
+			if err := mgrReloadState(); err != nil {
+				log.Printf("state reload: error: %v", err)
+			}
+			continue
+		case <-registry_ticker.C:
+			mgrFlushRegistry()
+			continue
+		}
 		switch req := req.(type) {
 		case workRequest:
-			req.rsp_ch <- mgrDecideWork(req.t)
-		case exportRequest:
-			req.rsp_ch <- mgrHandleExport(req)
+			if err := mgrLearnItemStacks(req.t); err != nil {
+				log.Printf("item catalog: error: %v: %v", req.t.Label, err)
+			}
+			job, err := mgrDecideWork(req.t)
+			mgrRecordFailure(req.t.Label, err)
+			if err := mgrRecordReport(req.t, req.raw, job); err != nil {
+				log.Printf("registry: error: %v: %v", req.t.Label, err)
+			}
+			req.rsp_ch <- workResponse{job, mgrFuelItems(req.t.Label), err}
+		case callRequest:
+			req.rsp_ch <- req.fn()
 		case exitRequest:
+			mgrFlushRegistry()
 			return
 		}
 	}
 }
 
-func mgrHandleExport(er exportRequest) bool {
+type turtleFailure struct {
+	Time  string
+	Error string
+	// number of consecutive failed requests
+	Count int
+}
+
+// Map from turtle to its last failed request. Cleared when the turtle
+// has a successful request again.
+var turtleFailures = map[turtleID]*turtleFailure{}
+
+func mgrRecordFailure(label turtleID, err error) {
+	key := "failures/" + string(label)
+	if err == nil {
+		if turtleFailures[label] != nil {
+			delete(turtleFailures, label)
+			syncNotify(key, "null")
+		}
+		return
+	}
+	log.Printf("decide work: error: %v: %v", label, err)
+	failure := turtleFailures[label]
+	if failure == nil {
+		failure = new(turtleFailure)
+		turtleFailures[label] = failure
+	}
+	failure.Time = time.Now().UTC().Format(time.RFC3339)
+	failure.Error = err.Error()
+	failure.Count++
+	raw, _ := json.Marshal(failure)
+	syncNotify(key, string(raw))
+}
+
+func mgrHandleExport(er exportRequest) (*exportOrder, error) {
 	area := areas[er.AreaID]
 	if area == nil {
-		log.Printf("handle export: error: invalid area id: %v", er.AreaID)
-		return false
-	}
-	switch area := area.(type) {
-	case *storageArea:
-		s := area
-		new_count := s.Exporting[er.ItemID] + er.Count
-		n_total := 0
-		for _, box := range s.Boxes {
-			if box.Amount < 0 {
-				continue
-			}
-			if box.Name == er.ItemID {
-				n_total += box.Amount
-			}
-		}
-		if new_count > n_total {
-			new_count = n_total
-		}
-		if new_count <= 0 {
-			delete(s.Exporting, er.ItemID)
-		} else {
-			s.Exporting[er.ItemID] = new_count
-		}
-		s.store()
-		return true
-	default:
-		log.Printf("handle export: error: do not understand area type: %T", area)
-		return false
+		return nil, errNotFound("invalid area id: %v", er.AreaID)
 	}
+	return area.handleExport(er)
 }
 
-func mgrDecideWork(t turtle) *string {
-	label_parts := strings.Split(string(t.Label), ".")
+// Returns the id of the area a turtle works in.
+func turtleAreaID(label turtleID) (areaID, error) {
+	label_parts := strings.Split(string(label), ".")
 	if len(label_parts) != 3 {
-		log.Printf("decide work: error: invalid turtle id: %v", t.Label)
-		return nil
+		return "", errBadRequest("invalid turtle id: %v", label)
+	}
+	return areaID(strings.Join(label_parts[0:2], ".")), nil
+}
+
+func mgrDecideWork(t turtle) (*job, error) {
+	area_id, err := turtleAreaID(t.Label)
+	if err != nil {
+		return nil, err
 	}
-	area_id := areaID(strings.Join(label_parts[0:2], "."))
 	area := areas[area_id]
-	if len(label_parts) != 3 {
-		log.Printf("decide work: error: invalid turtle area id: %v", t.Label)
-		return nil
+	if area == nil {
+		return nil, errNotFound("invalid turtle area id: %v", t.Label)
 	}
-	switch area := area.(type) {
-	case *storageArea:
-		return mgrDecideStorageWork(t, area)
-	case *mineArea:
-		return mgrDecideMineWork(t, area)
-	case *farmArea:
-		job, err := mgrDecideFarmWork(t, area)
-		if err != nil {
-			log.Printf("farm work error: %v: %v", t.Label, err)
+	job, err := area.decideWork(t)
+	if err != nil {
+		return nil, err
+	}
+	if job != nil {
+		if err := job.validate(); err != nil {
+			return nil, err
 		}
-		return job
-	default:
-		log.Printf("decide work: error: do not understand area type: %T", area)
+	}
+	return job, nil
+}
+
+// Returns the fuel items of the area a turtle works in, nil if the turtle
+// is not in an area.
+func mgrFuelItems(label turtleID) map[itemID]int {
+	area_id, err := turtleAreaID(label)
+	if err != nil || areas[area_id] == nil {
 		return nil
 	}
+	return areas[area_id].getFuel().itemValues()
+}
+
+// An error in handling a request that maps to a HTTP status. Errors of
+// other types are internal errors.
+type reqError struct {
+	status int
+	msg    string
+}
+
+func (e *reqError) Error() string {
+	return e.msg
+}
+
+// The request is malformed.
+func errBadRequest(format string, a ...interface{}) error {
+	return &reqError{http.StatusBadRequest, fmt.Sprintf(format, a...)}
+}
+
+// The request refers to something that does not exist.
+func errNotFound(format string, a ...interface{}) error {
+	return &reqError{http.StatusNotFound, fmt.Sprintf(format, a...)}
+}
+
+// The request does not match the current state, e.g. a turtle reports
+// work that is inconsistent with its assigned order.
+func errConflict(format string, a ...interface{}) error {
+	return &reqError{http.StatusConflict, fmt.Sprintf(format, a...)}
+}
+
+// Returns the HTTP status of a request error.
+func errStatus(err error) int {
+	if re, ok := err.(*reqError); ok {
+		return re.status
+	}
+	return http.StatusInternalServerError
 }
 
 func pathSyncKey(fs_path string) string {
 	return fmt.Sprintf("%s/%s", path.Base(path.Dir(fs_path)), path.Base(fs_path))
 }
 
-func storeJSON(fs_path string, src interface{}) {
-	storeJSONSync(fs_path, src, true)
+func storeJSON(fs_path string, src interface{}) error {
+	return storeJSONSync(fs_path, src, true)
 }
 
-func storeJSONSync(fs_path string, src interface{}, sync bool) {
+func storeJSONSync(fs_path string, src interface{}, sync bool) error {
 	raw, err := json.MarshalIndent(src, "", "\t")
-	check(err)
+	if err != nil {
+		return err
+	}
 	if sync {
 		syncNotify(pathSyncKey(fs_path), string(raw))
 	}
-	err = ioutil.WriteFile(fs_path, raw, 0644)
-	check(err)
+	return writeFileAtomic(fs_path, raw)
 }
 
-func loadJSON(fs_path string, dst interface{}) {
+// Decodes a JSON file and publishes it to sync clients.
+func loadJSON(fs_path string, dst interface{}) error {
 	raw, err := ioutil.ReadFile(fs_path)
-	check(err)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(raw, dst); err != nil {
+		return fmt.Errorf("decoding %v failed: %v", fs_path, err)
+	}
 	syncNotify(pathSyncKey(fs_path), string(raw))
-	err = json.Unmarshal(raw, dst)
-	check(err)
+	return nil
 }
 
-var rgx_row = regexp.MustCompile("^plane.([0-9]+)$")
+// Decodes a JSON file without publishing it. Area files are published by
+// syncAreaDir once the whole area loaded.
+func readJSON(fs_path string, dst interface{}) error {
+	raw, err := ioutil.ReadFile(fs_path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(raw, dst); err != nil {
+		return fmt.Errorf("decoding %v failed: %v", fs_path, err)
+	}
+	return nil
+}
 
-func loadArea(area_id areaID, area_dir string) {
-	area_parts := strings.Split(string(area_id), ".")
-	if len(area_parts) != 2 {
-		panic(fmt.Sprintf("invalid area id: %v", area_id))
+// Publishes the state files of a loaded area to sync clients.
+func syncAreaDir(area_dir string) error {
+	files, err := ioutil.ReadDir(area_dir)
+	if err != nil {
+		return err
 	}
-	area_type := area_parts[0]
-	switch area_type {
-	case "farm":
-		f := new(farmArea)
-		f.Path = fmt.Sprintf("%s/details", area_dir)
-		loadJSON(f.Path, f)
-		if f.ID != area_id {
-			panic(fmt.Sprintf("invalid farm id: %v, expected: %v", f.ID, area_id))
-		}
-		for i, plot := range f.Plots {
-			plot.Level = i
-		}
-		// Write new area.
-		areas[area_id] = f
-		log.Printf("loaded farm: %v\n", f.ID)
-	case "mine":
-		m := new(mineArea)
-		m.Path = fmt.Sprintf("%s/details", area_dir)
-		loadJSON(m.Path, m)
-		if m.ID != area_id {
-			panic(fmt.Sprintf("invalid mine id: %v, expected: %v", m.ID, area_id))
-		}
-		if m.MineProgress == nil {
-			m.MineProgress = map[string][]boreholeState{}
-		}
-		if m.MineAllocs == nil {
-			m.MineAllocs = map[turtleID]*mineOrder{}
-		}
-		// Write new area.
-		areas[area_id] = m
-		log.Printf("loaded mine: %v\n", m.ID)
-	case "storage":
-		s := new(storageArea)
-		s.Path = fmt.Sprintf("%s/details", area_dir)
-		loadJSON(s.Path, s)
-		if s.ID != area_id {
-			panic(fmt.Sprintf("invalid storage id: %v, expected: %v", s.ID, area_id))
-		}
-		if s.LoadOrders == nil {
-			s.LoadOrders = map[turtleID]*loadOrder{}
-		}
-		if s.Exporting == nil {
-			s.Exporting = map[itemID]int{}
-		}
-		if s.ExportAllocs == nil {
-			s.ExportAllocs = map[turtleID]map[itemID]int{}
+	for _, file := range files {
+		if !isStateFile(file) {
+			continue
 		}
-		s.Boxes = make([]storageBox, s.nBoxes())
-		files, err := ioutil.ReadDir(area_dir)
-		check(err)
-		// Read boxes.
-		for _, file := range files {
-			m := rgx_row.FindStringSubmatch(file.Name())
-			if m == nil {
-				continue
-			}
-			plane_id, err := strconv.Atoi(m[1])
-			check(err)
-			var row_boxes []storageBox
-			loadJSON(fmt.Sprintf("%s/%s", area_dir, file.Name()), &row_boxes)
-			for i, box := range row_boxes {
-				s.Boxes[s.nBoxesPerPlane()*plane_id+i] = box
-			}
+		fs_path := path.Join(area_dir, file.Name())
+		raw, err := ioutil.ReadFile(fs_path)
+		if err != nil {
+			return err
 		}
-		// Initialize I/O hole.
-		s.Boxes[4].Amount = -1
-		s.Boxes[5].Amount = -1
-		s.Boxes[6].Amount = -1
-		// Write new area.
-		areas[area_id] = s
-		log.Printf("loaded storage: %v\n", s.ID)
-		//fmt.Printf("loaded storage: %#v", s)
-	default:
-		panic(fmt.Sprintf("unknown area type: %v", area_type))
+		syncNotify(pathSyncKey(fs_path), string(raw))
 	}
+	return nil
 }
 
-func loadState(state_dir string) {
+func loadArea(area_id areaID, area_dir string) error {
+	a, err := newArea(area_id)
+	if err != nil {
+		return err
+	}
+	if err := snapshotStateDir(area_dir); err != nil {
+		return err
+	}
+	if err := a.load(area_id, area_dir); err != nil {
+		return fmt.Errorf("loading %v failed: %v", area_id, err)
+	}
+	if err := syncAreaDir(area_dir); err != nil {
+		return err
+	}
+	// Write new area.
+	areas[area_id] = a
+	info := a.describe()
+	log.Printf("loaded %v: %v\n", info.Type, info.ID)
+	return nil
+}
+
+// State directory, set by loadState.
+var state_dir_path string
+
+// Directory in the state directory where deleted areas are moved.
+const trashDirName = "trash"
+
+// Returns true if a directory in the state directory is an area directory.
+func isAreaDir(info os.FileInfo) bool {
+	name := info.Name()
+	return info.IsDir() && name != registryDirName && name != trashDirName
+}
+
+func loadState(state_dir string) error {
+	state_dir_path = state_dir
 	area_dirs, err := ioutil.ReadDir(state_dir)
-	check(err)
+	if err != nil {
+		return err
+	}
 	for _, area_dir := range area_dirs {
-		if !area_dir.IsDir() {
+		if !isAreaDir(area_dir) {
 			continue
 		}
 		area_id := areaID(area_dir.Name())
 		area_dir := fmt.Sprintf("%s/%s", state_dir, area_id)
-		loadArea(area_id, area_dir)
+		if err := recoverState(area_dir); err != nil {
+			return err
+		}
+		if err := loadArea(area_id, area_dir); err != nil {
+			return err
+		}
 	}
+	return nil
 }
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadStateInvalid(t *testing.T) {
+	tests := []struct {
+		files map[string]string
+		want  string
+	}{
+		{map[string]string{"storage.0/details": `{"ID": "storage.0",`}, "decoding"},
+		{map[string]string{"mine.0/details": `{"ID": "mine.1"}`}, "invalid mine id"},
+		{map[string]string{"farm.0/details": `{"ID": "farm.1"}`}, "invalid farm id"},
+		{map[string]string{"pond.0/details": `{"ID": "pond.0"}`}, "pond"},
+		{map[string]string{
+			"storage.0/details": `{"ID": "storage.0", "XLen": 4, "ZLen": 4, "Rows": 2}`,
+			"storage.0/plane.2": `[]`,
+		}, "does not fit the layout"},
+		{map[string]string{
+			"storage.0/details": `{"ID": "storage.0", "XLen": 4, "ZLen": 4, "Rows": 2}`,
+			"storage.0/routing": `[{"pattern": "minecraft:dirt/0", "action": "teleport"}]`,
+		}, "invalid routing"},
+		{map[string]string{
+			"storage.0/details": `{"ID": "storage.0", "XLen": 4, "ZLen": 4, "Rows": 2, "bulk_export": {"threshold": -5}}`,
+		}, "invalid bulk_export"},
+		{map[string]string{"turtles.watchdog": `{"lost_after": -1}`}, "invalid watchdog"},
+		{map[string]string{"storage.0/details": `{"ID": "storage.0", "layout": {"shape": "spiral", "rows": 2}}`}, "invalid layout"},
+	}
+	for _, test := range tests {
+		err := simBootServer(simStateDir(t, test.files))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("loading %v: got error %v, want %q", test.files, err, test.want)
+		}
+	}
+}